@@ -1,82 +1,301 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/alam0rt/tailscale-sidecar-injector/pkg/admission"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/controller"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/policy"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/server"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/tailscale"
 	"github.com/sirupsen/logrus"
-	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// secretReconcileInterval is how often deferred pre-auth keys are minted
+	// and expired ones removed
+	secretReconcileInterval = time.Minute
+	policyResync            = 10 * time.Minute
+	cacheSyncTimeout        = 30 * time.Second
+	namespaceResync         = 10 * time.Minute
+	configPollInterval      = 10 * time.Second
+	controllerResync        = time.Minute
+	controllerWorkers       = 2
+	leaseName               = "tailscale-sidecar-injector"
+	leaseDuration           = 15 * time.Second
+	// defaultNamespace is the namespace of the webhook unless POD_NAMESPACE
+	// is set
+	defaultNamespace = "tailscale-sidecar-webhook"
 )
 
 func main() {
 	setLogger()
+	logrus.Infof("tailscale-sidecar-injector %s", mutation.Version)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	// handle our core application
-	http.HandleFunc("/mutate-pods", ServeMutatePods)
-	http.HandleFunc("/health", ServeHealth)
+	cfg, err := kubeConfig()
+	if err != nil {
+		logrus.Fatalf("could not load kubernetes config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		logrus.Fatalf("could not create kubernetes client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		logrus.Fatalf("could not create kubernetes client: %v", err)
+	}
+
+	settings, err := config.NewStore(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		logrus.Fatalf("could not load config: %v", err)
+	}
+	go settings.Watch(ctx, logrus.WithField("component", "config"), configPollInterval, func(c *config.Config) {
+		logrus.Infof("reloaded config, injecting %s", c.ImageRef())
+	})
+
+	provider, err := authKeyProvider(ctx, settings.Get())
+	if err != nil {
+		logrus.Fatalf("could not create auth key provider: %v", err)
+	}
+	logrus.Infof("using %s auth key provider", provider.Name())
+
+	// closed once the unused pooled keys are expired on shutdown
+	poolDrained := make(chan struct{})
+	if pool := settings.Get().KeyPool; pool.Size > 0 {
+		p := mutation.NewKeyPool(logrus.WithField("component", "key_pool"), provider, pool.Size, pool.MaxAge.Duration)
+		go func() {
+			p.Run(ctx)
+			close(poolDrained)
+		}()
+		provider = p
+	} else {
+		close(poolDrained)
+	}
+
+	mutator := mutation.NewMutator(logrus.NewEntry(logrus.StandardLogger()))
+	mutator.Client = client
+	mutator.Provider = provider
+	mutator.Policies = policies(ctx, dynamicClient)
+	mutator.Namespaces = namespaces(ctx, client)
+	mutator.WebhookNamespace = getEnv("POD_NAMESPACE", defaultNamespace)
+	mutator.Config = settings
+
+	// pods are given the cleanup finalizer of the controller, they could
+	// not be deleted without it
+	var hs headscale.HeadscaleClient
+	if settings.Get().Provider.Type == config.ProviderHeadscale {
+		if hs, err = headscaleClient(ctx, settings.Get()); err != nil {
+			logrus.Fatalf("could not create headscale client: %v", err)
+		}
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		logrus.Fatalf("could not get hostname: %v", err)
+	}
+
+	// a single replica mints deferred keys and cleans up Headscale
+	go runElected(ctx, client, identity, func(ctx context.Context) {
+		go mutation.RunAuthKeySecretReconciler(ctx, logrus.WithField("component", "secret_reconciler"), client, provider, secretReconcileInterval)
+		if hs != nil {
+			if err := runController(ctx, client, hs); err != nil {
+				logrus.Errorf("controller stopped, releasing the lease: %v", err)
+				return
+			}
+		}
+		<-ctx.Done()
+	})
+
+	srv := &server.Server{
+		Addr:          ":8080",
+		Logger:        logrus.WithField("component", "server"),
+		Mutator:       mutator,
+		ShutdownDelay: server.DefaultShutdownDelay,
+	}
 
-	// start the server
 	// listens to clear text http on port 8080 unless TLS env var is set to "true"
 	if os.Getenv("TLS") == "true" {
-		cert := "/etc/admission-webhook/tls/tls.crt"
-		key := "/etc/admission-webhook/tls/tls.key"
-		logrus.Print("Listening on port 443...")
-		logrus.Fatal(http.ListenAndServeTLS(":443", cert, key, nil))
-	} else {
-		logrus.Print("Listening on port 8080...")
-		logrus.Fatal(http.ListenAndServe(":8080", nil))
+		srv.Addr = ":443"
+		srv.CertFile = getEnv("TLS_CERT_FILE", "/etc/admission-webhook/tls/tls.crt")
+		srv.KeyFile = getEnv("TLS_KEY_FILE", "/etc/admission-webhook/tls/tls.key")
 	}
 
+	if err := srv.Run(ctx); err != nil {
+		logrus.Fatal(err)
+	}
+	<-poolDrained
 }
 
-// ServeHealth returns 200 when things are good
-func ServeHealth(w http.ResponseWriter, r *http.Request) {
-	logrus.WithField("uri", r.RequestURI).Debug("healthy")
-	fmt.Fprint(w, "OK")
+// getEnv returns the value of the environment variable key or defaultValue
+// when it is unset
+func getEnv(key, defaultValue string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return defaultValue
 }
 
-// ServeMutatePods returns an admission review with pod mutations as a json patch
-// in the review response
-func ServeMutatePods(w http.ResponseWriter, r *http.Request) {
-	logger := logrus.WithField("uri", r.RequestURI)
-	logger.Debug("received mutation request")
+// kubeConfig loads the kubernetes client config from KUBECONFIG if set,
+// falling back to the in-cluster service account
+func kubeConfig() (*rest.Config, error) {
+	if path := os.Getenv("KUBECONFIG"); path != "" {
+		return clientcmd.BuildConfigFromFlags("", path)
+	}
+	return rest.InClusterConfig()
+}
 
-	in, err := parseRequest(*r)
-	if err != nil {
-		logger.Error(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// runElected runs fn whenever this replica holds the lease, until the
+// context is cancelled. The context of fn is cancelled when the lease is
+// lost, and the lease is released when fn returns so another replica takes
+// over
+func runElected(ctx context.Context, client kubernetes.Interface, identity string, fn func(ctx context.Context)) {
+	logger := logrus.WithField("component", "leader_election")
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: getEnv("POD_NAMESPACE", defaultNamespace),
+		},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
 	}
 
-	adm := admission.Admitter{
-		Logger:  logger,
-		Request: in.Request,
+	for ctx.Err() == nil {
+		term, cancel := context.WithCancel(ctx)
+		leaderelection.RunOrDie(term, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					logger.Info("acquired lease")
+					fn(ctx)
+					cancel()
+				},
+				OnStoppedLeading: func() {
+					logger.Info("lost lease")
+				},
+			},
+		})
+		cancel()
+
+		// leave the released lease to the other replicas for a while
+		select {
+		case <-ctx.Done():
+		case <-time.After(leaseDuration):
+		}
 	}
+}
 
-	out, err := adm.MutatePodReview()
-	if err != nil {
-		e := fmt.Sprintf("could not generate admission response: %v", err)
-		logger.Error(e)
-		http.Error(w, e, http.StatusInternalServerError)
-		return
+// headscaleClient returns the client of the controller
+func headscaleClient(ctx context.Context, c *config.Config) (headscale.HeadscaleClient, error) {
+	address := c.Headscale.Address
+	if address == "" {
+		address = c.LoginServer
 	}
+	return headscale.Dial(ctx, headscale.Options{
+		Transport: c.Headscale.Transport,
+		APIKey:    os.Getenv("HEADSCALE_CLI_API_KEY"),
+		Address:   address,
+		Insecure:  c.Headscale.Insecure,
+		Retry:     c.Headscale.RetryPolicy(),
+		Breaker:   c.Headscale.BreakerPolicy(),
+	})
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	jout, err := json.Marshal(out)
-	if err != nil {
-		e := fmt.Sprintf("could not parse admission response: %v", err)
-		logger.Error(e)
-		http.Error(w, e, http.StatusInternalServerError)
-		return
+// runController runs the Headscale cleanup controller until the context is
+// cancelled
+func runController(ctx context.Context, client kubernetes.Interface, hs headscale.HeadscaleClient) error {
+	logger := logrus.WithField("component", "controller")
+	logger.Info("starting controller")
+	ctrl := controller.New(logger, client, hs, controllerResync)
+	return ctrl.Run(ctx, controllerWorkers)
+}
+
+// policies starts watching TailscaleSidecarPolicies, admissions are served
+// without policies if the cache cannot be synced in time (e.g. the CRD is
+// not installed)
+func policies(ctx context.Context, client dynamic.Interface) *policy.Lister {
+	l := policy.NewLister(client, policyResync)
+	go l.Run(ctx)
+
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+	if !l.WaitForSync(syncCtx) {
+		logrus.Warn("TailscaleSidecarPolicy cache not synced, is the CRD installed?")
+	}
+	return l
+}
+
+// namespaces starts watching namespaces, which opt their pods into
+// injection. Namespaces are looked up in the API server if the cache
+// cannot be synced in time
+func namespaces(ctx context.Context, client kubernetes.Interface) corelisters.NamespaceLister {
+	factory := informers.NewSharedInformerFactory(client, namespaceResync)
+	informer := factory.Core().V1().Namespaces()
+	lister := informer.Lister()
+	factory.Start(ctx.Done())
+
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), informer.Informer().HasSynced) {
+		logrus.Warn("namespace cache not synced, is the webhook allowed to list namespaces?")
+		return nil
 	}
+	return lister
+}
 
-	logger.Debug("sending response")
-	logger.Debugf("%s", jout)
-	fmt.Fprintf(w, "%s", jout)
+// authKeyProvider builds the configured provider, credentials are read from
+// the environment so they can be kept in a secret
+func authKeyProvider(ctx context.Context, settings *config.Config) (mutation.AuthKeyProvider, error) {
+	c := settings.Provider
+	switch c.Type {
+	case config.ProviderHeadscale:
+		return &mutation.HeadscaleProvider{
+			APIKey:    os.Getenv("HEADSCALE_CLI_API_KEY"),
+			Transport: settings.Headscale.Transport,
+			Insecure:  settings.Headscale.Insecure,
+			Retry:     settings.Headscale.RetryPolicy(),
+			Breaker:   settings.Headscale.BreakerPolicy(),
+		}, nil
+	case config.ProviderTailscale:
+		ts, err := tailscale.New(ctx, "", "", "")
+		if err != nil {
+			return nil, err
+		}
+		if c.Tailnet != "" {
+			ts.Tailnet = c.Tailnet
+		}
+		return &mutation.TailscaleProvider{Client: ts}, nil
+	case config.ProviderStatic:
+		return &mutation.StaticSecretProvider{
+			SecretName: c.SecretName,
+			Key:        c.SecretKey,
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", mutation.ErrUnknownProvider, c.Type)
+	}
 }
 
 // setLogger sets the logger using env vars, it defaults to text logs on
@@ -97,31 +316,3 @@ func setLogger() {
 		logrus.SetFormatter(&logrus.JSONFormatter{})
 	}
 }
-
-// parseRequest extracts an AdmissionReview from an http.Request if possible
-func parseRequest(r http.Request) (*admissionv1.AdmissionReview, error) {
-	if r.Header.Get("Content-Type") != "application/json" {
-		return nil, fmt.Errorf("Content-Type: %q should be %q",
-			r.Header.Get("Content-Type"), "application/json")
-	}
-
-	bodybuf := new(bytes.Buffer)
-	bodybuf.ReadFrom(r.Body)
-	body := bodybuf.Bytes()
-
-	if len(body) == 0 {
-		return nil, fmt.Errorf("admission request body is empty")
-	}
-
-	var a admissionv1.AdmissionReview
-
-	if err := json.Unmarshal(body, &a); err != nil {
-		return nil, fmt.Errorf("could not parse admission review request: %v", err)
-	}
-
-	if a.Request == nil {
-		return nil, fmt.Errorf("admission review can't be used: Request field is nil")
-	}
-
-	return &a, nil
-}
@@ -4,15 +4,22 @@
 package admission
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/metrics"
 	"github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation"
 	"github.com/sirupsen/logrus"
+	"github.com/wI2L/jsondiff"
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	types "k8s.io/apimachinery/pkg/types"
 )
 
@@ -20,25 +27,57 @@ import (
 type Admitter struct {
 	Logger  *logrus.Entry
 	Request *admissionv1.AdmissionRequest
+	// Mutator holds the dependencies shared by every mutation
+	Mutator *mutation.Mutator
 }
 
 // MutatePodReview takes an admission request and mutates the pod within,
-// it returns an admission review with mutations as a json patch (if any)
-func (a Admitter) MutatePodReview() (*admissionv1.AdmissionReview, error) {
+// it returns an admission review with mutations as a json patch (if any).
+// Pods which cannot be mutated are denied with the reason in the review.
+// The context should expire before the API server gives up on the webhook
+func (a Admitter) MutatePodReview(ctx context.Context) (*admissionv1.AdmissionReview, error) {
+	start := time.Now()
+	outcome := metrics.OutcomeErrored
+	defer func() {
+		metrics.ObserveAdmission(outcome, time.Since(start))
+	}()
+
 	pod, err := a.Pod()
 	if err != nil {
 		e := fmt.Sprintf("could not parse pod in admission review request: %v", err)
 		return reviewResponse(a.Request.UID, false, http.StatusBadRequest, e), err
 	}
 
-	m := mutation.NewMutator(a.Logger)
-	patch, err := m.MutatePodPatch(pod)
+	// the containers of a pod cannot change once it is created
+	if a.Request.Operation == admissionv1.Update {
+		outcome = metrics.OutcomeSkipped
+		return patchReviewResponse(a.Request.UID, nil)
+	}
+
+	result, err := a.Mutator.MutatePodPatch(ctx, pod, a.dryRun())
 	if err != nil {
 		e := fmt.Sprintf("could not mutate pod: %v", err)
-		return reviewResponse(a.Request.UID, false, http.StatusBadRequest, e), err
+		a.Logger.Error(e)
+		return reviewResponse(a.Request.UID, false, http.StatusForbidden, e), nil
+	}
+
+	switch {
+	case result.FailedOpen:
+		outcome = metrics.OutcomeFailedOpen
+	case result.Deferred:
+		outcome = metrics.OutcomeDeferred
+	case emptyPatch(result.Patch):
+		outcome = metrics.OutcomeSkipped
+	default:
+		outcome = metrics.OutcomeInjected
 	}
 
-	return patchReviewResponse(a.Request.UID, patch)
+	review, err := patchReviewResponse(a.Request.UID, result.Patch)
+	if err != nil {
+		return nil, err
+	}
+	review.Response.Warnings = result.Warnings
+	return review, nil
 }
 
 // Pod extracts a pod from an admission request
@@ -52,9 +91,106 @@ func (a Admitter) Pod() (*corev1.Pod, error) {
 		return nil, err
 	}
 
+	// the namespace is not always set on pods being created
+	if p.Namespace == "" {
+		p.Namespace = a.Request.Namespace
+	}
+
 	return &p, nil
 }
 
+// MutateWorkloadReview takes an admission request for a workload and injects
+// the sidecar into its pod template, it returns an admission review with
+// mutations as a json patch (if any). Workloads which cannot be mutated are
+// denied with the reason in the review
+func (a Admitter) MutateWorkloadReview(ctx context.Context) (*admissionv1.AdmissionReview, error) {
+	start := time.Now()
+	outcome := metrics.OutcomeErrored
+	defer func() {
+		metrics.ObserveAdmission(outcome, time.Since(start))
+	}()
+
+	obj, tmpl, err := a.Workload()
+	if err != nil {
+		e := fmt.Sprintf("could not parse workload in admission review request: %v", err)
+		return reviewResponse(a.Request.UID, false, http.StatusBadRequest, e), err
+	}
+	original := obj.DeepCopyObject()
+
+	result, err := a.Mutator.MutateTemplate(ctx, a.Request.Namespace, tmpl, a.dryRun())
+	if err != nil {
+		e := fmt.Sprintf("could not mutate pod template: %v", err)
+		a.Logger.Error(e)
+		return reviewResponse(a.Request.UID, false, http.StatusForbidden, e), nil
+	}
+
+	patch, err := jsondiff.Compare(original, obj)
+	if err != nil {
+		return nil, err
+	}
+	result.Patch, err = json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	outcome = metrics.OutcomeInjected
+	if emptyPatch(result.Patch) {
+		outcome = metrics.OutcomeSkipped
+	}
+
+	review, err := patchReviewResponse(a.Request.UID, result.Patch)
+	if err != nil {
+		return nil, err
+	}
+	review.Response.Warnings = result.Warnings
+	return review, nil
+}
+
+// Workload extracts a workload and its pod template from an admission
+// request, the template points into the workload
+func (a Admitter) Workload() (runtime.Object, *corev1.PodTemplateSpec, error) {
+	var (
+		obj  runtime.Object
+		tmpl *corev1.PodTemplateSpec
+	)
+	switch a.Request.Kind.Kind {
+	case "Deployment":
+		d := &appsv1.Deployment{}
+		obj, tmpl = d, &d.Spec.Template
+	case "StatefulSet":
+		s := &appsv1.StatefulSet{}
+		obj, tmpl = s, &s.Spec.Template
+	case "DaemonSet":
+		d := &appsv1.DaemonSet{}
+		obj, tmpl = d, &d.Spec.Template
+	case "Job":
+		j := &batchv1.Job{}
+		obj, tmpl = j, &j.Spec.Template
+	case "CronJob":
+		c := &batchv1.CronJob{}
+		obj, tmpl = c, &c.Spec.JobTemplate.Spec.Template
+	default:
+		return nil, nil, fmt.Errorf("kind %s is not supported here", a.Request.Kind.Kind)
+	}
+
+	if err := json.Unmarshal(a.Request.Object.Raw, obj); err != nil {
+		return nil, nil, err
+	}
+	return obj, tmpl, nil
+}
+
+// dryRun reports whether the request must have no side effect, e.g. from
+// kubectl apply --dry-run=server
+func (a Admitter) dryRun() bool {
+	return a.Request.DryRun != nil && *a.Request.DryRun
+}
+
+// emptyPatch reports whether a json patch has no operations
+func emptyPatch(patch []byte) bool {
+	p := string(patch)
+	return p == "" || p == "null" || p == "[]"
+}
+
 // reviewResponse TODO: godoc
 func reviewResponse(uid types.UID, allowed bool, httpCode int32,
 	reason string) *admissionv1.AdmissionReview {
@@ -1,12 +1,19 @@
 package admission
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"testing"
 
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/metrics"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -96,3 +103,132 @@ func TestPatchReviewResponse(t *testing.T) {
 	}
 	assert.Equal(t, want, got)
 }
+
+func TestMutatePodReviewMetrics(t *testing.T) {
+	raw, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "unlabelled"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitter := func(kind string) Admitter {
+		return Admitter{
+			Logger:  logrus.NewEntry(logrus.New()),
+			Mutator: mutation.NewMutator(logrus.NewEntry(logrus.New())),
+			Request: &admissionv1.AdmissionRequest{
+				UID:    types.UID("test"),
+				Kind:   metav1.GroupVersionKind{Version: "v1", Kind: kind},
+				Object: runtime.RawExtension{Raw: raw},
+			},
+		}
+	}
+
+	skipped := testutil.ToFloat64(metrics.AdmissionRequests.WithLabelValues(metrics.OutcomeSkipped))
+	errored := testutil.ToFloat64(metrics.AdmissionRequests.WithLabelValues(metrics.OutcomeErrored))
+
+	_, err = admitter("Pod").MutatePodReview(context.Background())
+	assert.NoError(t, err)
+	_, err = admitter("Deployment").MutatePodReview(context.Background())
+	assert.Error(t, err)
+
+	assert.Equal(t, skipped+1, testutil.ToFloat64(metrics.AdmissionRequests.WithLabelValues(metrics.OutcomeSkipped)))
+	assert.Equal(t, errored+1, testutil.ToFloat64(metrics.AdmissionRequests.WithLabelValues(metrics.OutcomeErrored)))
+}
+
+func TestMutatePodReviewUpdate(t *testing.T) {
+	raw, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:   "web",
+		Labels: map[string]string{mutation.InjectLabel: "true"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := Admitter{
+		Logger:  logrus.NewEntry(logrus.New()),
+		Mutator: mutation.NewMutator(logrus.NewEntry(logrus.New())),
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test"),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Update,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+
+	review, err := a.MutatePodReview(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, review.Response.Allowed)
+	assert.True(t, emptyPatch(review.Response.Patch), "pods are only injected when created")
+}
+
+func TestWorkload(t *testing.T) {
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+	}
+	workloads := map[string]any{
+		"Deployment":  &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}},
+		"StatefulSet": &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: template}},
+		"DaemonSet":   &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Template: template}},
+		"Job":         &batchv1.Job{Spec: batchv1.JobSpec{Template: template}},
+		"CronJob": &batchv1.CronJob{Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+		}},
+	}
+
+	for kind, workload := range workloads {
+		t.Run(kind, func(t *testing.T) {
+			raw, err := json.Marshal(workload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := Admitter{Request: &admissionv1.AdmissionRequest{
+				Kind:   metav1.GroupVersionKind{Kind: kind},
+				Object: runtime.RawExtension{Raw: raw},
+			}}
+
+			obj, tmpl, err := a.Workload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, workload, obj)
+			assert.Equal(t, "web", tmpl.Labels["app"])
+
+			// the template points into the workload
+			tmpl.Labels["app"] = "api"
+			raw, err = json.Marshal(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Contains(t, string(raw), `"app":"api"`)
+		})
+	}
+
+	a := Admitter{Request: &admissionv1.AdmissionRequest{Kind: metav1.GroupVersionKind{Kind: "ReplicaSet"}}}
+	_, _, err := a.Workload()
+	assert.Error(t, err)
+}
+
+func TestMutateWorkloadReviewDisabled(t *testing.T) {
+	raw, err := json.Marshal(&appsv1.Deployment{Spec: appsv1.DeploymentSpec{
+		Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{mutation.InjectLabel: "true"},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := Admitter{
+		Logger:  logrus.NewEntry(logrus.New()),
+		Mutator: mutation.NewMutator(logrus.NewEntry(logrus.New())),
+		Request: &admissionv1.AdmissionRequest{
+			UID:    types.UID("test"),
+			Kind:   metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Object: runtime.RawExtension{Raw: raw},
+		},
+	}
+
+	review, err := a.MutateWorkloadReview(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, review.Response.Allowed)
+	assert.True(t, emptyPatch(review.Response.Patch), "templates are only injected when enabled")
+}
@@ -0,0 +1,4 @@
+// Package v1alpha1 contains the tailscale.iced.cool/v1alpha1 API types
+// +kubebuilder:object:generate=true
+// +groupName=tailscale.iced.cool
+package v1alpha1
@@ -0,0 +1,195 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// TailscaleSidecarPolicy sets the sidecar defaults for the pods it selects
+// in its namespace. Pod annotations take precedence over the policy
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=tsp
+// +kubebuilder:printcolumn:name="User",type=string,JSONPath=`.spec.user`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+type TailscaleSidecarPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TailscaleSidecarPolicySpec `json:"spec"`
+}
+
+type TailscaleSidecarPolicySpec struct {
+	// PodSelector selects the pods the policy applies to, an empty selector
+	// selects every pod in the namespace
+	// +optional
+	PodSelector metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// User is the user pre-auth keys are created for
+	// +optional
+	User string `json:"user,omitempty"`
+
+	// Tags are the ACL tags given to the nodes, without the "tag:" prefix.
+	// Each must be allowed in the namespace by allowedTags of the config
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+
+	// Image is the tailscale image used by the sidecar
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Userspace runs tailscaled with userspace networking
+	// +optional
+	Userspace *bool `json:"userspace,omitempty"`
+
+	// LoginServer is the control server the sidecar logs into
+	// +optional
+	LoginServer string `json:"loginServer,omitempty"`
+
+	// Resources of the sidecar container
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// ExtraArgs are appended to TS_EXTRA_ARGS, they may not advertise
+	// routes, tags or an exit node
+	// +optional
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+
+	// FailurePolicy decides what happens to a pod when no pre-auth key
+	// can be minted for it
+	// +kubebuilder:validation:Enum=fail-closed;fail-open;defer
+	// +optional
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+
+	// NodeMode decides the kind of pre-auth key minted for the pods and
+	// whether their node outlives them
+	// +kubebuilder:validation:Enum=ephemeral;reusable;persistent
+	// +optional
+	NodeMode NodeMode `json:"nodeMode,omitempty"`
+
+	// Hostname is a template of the Tailscale hostname of the pods, e.g.
+	// {{.Namespace}}-{{.OwnerName}}-{{.Ordinal}}
+	// +optional
+	Hostname string `json:"hostname,omitempty"`
+
+	// Serve publishes ports of the pods on the tailnet with tailscale serve
+	// +optional
+	Serve []ServePort `json:"serve,omitempty"`
+
+	// AdvertiseRoutes are the prefixes the pods route the tailnet to, e.g.
+	// the service CIDR of the cluster. Each must be allowed in the
+	// namespace by routes.allowed of the config
+	// +optional
+	AdvertiseRoutes []string `json:"advertiseRoutes,omitempty"`
+
+	// AdvertiseExitNode offers the pods as exit nodes, routes.allowed of
+	// the config must allow 0.0.0.0/0 and ::/0 in the namespace
+	// +optional
+	AdvertiseExitNode *bool `json:"advertiseExitNode,omitempty"`
+
+	// AcceptRoutes routes the traffic of the pods to the subnets
+	// advertised by other nodes
+	// +optional
+	AcceptRoutes *bool `json:"acceptRoutes,omitempty"`
+
+	// ExitNode is the IP or name of the exit node the pods send their
+	// internet traffic through
+	// +optional
+	ExitNode string `json:"exitNode,omitempty"`
+
+	// ProxyContainers are the containers given the proxy env of userspace
+	// sidecars, every container by default
+	// +optional
+	ProxyContainers []string `json:"proxyContainers,omitempty"`
+}
+
+// ServePort publishes a port of a pod on the tailnet
+type ServePort struct {
+	// Protocol is http, https or tcp
+	// +kubebuilder:validation:Enum=http;https;tcp
+	Protocol ServeProtocol `json:"protocol"`
+
+	// Port is the port published on the tailnet
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+
+	// TargetPort is the container port, by number or name, traffic is
+	// sent to. It defaults to Port
+	// +optional
+	TargetPort intstr.IntOrString `json:"targetPort,omitempty"`
+
+	// Funnel also publishes the port on the internet, only https ports
+	// 443, 8443 and 10000 can be funneled
+	// +optional
+	Funnel bool `json:"funnel,omitempty"`
+}
+
+// ServeProtocol is how tailscale serve handles a published port
+type ServeProtocol string
+
+const (
+	// ServeHTTP proxies HTTP to the container
+	ServeHTTP ServeProtocol = "http"
+	// ServeHTTPS terminates TLS with the certificate of the node and
+	// proxies HTTP to the container
+	ServeHTTPS ServeProtocol = "https"
+	// ServeTCP forwards TCP to the container
+	ServeTCP ServeProtocol = "tcp"
+)
+
+// FailurePolicy decides what happens to a pod when no pre-auth key can be
+// minted for it
+type FailurePolicy string
+
+const (
+	// FailClosed rejects the pod
+	FailClosed FailurePolicy = "fail-closed"
+	// FailOpen admits the pod without the sidecar
+	FailOpen FailurePolicy = "fail-open"
+	// Defer injects the sidecar and mints the key in the background
+	Defer FailurePolicy = "defer"
+)
+
+// Valid reports whether p is a known failure policy
+func (p FailurePolicy) Valid() bool {
+	switch p {
+	case FailClosed, FailOpen, Defer:
+		return true
+	}
+	return false
+}
+
+// NodeMode decides the kind of pre-auth key minted for a pod
+type NodeMode string
+
+const (
+	// Ephemeral nodes join with a single use key and are removed from the
+	// tailnet once the pod is gone, it suits Deployments and Jobs
+	Ephemeral NodeMode = "ephemeral"
+	// Reusable nodes are ephemeral but their key may be used again, e.g.
+	// by a sidecar which lost its state when restarting
+	Reusable NodeMode = "reusable"
+	// Persistent nodes keep their identity across restarts of the pod, in
+	// a state secret and under a hostname derived from the StatefulSet
+	// ordinal of the pod
+	Persistent NodeMode = "persistent"
+)
+
+// Valid reports whether m is a known node mode
+func (m NodeMode) Valid() bool {
+	switch m {
+	case Ephemeral, Reusable, Persistent:
+		return true
+	}
+	return false
+}
+
+// TailscaleSidecarPolicyList is a list of TailscaleSidecarPolicy
+// +kubebuilder:object:root=true
+type TailscaleSidecarPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []TailscaleSidecarPolicy `json:"items"`
+}
@@ -0,0 +1,479 @@
+// Package config loads the cluster-wide injector configuration, usually
+// mounted from a ConfigMap, and keeps it up to date as the file changes
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ProviderHeadscale string = "headscale"
+	ProviderTailscale string = "tailscale"
+	ProviderStatic    string = "static"
+
+	// Pod Security Standards levels
+	PodSecurityPrivileged string = "privileged"
+	PodSecurityBaseline   string = "baseline"
+	PodSecurityRestricted string = "restricted"
+
+	// maxKeyTTL is the longest expiry accepted by the Tailscale API
+	maxKeyTTL = 90 * 24 * time.Hour
+)
+
+// Config is the cluster-wide configuration of the injector. Every field
+// is reloaded when the file changes except Provider which is only read at
+// startup
+type Config struct {
+	// Image is the tailscale image injected as a sidecar, without tag
+	Image string `json:"image"`
+	// Tag of the tailscale image
+	Tag string `json:"tag"`
+	// SecretName is the default TS_KUBE_SECRET the sidecar keeps its state in
+	SecretName string `json:"secretName"`
+	// KeyTTL is how long the pre-auth key minted for a pod stays valid
+	KeyTTL metav1.Duration `json:"keyTTL"`
+	// DefaultTags are the ACL tags, without the "tag:" prefix, given to
+	// nodes when neither a policy nor the pod sets any
+	DefaultTags []string `json:"defaultTags"`
+	// NamespaceTag adds the namespace of the pod to DefaultTags
+	NamespaceTag bool `json:"namespaceTag"`
+	// AllowedTags lists by namespace the ACL tags, without the "tag:"
+	// prefix, pods may ask for with the tags annotation or a policy. Tags
+	// may be patterns as in path.Match and the "*" namespace applies to
+	// every namespace. Pods may ask for no tag when it is empty
+	AllowedTags map[string][]string `json:"allowedTags,omitempty"`
+	// ExcludedNamespaces are never injected, whatever the labels of their
+	// pods. Namespaces may be patterns as in path.Match. The namespace of
+	// the webhook is always excluded
+	ExcludedNamespaces []string `json:"excludedNamespaces"`
+	// InjectTemplates injects the sidecar into the pod templates of the
+	// workloads sent to /mutate-workloads, their pods still get their key
+	// when admitted
+	InjectTemplates bool `json:"injectTemplates"`
+	// Resources of sidecars unless a policy or annotations set them
+	Resources corev1.ResourceRequirements `json:"resources"`
+	// HealthCheck configures the startup probe of sidecars
+	HealthCheck HealthCheckConfig `json:"healthCheck"`
+	// PodSecurity decides how sidecars comply with Pod Security admission
+	PodSecurity PodSecurityConfig `json:"podSecurity"`
+	// Proxy configures the proxies of userspace sidecars
+	Proxy ProxyConfig `json:"proxy"`
+	// Routes decides which subnet routes pods may advertise
+	Routes RoutesConfig `json:"routes"`
+	// LoginServer is the default control server sidecars log into
+	LoginServer string `json:"loginServer,omitempty"`
+	// AllowedLoginServers are the other login servers pods may log into
+	// with the login-server annotation or a policy. Their keys are minted
+	// with the API of the login server itself
+	AllowedLoginServers []string `json:"allowedLoginServers,omitempty"`
+	// Hostname is the default template of the Tailscale hostname of pods,
+	// e.g. {{.Namespace}}-{{.OwnerName}}-{{.Ordinal}}. When empty nodes are
+	// named after the pod
+	Hostname string `json:"hostname,omitempty"`
+	// FailurePolicy is the default behaviour when no pre-auth key can be
+	// minted for a pod, one of fail-closed, fail-open or defer
+	FailurePolicy v1alpha1.FailurePolicy `json:"failurePolicy"`
+	Headscale     HeadscaleConfig        `json:"headscale"`
+	Provider      ProviderConfig         `json:"provider"`
+	// KeyPool is only read at startup
+	KeyPool KeyPoolConfig `json:"keyPool"`
+}
+
+type HealthCheckConfig struct {
+	// Enabled serves /healthz on Port and holds back the app containers
+	// until the node joined the tailnet
+	Enabled bool `json:"enabled"`
+	// Port of the local endpoint of tailscaled, TS_LOCAL_ADDR_PORT
+	Port int32 `json:"port"`
+	// StartupTimeout is how long a sidecar has to join the tailnet before
+	// it is restarted
+	StartupTimeout metav1.Duration `json:"startupTimeout"`
+}
+
+type PodSecurityConfig struct {
+	// DefaultLevel is the level enforced in namespaces without the
+	// pod-security.kubernetes.io/enforce label, as configured for the
+	// cluster. Sidecars fall back to userspace below privileged
+	DefaultLevel string `json:"defaultLevel"`
+	// TunDeviceResource is the extended resource of a device plugin
+	// providing /dev/net/tun, e.g. squat.ai/tun. The device is mounted from
+	// the host when empty
+	TunDeviceResource string `json:"tunDeviceResource,omitempty"`
+}
+
+type ProxyConfig struct {
+	// Port the SOCKS5 and HTTP proxies of userspace sidecars listen on
+	// localhost
+	Port int32 `json:"port"`
+	// NoProxy are the hosts, domains and CIDRs app containers reach
+	// without the proxy
+	NoProxy []string `json:"noProxy"`
+}
+
+type RoutesConfig struct {
+	// Allowed lists by namespace the prefixes pods may advertise routes
+	// within with the advertise-routes annotation or a policy, the "*"
+	// namespace applies to every namespace. Exit nodes need 0.0.0.0/0 and
+	// ::/0. Pods may advertise no route when it is empty
+	Allowed map[string][]string `json:"allowed,omitempty"`
+	// AutoApprove enables the routes advertised by pods in Headscale once
+	// their node joined
+	AutoApprove bool `json:"autoApprove"`
+}
+
+type KeyPoolConfig struct {
+	// Size is the number of pre-minted keys kept ready per user and set of
+	// tags, 0 disables the pool
+	Size int `json:"size"`
+	// MaxAge is how long a pooled key waits to be handed out before it is
+	// replaced, it must be shorter than keyTTL. Pooled keys are minted for
+	// keyTTL, pods are given keys valid for at least keyTTL less MaxAge
+	MaxAge metav1.Duration `json:"maxAge"`
+}
+
+type HeadscaleConfig struct {
+	// Address of the Headscale API, defaults to HEADSCALE_CLI_ADDRESS
+	Address string `json:"address,omitempty"`
+	// CreateUsers creates the user of a pod when it does not exist yet
+	CreateUsers bool `json:"createUsers,omitempty"`
+	// Transport is rest (the default) or grpc, it is only read on startup
+	Transport string `json:"transport,omitempty"`
+	// Insecure skips verifying the certificate of Headscale, it is only
+	// read on startup
+	Insecure bool `json:"insecure,omitempty"`
+	// Retry and CircuitBreaker apply to both transports, they are only
+	// read on startup
+	Retry          RetryConfig          `json:"retry"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuitBreaker"`
+}
+
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts of a call including the first
+	// one, 1 disables retries
+	MaxAttempts int `json:"maxAttempts"`
+	// BaseDelay is the backoff before the first retry, it doubles on every
+	// retry up to MaxDelay
+	BaseDelay metav1.Duration `json:"baseDelay"`
+	MaxDelay  metav1.Duration `json:"maxDelay"`
+}
+
+type CircuitBreakerConfig struct {
+	// Threshold is the number of consecutive failures after which calls
+	// fail fast, 0 disables the circuit breaker
+	Threshold int `json:"threshold"`
+	// Cooldown is how long calls fail fast before Headscale is tried again
+	Cooldown metav1.Duration `json:"cooldown"`
+}
+
+// RetryPolicy returns the retry policy of the Headscale client
+func (c HeadscaleConfig) RetryPolicy() headscale.RetryPolicy {
+	return headscale.RetryPolicy{
+		MaxAttempts: c.Retry.MaxAttempts,
+		BaseDelay:   c.Retry.BaseDelay.Duration,
+		MaxDelay:    c.Retry.MaxDelay.Duration,
+	}
+}
+
+// BreakerPolicy returns the circuit breaker policy of the Headscale client
+func (c HeadscaleConfig) BreakerPolicy() headscale.BreakerPolicy {
+	return headscale.BreakerPolicy{
+		Threshold: c.CircuitBreaker.Threshold,
+		Cooldown:  c.CircuitBreaker.Cooldown.Duration,
+	}
+}
+
+type ProviderConfig struct {
+	// Type is one of headscale, tailscale or static
+	Type string `json:"type"`
+	// Tailnet keys are minted in by the tailscale provider
+	Tailnet string `json:"tailnet,omitempty"`
+	// SecretName holds the key handed out by the static provider
+	SecretName string `json:"secretName,omitempty"`
+	// SecretKey is the key within SecretName holding the pre-auth key
+	SecretKey string `json:"secretKey,omitempty"`
+}
+
+// Default returns the configuration used when no file is provided
+func Default() *Config {
+	return &Config{
+		Image:         "ghcr.io/tailscale/tailscale",
+		Tag:           "latest",
+		SecretName:    "tailscale-auth",
+		KeyTTL:        metav1.Duration{Duration: 2 * time.Minute},
+		DefaultTags:   []string{"pod"},
+		NamespaceTag:  true,
+		FailurePolicy: v1alpha1.FailClosed,
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("10m"),
+				corev1.ResourceMemory: resource.MustParse("32Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+		},
+		HealthCheck: HealthCheckConfig{
+			Enabled:        true,
+			Port:           9002,
+			StartupTimeout: metav1.Duration{Duration: 2 * time.Minute},
+		},
+		PodSecurity: PodSecurityConfig{
+			DefaultLevel: PodSecurityPrivileged,
+		},
+		Proxy: ProxyConfig{
+			Port:    1055,
+			NoProxy: []string{"localhost", "127.0.0.1", "::1", ".svc", ".cluster.local"},
+		},
+		Headscale: HeadscaleConfig{
+			Retry: RetryConfig{
+				MaxAttempts: headscale.DefaultRetryPolicy.MaxAttempts,
+				BaseDelay:   metav1.Duration{Duration: headscale.DefaultRetryPolicy.BaseDelay},
+				MaxDelay:    metav1.Duration{Duration: headscale.DefaultRetryPolicy.MaxDelay},
+			},
+			CircuitBreaker: CircuitBreakerConfig{
+				Threshold: headscale.DefaultBreakerPolicy.Threshold,
+				Cooldown:  metav1.Duration{Duration: headscale.DefaultBreakerPolicy.Cooldown},
+			},
+		},
+		Provider: ProviderConfig{
+			Type: ProviderHeadscale,
+		},
+		KeyPool: KeyPoolConfig{
+			MaxAge: metav1.Duration{Duration: time.Minute},
+		},
+		ExcludedNamespaces: []string{"kube-system", "kube-public", "kube-node-lease"},
+	}
+}
+
+// Parse reads a YAML or JSON configuration on top of the defaults and
+// validates it, unknown fields are rejected. Resources set in the file
+// replace the default resources instead of being merged with them
+func Parse(data []byte) (*Config, error) {
+	c := Default()
+	var set struct {
+		Resources *json.RawMessage `json:"resources"`
+	}
+	// errors are reported by the strict unmarshalling
+	if err := yaml.Unmarshal(data, &set); err == nil && set.Resources != nil {
+		c.Resources = corev1.ResourceRequirements{}
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("could not parse config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load reads and validates the configuration file at path
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Validate returns an error describing every invalid field
+func (c *Config) Validate() error {
+	var errs []string
+
+	if c.Image == "" {
+		errs = append(errs, "image must be set")
+	}
+	if c.Tag == "" {
+		errs = append(errs, "tag must be set")
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(c.SecretName) {
+		errs = append(errs, fmt.Sprintf("secretName %q: %s", c.SecretName, msg))
+	}
+	if c.KeyTTL.Duration <= 0 || c.KeyTTL.Duration > maxKeyTTL {
+		errs = append(errs, fmt.Sprintf("keyTTL must be between 0 and %s", maxKeyTTL))
+	}
+	for _, tag := range c.DefaultTags {
+		if !ValidTag(tag) {
+			errs = append(errs, fmt.Sprintf("defaultTags: invalid tag %q", tag))
+		}
+	}
+	for namespace, tags := range c.AllowedTags {
+		for _, tag := range tags {
+			if _, err := path.Match(tag, ""); err != nil || !ValidTag(tag) {
+				errs = append(errs, fmt.Sprintf("allowedTags: invalid tag %q for namespace %q", tag, namespace))
+			}
+		}
+	}
+	for _, namespace := range c.ExcludedNamespaces {
+		if _, err := path.Match(namespace, ""); err != nil || namespace == "" {
+			errs = append(errs, fmt.Sprintf("excludedNamespaces: invalid namespace %q", namespace))
+		}
+	}
+	for name, limit := range c.Resources.Limits {
+		if request, ok := c.Resources.Requests[name]; ok && request.Cmp(limit) > 0 {
+			errs = append(errs, fmt.Sprintf("resources: %s request %s exceeds its limit %s", name, request.String(), limit.String()))
+		}
+	}
+	if h := c.HealthCheck; h.Enabled && (h.Port < 1 || h.Port > 65535 || h.StartupTimeout.Duration < time.Second) {
+		errs = append(errs, "healthCheck: port must be valid and startupTimeout at least 1s")
+	}
+	switch c.PodSecurity.DefaultLevel {
+	case PodSecurityPrivileged, PodSecurityBaseline, PodSecurityRestricted:
+	default:
+		errs = append(errs, fmt.Sprintf("podSecurity.defaultLevel: unknown level %q", c.PodSecurity.DefaultLevel))
+	}
+	if r := c.PodSecurity.TunDeviceResource; r != "" {
+		for _, msg := range validation.IsQualifiedName(r) {
+			errs = append(errs, fmt.Sprintf("podSecurity.tunDeviceResource %q: %s", r, msg))
+		}
+	}
+	if c.Proxy.Port < 1 || c.Proxy.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("proxy.port: invalid port %d", c.Proxy.Port))
+	}
+	for _, host := range c.Proxy.NoProxy {
+		if host == "" || strings.ContainsAny(host, " ,") {
+			errs = append(errs, fmt.Sprintf("proxy.noProxy: invalid host %q", host))
+		}
+	}
+	for namespace, prefixes := range c.Routes.Allowed {
+		for _, prefix := range prefixes {
+			if _, err := netip.ParsePrefix(prefix); err != nil {
+				errs = append(errs, fmt.Sprintf("routes.allowed: invalid prefix %q for namespace %q", prefix, namespace))
+			}
+		}
+	}
+	if c.LoginServer != "" {
+		if _, err := url.ParseRequestURI(c.LoginServer); err != nil {
+			errs = append(errs, fmt.Sprintf("loginServer: %v", err))
+		}
+	}
+	for _, server := range c.AllowedLoginServers {
+		if _, err := url.ParseRequestURI(server); err != nil {
+			errs = append(errs, fmt.Sprintf("allowedLoginServers: %v", err))
+		}
+	}
+	if c.Hostname != "" {
+		if _, err := template.New("hostname").Parse(c.Hostname); err != nil {
+			errs = append(errs, fmt.Sprintf("hostname: %v", err))
+		}
+	}
+	// gRPC addresses may also be host:port
+	if c.Headscale.Address != "" && c.Headscale.Transport != headscale.TransportGRPC {
+		if _, err := url.ParseRequestURI(c.Headscale.Address); err != nil {
+			errs = append(errs, fmt.Sprintf("headscale.address: %v", err))
+		}
+	}
+
+	switch c.Headscale.Transport {
+	case "", headscale.TransportREST, headscale.TransportGRPC:
+	default:
+		errs = append(errs, fmt.Sprintf("headscale.transport: unknown transport %q", c.Headscale.Transport))
+	}
+	if r := c.Headscale.Retry; r.MaxAttempts < 1 {
+		errs = append(errs, "headscale.retry.maxAttempts must be at least 1")
+	} else if r.MaxAttempts > 1 && (r.BaseDelay.Duration <= 0 || r.MaxDelay.Duration < r.BaseDelay.Duration) {
+		errs = append(errs, "headscale.retry: baseDelay must be positive and at most maxDelay")
+	}
+	if b := c.Headscale.CircuitBreaker; b.Threshold < 0 || (b.Threshold > 0 && b.Cooldown.Duration <= 0) {
+		errs = append(errs, "headscale.circuitBreaker: threshold must not be negative and cooldown must be positive")
+	}
+
+	if c.KeyPool.Size < 0 {
+		errs = append(errs, "keyPool.size must not be negative")
+	}
+	if c.KeyPool.Size > 0 && (c.KeyPool.MaxAge.Duration <= 0 || c.KeyPool.MaxAge.Duration >= c.KeyTTL.Duration) {
+		errs = append(errs, "keyPool.maxAge must be positive and shorter than keyTTL")
+	}
+
+	if !c.FailurePolicy.Valid() {
+		errs = append(errs, fmt.Sprintf("failurePolicy: unknown policy %q", c.FailurePolicy))
+	}
+
+	switch c.Provider.Type {
+	case ProviderHeadscale, ProviderTailscale:
+	case ProviderStatic:
+		if c.Provider.SecretName == "" {
+			errs = append(errs, "provider.secretName must be set for the static provider")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("provider.type: unknown provider %q", c.Provider.Type))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ImageRef returns the image reference of the sidecar
+func (c *Config) ImageRef() string {
+	return c.Image + ":" + c.Tag
+}
+
+// ValidTag reports whether tag is an ACL tag without its "tag:" prefix
+func ValidTag(tag string) bool {
+	return tag != "" && !strings.HasPrefix(tag, "tag:") && !strings.ContainsAny(tag, " ,")
+}
+
+// TagAllowed reports whether pods in namespace may ask for tag
+func (c *Config) TagAllowed(namespace, tag string) bool {
+	for _, ns := range []string{namespace, "*"} {
+		for _, pattern := range c.AllowedTags[ns] {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NamespaceExcluded reports whether pods in namespace are never injected
+func (c *Config) NamespaceExcluded(namespace string) bool {
+	for _, pattern := range c.ExcludedNamespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteAllowed reports whether pods in namespace may advertise a route to
+// prefix
+func (c *Config) RouteAllowed(namespace string, prefix netip.Prefix) bool {
+	for _, ns := range []string{namespace, "*"} {
+		for _, s := range c.Routes.Allowed[ns] {
+			allowed, err := netip.ParsePrefix(s)
+			if err != nil {
+				continue
+			}
+			if allowed.Bits() <= prefix.Bits() && allowed.Contains(prefix.Addr()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Tags returns the default ACL tags of a pod in namespace
+func (c *Config) Tags(namespace string) []string {
+	var tags []string
+	if c.NamespaceTag && namespace != "" {
+		tags = append(tags, namespace)
+	}
+	return append(tags, c.DefaultTags...)
+}
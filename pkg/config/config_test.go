@@ -0,0 +1,144 @@
+package config
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseDefaults(t *testing.T) {
+	got, err := Parse([]byte(``))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), got)
+	assert.Equal(t, "ghcr.io/tailscale/tailscale:latest", got.ImageRef())
+	assert.Equal(t, []string{"apps", "pod"}, got.Tags("apps"))
+}
+
+func TestParse(t *testing.T) {
+	got, err := Parse([]byte(`
+image: registry.example.com/tailscale
+tag: v1.80.0
+keyTTL: 5m
+defaultTags: [k8s]
+namespaceTag: false
+loginServer: https://headscale.example.com
+headscale:
+  address: http://headscale.headscale.svc:8080
+  retry: {maxAttempts: 5}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "registry.example.com/tailscale:v1.80.0", got.ImageRef())
+	assert.Equal(t, 5*time.Minute, got.KeyTTL.Duration)
+	assert.Equal(t, []string{"k8s"}, got.Tags("apps"))
+	assert.Equal(t, "tailscale-auth", got.SecretName, "unset fields keep their default")
+	assert.Equal(t, "http://headscale.headscale.svc:8080", got.Headscale.Address)
+	assert.Equal(t, 5, got.Headscale.RetryPolicy().MaxAttempts)
+	assert.Equal(t, 100*time.Millisecond, got.Headscale.RetryPolicy().BaseDelay, "unset fields keep their default")
+}
+
+func TestParseResources(t *testing.T) {
+	got, err := Parse([]byte(`
+resources:
+  requests: {cpu: 50m}
+  limits: {cpu: 200m}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("50m")},
+		Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")},
+	}, got.Resources, "the default resources are replaced, not merged")
+
+	got, err = Parse([]byte(`resources: {requests: {cpu: 10m}}`))
+	require.NoError(t, err)
+	assert.Empty(t, got.Resources.Limits, "the default memory limit can be removed")
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":        `imag: typo`,
+		"empty image":          `image: ""`,
+		"negative ttl":         `keyTTL: -1m`,
+		"prefixed tag":         `defaultTags: ["tag:pod"]`,
+		"invalid secret name":  `secretName: Not_Valid`,
+		"relative address":     `headscale: {address: headscale}`,
+		"unknown provider":     `provider: {type: wireguard}`,
+		"static without name":  `provider: {type: static}`,
+		"unknown failure":      `failurePolicy: retry`,
+		"unknown transport":    `headscale: {transport: websocket}`,
+		"no attempts":          `headscale: {retry: {maxAttempts: 0}}`,
+		"backoff shrinking":    `headscale: {retry: {baseDelay: 2s, maxDelay: 1s}}`,
+		"breaker never closes": `headscale: {circuitBreaker: {cooldown: 0s}}`,
+		"pool keys too old":    `keyPool: {size: 5, maxAge: 2m}`,
+		"broken hostname":      `hostname: "{{.Namespace"`,
+		"prefixed allowed tag": `allowedTags: {apps: ["tag:web"]}`,
+		"bad tag pattern":      `allowedTags: {apps: ["web["]}`,
+		"bad allowed route":    `routes: {allowed: {apps: ["10.0.0.0"]}}`,
+		"proxy without port":   `proxy: {port: 0}`,
+		"unknown pss level":    `podSecurity: {defaultLevel: strict}`,
+		"request over limit":   `resources: {requests: {memory: 1Gi}, limits: {memory: 128Mi}}`,
+		"no health port":       `healthCheck: {enabled: true, port: 0}`,
+		"bad tun resource":     `podSecurity: {tunDeviceResource: "squat.ai/tun/0"}`,
+		"bad no proxy host":    `proxy: {noProxy: ["a,b"]}`,
+		"bad excluded pattern": `excludedNamespaces: ["kube-["]`,
+		"not a config at all":  `[1, 2, 3]`,
+		"ttl longer than keys": `keyTTL: 2200h`,
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTagAllowed(t *testing.T) {
+	c, err := Parse([]byte(`
+allowedTags:
+  apps: [web, "team-*"]
+  "*": [monitoring]
+`))
+	require.NoError(t, err)
+
+	assert.True(t, c.TagAllowed("apps", "web"))
+	assert.True(t, c.TagAllowed("apps", "team-a"))
+	assert.True(t, c.TagAllowed("apps", "monitoring"), "the * namespace applies to every namespace")
+	assert.True(t, c.TagAllowed("db", "monitoring"))
+	assert.False(t, c.TagAllowed("db", "web"))
+	assert.False(t, Default().TagAllowed("apps", "web"), "no tag is allowed by default")
+}
+
+func TestNamespaceExcluded(t *testing.T) {
+	assert.True(t, Default().NamespaceExcluded("kube-system"))
+	assert.False(t, Default().NamespaceExcluded("apps"))
+
+	c, err := Parse([]byte(`excludedNamespaces: ["kube-*", monitoring]`))
+	require.NoError(t, err)
+	assert.True(t, c.NamespaceExcluded("kube-public"))
+	assert.True(t, c.NamespaceExcluded("monitoring"))
+	assert.False(t, c.NamespaceExcluded("apps"))
+}
+
+func TestRouteAllowed(t *testing.T) {
+	c, err := Parse([]byte(`
+routes:
+  allowed:
+    apps: [10.96.0.0/12, "fd00::/8"]
+    "*": [192.168.1.0/24]
+`))
+	require.NoError(t, err)
+
+	assert.True(t, c.RouteAllowed("apps", netip.MustParsePrefix("10.96.0.0/12")))
+	assert.True(t, c.RouteAllowed("apps", netip.MustParsePrefix("10.100.0.0/16")))
+	assert.True(t, c.RouteAllowed("apps", netip.MustParsePrefix("fd00:1::/64")))
+	assert.True(t, c.RouteAllowed("db", netip.MustParsePrefix("192.168.1.0/24")), "the * namespace applies to every namespace")
+	assert.False(t, c.RouteAllowed("apps", netip.MustParsePrefix("10.0.0.0/8")), "wider than the allowed prefix")
+	assert.False(t, c.RouteAllowed("db", netip.MustParsePrefix("10.96.0.0/12")))
+	assert.False(t, c.RouteAllowed("apps", netip.MustParsePrefix("0.0.0.0/0")))
+	assert.False(t, Default().RouteAllowed("apps", netip.MustParsePrefix("10.96.0.0/12")), "no route is allowed by default")
+}
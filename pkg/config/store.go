@@ -0,0 +1,91 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Store holds the current configuration, it is safe for concurrent use
+type Store struct {
+	path    string
+	current atomic.Pointer[Config]
+	raw     []byte
+}
+
+// NewStore loads the configuration at path, an empty path serves the
+// defaults
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path == "" {
+		s.current.Store(Default())
+		return s, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	s.raw = raw
+	s.current.Store(c)
+	return s, nil
+}
+
+// Get returns the current configuration, it must not be modified
+func (s *Store) Get() *Config {
+	return s.current.Load()
+}
+
+// Watch polls the configuration file every interval until the context is
+// cancelled. Polling rather than inotify copes with the symlink swap done
+// by the kubelet when a ConfigMap is updated. Invalid configurations are
+// logged and the last valid one is kept
+func (s *Store) Watch(ctx context.Context, logger logrus.FieldLogger, interval time.Duration, onReload func(*Config)) {
+	if s.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.reload(onReload); err != nil {
+				logger.Errorf("could not reload config %s, keeping the previous one: %v", s.path, err)
+			}
+		}
+	}
+}
+
+func (s *Store) reload(onReload func(*Config)) error {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(raw, s.raw) {
+		return nil
+	}
+	// only retry an invalid file once it changes again
+	s.raw = raw
+
+	c, err := Parse(raw)
+	if err != nil {
+		return err
+	}
+	s.current.Store(c)
+	if onReload != nil {
+		onReload(c)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`tag: v1`), 0o644))
+
+	s, err := NewStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", s.Get().Tag)
+
+	var reloaded []string
+	onReload := func(c *Config) { reloaded = append(reloaded, c.Tag) }
+
+	// unchanged files are not reloaded
+	require.NoError(t, s.reload(onReload))
+	assert.Empty(t, reloaded)
+
+	require.NoError(t, os.WriteFile(path, []byte(`tag: v2`), 0o644))
+	require.NoError(t, s.reload(onReload))
+	assert.Equal(t, "v2", s.Get().Tag)
+
+	// an invalid file keeps the last valid config
+	require.NoError(t, os.WriteFile(path, []byte(`tag: ""`), 0o644))
+	assert.Error(t, s.reload(onReload))
+	assert.Equal(t, "v2", s.Get().Tag)
+	assert.Equal(t, []string{"v2"}, reloaded)
+}
+
+func TestNewStoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`keyTTL: 0s`), 0o644))
+
+	_, err := NewStore(path)
+	assert.Error(t, err)
+}
+
+func TestNewStoreWithoutFile(t *testing.T) {
+	s, err := NewStore("")
+	require.NoError(t, err)
+	assert.Equal(t, Default(), s.Get())
+}
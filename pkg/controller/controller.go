@@ -0,0 +1,352 @@
+// Package controller removes the Headscale nodes and pre-auth keys of
+// injected pods once they are deleted, so ephemeral sidecars do not pile up
+// as stale machines, and enables the routes pods advertise
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// DefaultCleanupTimeout is how long the cleanup of a deleted pod is retried
+// before its finalizer is removed anyway
+const DefaultCleanupTimeout = 10 * time.Minute
+
+// Controller watches injected pods, records the Headscale node each of them
+// joined as and cleans it up when the pod is deleted
+type Controller struct {
+	Logger    logrus.FieldLogger
+	Client    kubernetes.Interface
+	Headscale headscale.HeadscaleClient
+	// CleanupTimeout bounds the time a deleted pod waits for its cleanup,
+	// counted from its deletion, so pods are not stuck terminating while
+	// Headscale is down
+	CleanupTimeout time.Duration
+
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	queue    workqueue.TypedRateLimitingInterface[string]
+}
+
+// New returns a Controller watching pods carrying the inject label, which
+// the webhook sets on every pod it injects
+func New(logger logrus.FieldLogger, client kubernetes.Interface, hs headscale.HeadscaleClient, resync time.Duration) *Controller {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, resync,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = mutation.InjectLabel
+		}),
+	)
+
+	c := &Controller{
+		Logger:    logger,
+		Client:    client,
+		Headscale: hs,
+		factory:   factory,
+		informer:  factory.Core().V1().Pods().Informer(),
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "pods"},
+		),
+		CleanupTimeout: DefaultCleanupTimeout,
+	}
+
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj any) { c.enqueue(obj) },
+	})
+
+	return c
+}
+
+func (c *Controller) enqueue(obj any) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the informer and workers, it blocks until the context is
+// cancelled
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		return fmt.Errorf("pod cache not synced")
+	}
+
+	c.Logger.Infof("starting %d workers", workers)
+	for range workers {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (c *Controller) worker(ctx context.Context) {
+	for c.next(ctx) {
+	}
+}
+
+func (c *Controller) next(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(ctx, key); err != nil {
+		c.Logger.Errorf("could not reconcile pod %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) reconcile(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	pod := obj.(*corev1.Pod)
+
+	cleanup := slices.Contains(pod.Finalizers, mutation.CleanupFinalizer)
+	if pod.DeletionTimestamp != nil {
+		if !cleanup {
+			return nil
+		}
+		err := c.cleanup(ctx, pod)
+		if err != nil && time.Since(pod.DeletionTimestamp.Time) > c.CleanupTimeout {
+			c.Logger.Errorf("giving up cleaning up pod %s/%s after %s, node %q and pre-auth key %q of user %q may be left in Headscale: %v",
+				pod.Namespace, pod.Name, c.CleanupTimeout,
+				pod.Annotations[mutation.NodeIDAnnotation], pod.Annotations[mutation.AuthKeyIDAnnotation], pod.Annotations[mutation.AuthKeyUserAnnotation], err)
+			return c.removeFinalizer(ctx, pod)
+		}
+		return err
+	}
+	_, approve := pod.Annotations[mutation.ApproveRoutesAnnotation]
+	if !cleanup && !approve {
+		return nil
+	}
+
+	nodeID, err := c.recordNode(ctx, pod)
+	if err != nil || nodeID == "" || !approve {
+		return err
+	}
+	return c.approveRoutes(ctx, pod, nodeID)
+}
+
+// recordNode annotates a running pod with the node which joined using its
+// pre-auth key and returns its ID, which is empty until it joined
+func (c *Controller) recordNode(ctx context.Context, pod *corev1.Pod) (string, error) {
+	if id, ok := pod.Annotations[mutation.NodeIDAnnotation]; ok {
+		return id, nil
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return "", nil
+	}
+
+	node, err := c.findNode(ctx, pod)
+	if err != nil || node == nil {
+		// the sidecar may not have joined yet, the pod is looked at again
+		// on its next update or resync
+		return "", err
+	}
+
+	if err := c.annotate(ctx, pod, mutation.NodeIDAnnotation, node.ID); err != nil {
+		return "", err
+	}
+
+	c.Logger.Debugf("pod %s/%s joined as node %s", pod.Namespace, pod.Name, node.ID)
+	return node.ID, nil
+}
+
+// approveRoutes enables the routes the node of a pod advertises, which it
+// may do some time after joining. The pod is looked at again on its next
+// update or resync until every route is enabled
+func (c *Controller) approveRoutes(ctx context.Context, pod *corev1.Pod, nodeID string) error {
+	want := pod.Annotations[mutation.ApproveRoutesAnnotation]
+	if pod.Annotations[mutation.RoutesApprovedAnnotation] == want {
+		return nil
+	}
+	prefixes := strings.Split(want, ",")
+
+	resp, err := c.Headscale.Routes().ListNode(ctx, nodeID)
+	if err != nil {
+		return fmt.Errorf("could not list routes of node %s: %w", nodeID, err)
+	}
+
+	var approved []string
+	for _, route := range resp.Routes {
+		if !route.Advertised || !slices.Contains(prefixes, route.Prefix) || slices.Contains(approved, route.Prefix) {
+			continue
+		}
+		if !route.Enabled {
+			if err := c.Headscale.Routes().Enable(ctx, route.ID); err != nil {
+				return fmt.Errorf("could not enable route %s of node %s: %w", route.Prefix, nodeID, err)
+			}
+			c.Logger.Infof("enabled route %s of pod %s/%s", route.Prefix, pod.Namespace, pod.Name)
+		}
+		approved = append(approved, route.Prefix)
+	}
+	if len(approved) < len(prefixes) {
+		return nil
+	}
+
+	return c.annotate(ctx, pod, mutation.RoutesApprovedAnnotation, want)
+}
+
+// annotate sets an annotation of a pod
+func (c *Controller) annotate(ctx context.Context, pod *corev1.Pod, key, value string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.Client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// authKeyID returns the ID of the pre-auth key of a pod. Deferred keys are
+// recorded on their secret once minted, the ID is empty until then
+func (c *Controller) authKeyID(ctx context.Context, pod *corev1.Pod) (string, error) {
+	if id, ok := pod.Annotations[mutation.AuthKeyIDAnnotation]; ok {
+		return id, nil
+	}
+	name, ok := pod.Annotations[mutation.AuthKeySecretAnnotation]
+	if !ok {
+		return "", nil
+	}
+	secret, err := c.Client.CoreV1().Secrets(pod.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get secret %s/%s: %w", pod.Namespace, name, err)
+	}
+	return secret.Annotations[mutation.AuthKeyIDAnnotation], nil
+}
+
+// findNode returns the node of a pod, either the recorded one or the one
+// registered with its pre-auth key. It returns nil when there is none
+func (c *Controller) findNode(ctx context.Context, pod *corev1.Pod) (*headscale.Node, error) {
+	nodeID := pod.Annotations[mutation.NodeIDAnnotation]
+	keyID, err := c.authKeyID(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Headscale.Nodes().List(ctx, pod.Annotations[mutation.AuthKeyUserAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("could not list nodes: %w", err)
+	}
+
+	for _, node := range resp.Nodes {
+		if nodeID != "" {
+			if node.ID == nodeID {
+				return &node, nil
+			}
+			continue
+		}
+		if keyID != "" && node.PreAuthKey != nil && node.PreAuthKey.ID == keyID {
+			return &node, nil
+		}
+	}
+	return nil, nil
+}
+
+// cleanup deletes the node of a pod and expires its pre-auth key, the
+// finalizer is only removed once both are gone from Headscale or
+// CleanupTimeout passed
+func (c *Controller) cleanup(ctx context.Context, pod *corev1.Pod) error {
+	node, err := c.findNode(ctx, pod)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		if err := c.Headscale.Nodes().Delete(ctx, node.ID); err != nil && !headscale.IsNotFound(err) {
+			return fmt.Errorf("could not delete node %s: %w", node.ID, err)
+		}
+		c.Logger.Infof("deleted node %s of pod %s/%s", node.ID, pod.Namespace, pod.Name)
+	}
+
+	if err := c.expireKey(ctx, pod); err != nil {
+		return err
+	}
+
+	// a deferred key must not be minted for a pod which is gone
+	if name, ok := pod.Annotations[mutation.AuthKeySecretAnnotation]; ok {
+		err := c.Client.CoreV1().Secrets(pod.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("could not delete secret %s/%s: %w", pod.Namespace, name, err)
+		}
+	}
+
+	return c.removeFinalizer(ctx, pod)
+}
+
+// expireKey expires the pre-auth key of a pod unless it already expired
+func (c *Controller) expireKey(ctx context.Context, pod *corev1.Pod) error {
+	keyID, err := c.authKeyID(ctx, pod)
+	if err != nil {
+		return err
+	}
+	user := pod.Annotations[mutation.AuthKeyUserAnnotation]
+	if keyID == "" || user == "" {
+		return nil
+	}
+
+	keys, err := c.Headscale.PreAuthKeys().List(ctx, user)
+	if err != nil {
+		return fmt.Errorf("could not list pre-auth keys: %w", err)
+	}
+
+	for _, key := range keys.PreAuthKeys {
+		if key.ID != keyID || !key.Expiration.After(time.Now()) {
+			continue
+		}
+		if err := c.Headscale.PreAuthKeys().Expire(ctx, user, key.Key); err != nil {
+			return fmt.Errorf("could not expire pre-auth key %s: %w", keyID, err)
+		}
+		c.Logger.Infof("expired pre-auth key %s of pod %s/%s", keyID, pod.Namespace, pod.Name)
+	}
+	return nil
+}
+
+func (c *Controller) removeFinalizer(ctx context.Context, pod *corev1.Pod) error {
+	mpod := pod.DeepCopy()
+	mpod.Finalizers = slices.DeleteFunc(mpod.Finalizers, func(f string) bool {
+		return f == mutation.CleanupFinalizer
+	})
+
+	_, err := c.Client.CoreV1().Pods(pod.Namespace).Update(ctx, mpod, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeHeadscale serves a single node registered with pre-auth key 7 and
+// advertising 10.96.0.0/12
+type fakeHeadscale struct {
+	// down fails every call
+	down    bool
+	deleted []string
+	expired []string
+	enabled []string
+}
+
+func (f *fakeHeadscale) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case f.down:
+		http.Error(w, `{"code":14,"message":"unavailable"}`, http.StatusServiceUnavailable)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/node":
+		json.NewEncoder(w).Encode(headscale.ListNodesResponse{Nodes: []headscale.Node{
+			{ID: "2", Name: "other", PreAuthKey: &headscale.PreAuthKey{ID: "6"}},
+			{ID: "3", Name: "web", PreAuthKey: &headscale.PreAuthKey{ID: "7"}},
+		}})
+	case r.Method == http.MethodDelete && r.URL.Path == "/api/v1/node/3":
+		f.deleted = append(f.deleted, "3")
+		w.Write([]byte(`{}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/node/3/routes":
+		json.NewEncoder(w).Encode(headscale.RoutesResponse{Routes: []headscale.Route{
+			{ID: "1", Prefix: "10.96.0.0/12", Advertised: true},
+			{ID: "2", Prefix: "192.168.0.0/24", Advertised: true},
+		}})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/routes/1/enable":
+		f.enabled = append(f.enabled, "1")
+		w.Write([]byte(`{}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/preauthkey":
+		json.NewEncoder(w).Encode(headscale.ListPreAuthKeysResponse{PreAuthKeys: []headscale.PreAuthKey{
+			{ID: "7", Key: "secret", Expiration: time.Now().Add(time.Hour)},
+		}})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/preauthkey/expire":
+		var req headscale.ExpirePreAuthKeyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.expired = append(f.expired, req.Key)
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testController(t *testing.T, pod *corev1.Pod, objects ...runtime.Object) (*Controller, *fakeHeadscale) {
+	t.Helper()
+
+	hs := &fakeHeadscale{}
+	srv := httptest.NewServer(hs)
+	t.Cleanup(srv.Close)
+
+	client, err := headscale.New(context.Background(), "key", srv.URL)
+	require.NoError(t, err)
+	client.Retry = headscale.RetryPolicy{MaxAttempts: 1}
+	client.Breaker = nil
+
+	c := New(logrus.New(), fake.NewSimpleClientset(append(objects, pod)...), client, 0)
+	require.NoError(t, c.informer.GetIndexer().Add(pod))
+	return c, hs
+}
+
+func testPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "apps",
+			Labels:    map[string]string{mutation.InjectLabel: "true"},
+			Annotations: map[string]string{
+				mutation.AuthKeyIDAnnotation:   "7",
+				mutation.AuthKeyUserAnnotation: "sammm",
+			},
+			Finalizers: []string{mutation.CleanupFinalizer},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestReconcileRecordsNode(t *testing.T) {
+	c, hs := testController(t, testPod())
+
+	require.NoError(t, c.reconcile(context.Background(), "apps/web"))
+
+	got, err := c.Client.CoreV1().Pods("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "3", got.Annotations[mutation.NodeIDAnnotation])
+	assert.Empty(t, hs.deleted)
+}
+
+func TestReconcileCleansUpDeletedPod(t *testing.T) {
+	pod := testPod()
+	pod.Annotations[mutation.NodeIDAnnotation] = "3"
+	pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	c, hs := testController(t, pod)
+
+	require.NoError(t, c.reconcile(context.Background(), "apps/web"))
+
+	assert.Equal(t, []string{"3"}, hs.deleted)
+	assert.Equal(t, []string{"secret"}, hs.expired)
+
+	got, err := c.Client.CoreV1().Pods("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, got.Finalizers, mutation.CleanupFinalizer)
+}
+
+func TestReconcileCleansUpDeferredPod(t *testing.T) {
+	pod := testPod()
+	delete(pod.Annotations, mutation.AuthKeyIDAnnotation)
+	pod.Annotations[mutation.AuthKeySecretAnnotation] = "web-tailscale-authkey"
+	pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:        "web-tailscale-authkey",
+		Namespace:   "apps",
+		Annotations: map[string]string{mutation.AuthKeyIDAnnotation: "7"},
+	}}
+	c, hs := testController(t, pod, secret)
+
+	require.NoError(t, c.reconcile(context.Background(), "apps/web"))
+
+	assert.Equal(t, []string{"3"}, hs.deleted, "the key ID is read from the secret")
+	assert.Equal(t, []string{"secret"}, hs.expired)
+	_, err := c.Client.CoreV1().Secrets("apps").Get(context.Background(), secret.Name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestReconcileGivesUpCleanup(t *testing.T) {
+	pod := testPod()
+	pod.Annotations[mutation.NodeIDAnnotation] = "3"
+	pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	c, hs := testController(t, pod)
+	hs.down = true
+
+	assert.Error(t, c.reconcile(context.Background(), "apps/web"), "cleanup is retried while Headscale is down")
+	got, err := c.Client.CoreV1().Pods("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, got.Finalizers, mutation.CleanupFinalizer)
+
+	pod.DeletionTimestamp = &metav1.Time{Time: time.Now().Add(-DefaultCleanupTimeout - time.Minute)}
+	require.NoError(t, c.informer.GetIndexer().Update(pod))
+	require.NoError(t, c.reconcile(context.Background(), "apps/web"))
+	got, err = c.Client.CoreV1().Pods("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, got.Finalizers, mutation.CleanupFinalizer, "the pod is let go once the timeout passed")
+	assert.Empty(t, hs.deleted)
+}
+
+func TestReconcileIgnoresPodsWithoutFinalizer(t *testing.T) {
+	pod := testPod()
+	pod.Finalizers = nil
+	pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	c, hs := testController(t, pod)
+
+	require.NoError(t, c.reconcile(context.Background(), "apps/web"))
+	assert.Empty(t, hs.deleted)
+	assert.Empty(t, hs.expired)
+}
+
+func TestReconcileApprovesRoutes(t *testing.T) {
+	pod := testPod()
+	pod.Finalizers = nil
+	pod.Annotations[mutation.ApproveRoutesAnnotation] = "10.96.0.0/12"
+	c, hs := testController(t, pod)
+
+	require.NoError(t, c.reconcile(context.Background(), "apps/web"))
+	assert.Equal(t, []string{"1"}, hs.enabled, "only the routes of the pod are enabled")
+
+	got, err := c.Client.CoreV1().Pods("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "3", got.Annotations[mutation.NodeIDAnnotation])
+	assert.Equal(t, "10.96.0.0/12", got.Annotations[mutation.RoutesApprovedAnnotation])
+}
+
+func TestReconcileWaitsForAdvertisedRoutes(t *testing.T) {
+	pod := testPod()
+	pod.Annotations[mutation.NodeIDAnnotation] = "3"
+	pod.Annotations[mutation.ApproveRoutesAnnotation] = "10.96.0.0/12,0.0.0.0/0,::/0"
+	c, hs := testController(t, pod)
+
+	require.NoError(t, c.reconcile(context.Background(), "apps/web"))
+	assert.Equal(t, []string{"1"}, hs.enabled)
+
+	got, err := c.Client.CoreV1().Pods("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, got.Annotations, mutation.RoutesApprovedAnnotation, "the exit routes are not advertised yet")
+}
+
+// keyProvider mints key 7 like Headscale
+type keyProvider struct{}
+
+func (keyProvider) Name() string {
+	return mutation.HeadscaleProviderName
+}
+
+func (keyProvider) AuthKey(_ context.Context, req mutation.AuthKeyRequest) (*mutation.AuthKey, error) {
+	return &mutation.AuthKey{ID: "7", Key: "secret", Expiration: req.Expiration}, nil
+}
+
+// pods injected as their namespace asked carry no label of their own
+func TestControllerWatchesNamespaceInjectedPods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web"}}},
+	}
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Labels: map[string]string{mutation.InjectLabel: "enabled"}}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "apps"}},
+		pod,
+	)
+
+	m := mutation.NewMutator(logrus.NewEntry(logrus.New()))
+	m.Client = client
+	m.Provider = keyProvider{}
+	res, err := m.MutatePodPatch(ctx, pod, false)
+	require.NoError(t, err)
+	_, err = client.CoreV1().Pods("apps").Patch(ctx, "web", types.JSONPatchType, res.Patch, metav1.PatchOptions{})
+	require.NoError(t, err)
+
+	c := New(logrus.New(), client, nil, 0)
+	c.factory.Start(ctx.Done())
+	require.True(t, cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced))
+
+	obj, exists, err := c.informer.GetIndexer().GetByKey("apps/web")
+	require.NoError(t, err)
+	require.True(t, exists, "the controller sees the pod")
+	assert.Contains(t, obj.(*corev1.Pod).Finalizers, mutation.CleanupFinalizer)
+}
@@ -0,0 +1,48 @@
+package headscale
+
+import (
+	"context"
+	"time"
+)
+
+// PreAuthKeyAPI manages pre-auth keys
+type PreAuthKeyAPI interface {
+	Create(ctx context.Context, user string, reusable bool, ephemeral bool, expiration time.Time, aclTags []string) (*CreatePreAuthKeyResponse, error)
+	List(ctx context.Context, user string) (*ListPreAuthKeysResponse, error)
+	Expire(ctx context.Context, user string, key string) error
+}
+
+// NodeAPI manages the machines registered with Headscale
+type NodeAPI interface {
+	List(ctx context.Context, user string) (*ListNodesResponse, error)
+	Get(ctx context.Context, id string) (*NodeResponse, error)
+	Delete(ctx context.Context, id string) error
+	Expire(ctx context.Context, id string) (*NodeResponse, error)
+	Rename(ctx context.Context, id string, name string) (*NodeResponse, error)
+	SetTags(ctx context.Context, id string, tags []string) (*NodeResponse, error)
+	Register(ctx context.Context, user string, key string) (*NodeResponse, error)
+}
+
+// RouteAPI manages the routes advertised by subnet routers and exit nodes
+type RouteAPI interface {
+	List(ctx context.Context) (*RoutesResponse, error)
+	ListNode(ctx context.Context, nodeID string) (*RoutesResponse, error)
+	Enable(ctx context.Context, id string) error
+	Disable(ctx context.Context, id string) error
+	Delete(ctx context.Context, id string) error
+}
+
+// UserAPI manages users
+type UserAPI interface {
+	Create(ctx context.Context, name string) (*UserResponse, error)
+	List(ctx context.Context) (*UsersResponse, error)
+	Rename(ctx context.Context, oldName string, newName string) (*UserResponse, error)
+	Delete(ctx context.Context, name string) error
+}
+
+var (
+	_ PreAuthKeyAPI = (*PreAuthKeyClient)(nil)
+	_ NodeAPI       = (*NodeClient)(nil)
+	_ RouteAPI      = (*RouteClient)(nil)
+	_ UserAPI       = (*UserClient)(nil)
+)
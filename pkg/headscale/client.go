@@ -3,13 +3,17 @@ package headscale
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/metrics"
 )
 
 type Client struct {
@@ -18,21 +22,53 @@ type Client struct {
 	UserAgent string
 	HTTP      *http.Client
 	Logger    *slog.Logger
+	Retry     RetryPolicy
+	// Breaker is shared by every call of the client, nil disables it
+	Breaker *CircuitBreaker
 }
 
+// HeadscaleClient is the Headscale API, spoken over the REST gateway by
+// Client or natively over gRPC by GRPCClient
 type HeadscaleClient interface {
-	PreAuthKeys() *PreAuthKeyClient
+	PreAuthKeys() PreAuthKeyAPI
+	Nodes() NodeAPI
+	Routes() RouteAPI
+	Users() UserAPI
+}
+
+var _ HeadscaleClient = (*Client)(nil)
+
+// restClient builds and sends requests to the REST gateway
+type restClient interface {
 	do(ctx context.Context, req *http.Request, v any) error
 	buildRequest(ctx context.Context, method string, uri *url.URL, req request) (*http.Request, error)
 	buildPath(parts ...string) *url.URL
 }
 
-func (c *Client) PreAuthKeys() *PreAuthKeyClient {
+func (c *Client) PreAuthKeys() PreAuthKeyAPI {
 	return &PreAuthKeyClient{
 		client: c,
 	}
 }
 
+func (c *Client) Nodes() NodeAPI {
+	return &NodeClient{
+		client: c,
+	}
+}
+
+func (c *Client) Routes() RouteAPI {
+	return &RouteClient{
+		client: c,
+	}
+}
+
+func (c *Client) Users() UserAPI {
+	return &UserClient{
+		client: c,
+	}
+}
+
 func (c *Client) buildPath(parts ...string) *url.URL {
 	parts = append([]string{basePath}, parts...)
 	return c.URL.JoinPath(parts...)
@@ -73,44 +109,166 @@ func New(ctx context.Context, apiKey, address string) (*Client, error) {
 	res.HTTP = &http.Client{
 		Timeout: DefaultTimeout,
 	}
+	res.Retry = DefaultRetryPolicy
+	res.Breaker = NewCircuitBreaker(DefaultBreakerPolicy)
 
 	return res, nil
 }
 
+const (
+	TransportREST string = "rest"
+	TransportGRPC string = "grpc"
+)
+
+// Options select how to reach Headscale
+type Options struct {
+	// Transport is TransportREST (the default) or TransportGRPC
+	Transport string
+	APIKey    string
+	// Address of the API, defaults to HEADSCALE_CLI_ADDRESS
+	Address string
+	// Insecure skips verifying the certificate of Headscale
+	Insecure bool
+	// Retry and Breaker apply to both transports, zero values keep the
+	// defaults
+	Retry   RetryPolicy
+	Breaker BreakerPolicy
+}
+
+// Dial returns a client speaking the transport selected by opts
+func Dial(ctx context.Context, opts Options) (HeadscaleClient, error) {
+	switch opts.Transport {
+	case "", TransportREST:
+		c, err := New(ctx, opts.APIKey, opts.Address)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Retry != (RetryPolicy{}) {
+			c.Retry = opts.Retry
+		}
+		if opts.Breaker != (BreakerPolicy{}) {
+			c.Breaker = NewCircuitBreaker(opts.Breaker)
+		}
+		if opts.Insecure {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			c.HTTP.Transport = t
+		}
+		return c, nil
+	case TransportGRPC:
+		if opts.Address == "" {
+			opts.Address = os.Getenv("HEADSCALE_CLI_ADDRESS")
+		}
+		if opts.APIKey == "" {
+			opts.APIKey = os.Getenv("HEADSCALE_CLI_API_KEY")
+		}
+		c, err := NewGRPC(opts.APIKey, opts.Address, opts.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Retry != (RetryPolicy{}) {
+			c.Retry = opts.Retry
+		}
+		if opts.Breaker != (BreakerPolicy{}) {
+			c.Breaker = NewCircuitBreaker(opts.Breaker)
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown headscale transport %q", opts.Transport)
+	}
+}
+
 type request struct {
+	// endpoint names the API call in metrics, e.g. CreatePreAuthKey
+	endpoint string
+	// idempotent marks POST requests which are safe to retry
+	idempotent  bool
 	body        any
 	headers     map[string]string
 	contentType string
 	params      map[string]string
 }
 
+// endpointKey is the context key holding the endpoint of a request
+type endpointKey struct{}
+
+// idempotentKey is the context key marking requests safe to retry
+type idempotentKey struct{}
+
+// do sends the request, retrying transient failures within the deadline of
+// the context and the retry policy
 func (c *Client) do(ctx context.Context, req *http.Request, v any) error {
+	endpoint, _ := req.Context().Value(endpointKey{}).(string)
+	if endpoint == "" {
+		endpoint = req.Method + " " + req.URL.Path
+	}
+	canRetry := idempotent(req)
+
+	for attempt := 1; ; attempt++ {
+		if !c.Breaker.allow(time.Now()) {
+			return fmt.Errorf("%s: %w", endpoint, ErrCircuitOpen)
+		}
+
+		r := req
+		if attempt > 1 {
+			r = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return err
+				}
+				r.Body = body
+			}
+		}
+
+		status, wait, err := c.send(ctx, endpoint, r, v)
+		c.Breaker.done(ctx, err == nil || !transient(status), time.Now())
+		if err == nil || attempt >= c.Retry.MaxAttempts || !retryable(status, canRetry) {
+			return err
+		}
+
+		delay := max(c.Retry.delay(attempt), wait)
+		if !withinBudget(ctx, delay) {
+			return err
+		}
+		c.Logger.WarnContext(ctx, "retrying request", "endpoint", endpoint, "attempt", attempt, "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send makes a single attempt, it returns the status code (0 without a
+// response) and the delay asked for by Headscale before retrying
+func (c *Client) send(ctx context.Context, endpoint string, req *http.Request, v any) (int, time.Duration, error) {
 	c.Logger.Debug("making http request", "method", req.Method, "url", req.URL.String(), "query", req.URL.RawQuery)
+	start := time.Now()
 	resp, err := c.HTTP.Do(req)
 	if err != nil {
+		metrics.ObserveHeadscaleRequest(endpoint, 0, time.Since(start))
 		c.Logger.ErrorContext(ctx, "failed making the request", "error", err)
-		return err
+		return 0, 0, err
 	}
+	metrics.ObserveHeadscaleRequest(endpoint, resp.StatusCode, time.Since(start))
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-		c.Logger.ErrorContext(ctx, "unexpected status code", "status", resp.StatusCode)
-		var b []byte
-		if n, err := resp.Body.Read(b); err == nil {
-			if n > 0 {
-				c.Logger.DebugContext(ctx, "response", "body", string(b))
-			}
-		}
-		return fmt.Errorf("unexepcted status code %d", resp.StatusCode)
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		apiErr := newAPIError(endpoint, resp, b)
+		c.Logger.ErrorContext(ctx, "unexpected status code", "status", resp.StatusCode, "code", apiErr.Code, "message", apiErr.Message, "request_id", apiErr.RequestID)
+		return resp.StatusCode, retryAfter(resp), apiErr
 	}
 	if v != nil {
 		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
-			return err
+			return resp.StatusCode, 0, err
 		}
 	}
 
-	return nil
+	return resp.StatusCode, 0, nil
 }
 
 func (c *Client) buildRequest(ctx context.Context, method string, uri *url.URL, req request) (*http.Request, error) {
@@ -135,6 +293,13 @@ func (c *Client) buildRequest(ctx context.Context, method string, uri *url.URL,
 	}
 	uri.RawQuery = query.Encode()
 
+	if req.endpoint != "" {
+		ctx = context.WithValue(ctx, endpointKey{}, req.endpoint)
+	}
+	if req.idempotent {
+		ctx = context.WithValue(ctx, idempotentKey{}, true)
+	}
+
 	r, err := http.NewRequestWithContext(ctx, method, uri.String(), bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		return nil, err
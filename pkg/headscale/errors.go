@@ -0,0 +1,168 @@
+package headscale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxErrorBody bounds how much of an error response is read
+const maxErrorBody = 64 << 10
+
+// APIError is returned when Headscale answers a call with an error, over
+// either transport
+type APIError struct {
+	// Endpoint names the API call, e.g. CreatePreAuthKey
+	Endpoint string
+	// StatusCode is the HTTP status, gRPC errors carry the status the
+	// gateway would have answered with
+	StatusCode int
+	// Code and Message are the gRPC status of the error
+	Code    codes.Code
+	Message string
+	// RequestID identifies the call in the logs of Headscale or of the
+	// proxy in front of it, when either sets one
+	RequestID string
+}
+
+// gatewayError is the body of errors answered by the gRPC gateway
+type gatewayError struct {
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message"`
+}
+
+// requestIDHeaders are the headers a request ID is looked for in
+var requestIDHeaders = []string{"X-Request-Id", "X-Correlation-Id", "X-Amzn-Trace-Id"}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString("headscale")
+	if e.Endpoint != "" {
+		b.WriteString(" " + e.Endpoint)
+	}
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	fmt.Fprintf(&b, ": %s (status %d", msg, e.StatusCode)
+	if e.RequestID != "" {
+		b.WriteString(", request " + e.RequestID)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// GRPCStatus lets status.Code and status.FromError read API errors
+func (e *APIError) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Message)
+}
+
+// newAPIError parses an error response of the gRPC gateway, the body is
+// kept as the message when it is not JSON
+func newAPIError(endpoint string, resp *http.Response, body []byte) *APIError {
+	e := &APIError{
+		Endpoint:   endpoint,
+		StatusCode: resp.StatusCode,
+		Code:       codeFromHTTPStatus(resp.StatusCode),
+	}
+	for _, h := range requestIDHeaders {
+		if id := resp.Header.Get(h); id != "" {
+			e.RequestID = id
+			break
+		}
+	}
+
+	var ge gatewayError
+	if err := json.Unmarshal(body, &ge); err == nil && ge.Message != "" {
+		e.Code = ge.Code
+		e.Message = ge.Message
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+// codeFromHTTPStatus is the reverse of runtime.HTTPStatusFromCode, for
+// errors not answered by the gateway itself
+func codeFromHTTPStatus(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Unknown
+}
+
+// apiErrorFromStatus converts the error of a gRPC call, errors without a
+// status are returned unchanged
+func apiErrorFromStatus(endpoint string, err error, requestID string) error {
+	s, ok := status.FromError(err)
+	if !ok || s.Code() == codes.OK {
+		return err
+	}
+	return &APIError{
+		Endpoint:   endpoint,
+		StatusCode: runtime.HTTPStatusFromCode(s.Code()),
+		Code:       s.Code(),
+		Message:    s.Message(),
+		RequestID:  requestID,
+	}
+}
+
+// IsNotFound reports whether err says the user, node or key does not
+// exist. Headscale answers most lookups of missing records with an
+// unknown error whose message ends in "not found", those count as well
+func IsNotFound(err error) bool {
+	var e *APIError
+	if !errors.As(err, &e) {
+		return false
+	}
+	if e.Code == codes.NotFound || e.StatusCode == http.StatusNotFound {
+		return true
+	}
+	return e.Code == codes.Unknown && strings.HasSuffix(e.Message, "not found")
+}
+
+// IsUnauthorized reports whether err says the API key is missing, invalid
+// or expired
+func IsUnauthorized(err error) bool {
+	var e *APIError
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Code == codes.Unauthenticated || e.Code == codes.PermissionDenied ||
+		e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// IsConflict reports whether err says the record already exists
+func IsConflict(err error) bool {
+	var e *APIError
+	if !errors.As(err, &e) {
+		return false
+	}
+	if e.Code == codes.AlreadyExists || e.StatusCode == http.StatusConflict {
+		return true
+	}
+	return e.Code == codes.Unknown && strings.HasSuffix(e.Message, "already exists")
+}
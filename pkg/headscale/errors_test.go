@@ -0,0 +1,90 @@
+package headscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		header  http.Header
+		want    APIError
+		wantMsg string
+		check   func(error) bool
+	}{
+		"gateway error": {
+			status:  http.StatusNotFound,
+			body:    `{"code":5,"message":"node not found","details":[]}`,
+			header:  http.Header{"X-Request-Id": {"abc"}},
+			want:    APIError{Endpoint: "GetNode", StatusCode: 404, Code: codes.NotFound, Message: "node not found", RequestID: "abc"},
+			wantMsg: "headscale GetNode: node not found (status 404, request abc)",
+			check:   IsNotFound,
+		},
+		"unknown error of a missing record": {
+			status: http.StatusInternalServerError,
+			body:   `{"code":2,"message":"user not found","details":[]}`,
+			want:   APIError{Endpoint: "GetNode", StatusCode: 500, Code: codes.Unknown, Message: "user not found"},
+			check:  IsNotFound,
+		},
+		"plain text": {
+			status:  http.StatusUnauthorized,
+			body:    "Unauthorized\n",
+			want:    APIError{Endpoint: "GetNode", StatusCode: 401, Code: codes.Unauthenticated, Message: "Unauthorized"},
+			wantMsg: "headscale GetNode: Unauthorized (status 401)",
+			check:   IsUnauthorized,
+		},
+		"conflict": {
+			status: http.StatusInternalServerError,
+			body:   `{"code":2,"message":"user already exists"}`,
+			want:   APIError{Endpoint: "GetNode", StatusCode: 500, Code: codes.Unknown, Message: "user already exists"},
+			check:  IsConflict,
+		},
+		"empty body": {
+			status:  http.StatusBadGateway,
+			want:    APIError{Endpoint: "GetNode", StatusCode: 502, Code: codes.Unknown},
+			wantMsg: "headscale GetNode: Bad Gateway (status 502)",
+			check:   func(err error) bool { return !IsNotFound(err) && !IsConflict(err) && !IsUnauthorized(err) },
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := fastRetries(testClient(t, func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			c.Retry.MaxAttempts = 1
+
+			_, err := c.Nodes().Get(context.Background(), "3")
+			var apiErr *APIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, tt.want, *apiErr)
+			if tt.wantMsg != "" {
+				assert.EqualError(t, err, tt.wantMsg)
+			}
+			assert.True(t, tt.check(fmt.Errorf("wrapped: %w", err)))
+			assert.Equal(t, tt.want.Code, status.Code(err))
+		})
+	}
+}
+
+func TestErrorHelpersIgnoreOtherErrors(t *testing.T) {
+	err := errors.New("connection refused")
+	assert.False(t, IsNotFound(err))
+	assert.False(t, IsUnauthorized(err))
+	assert.False(t, IsConflict(err))
+	assert.False(t, IsNotFound(nil))
+}
@@ -0,0 +1,484 @@
+package headscale
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/metrics"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCClient speaks the native Headscale gRPC API, like the headscale CLI
+type GRPCClient struct {
+	conn    *grpc.ClientConn
+	service v1.HeadscaleServiceClient
+	Logger  *slog.Logger
+	Retry   RetryPolicy
+	// Breaker is shared by every call of the client, nil disables it
+	Breaker *CircuitBreaker
+}
+
+var _ HeadscaleClient = (*GRPCClient)(nil)
+
+// NewGRPC returns a client for the gRPC API at address. The address is
+// either host:port, as in HEADSCALE_CLI_ADDRESS, a URL whose http scheme
+// disables TLS or the unix socket of Headscale. Insecure skips verifying the
+// certificate of Headscale
+func NewGRPC(apiKey, address string, insecure bool) (*GRPCClient, error) {
+	target, plaintext, err := grpcTarget(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds credentials.TransportCredentials
+	if !plaintext {
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: insecure})
+	}
+	return newGRPC(apiKey, target, creds)
+}
+
+// newGRPC dials target, without TLS when creds is nil
+func newGRPC(apiKey, target string, creds credentials.TransportCredentials, opts ...grpc.DialOption) (*GRPCClient, error) {
+	auth := tokenAuth{token: apiKey, secure: creds != nil}
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(auth),
+		grpc.WithUserAgent(DefaultUserAgent),
+	}, opts...)
+
+	c := &GRPCClient{
+		Logger:  slog.Default(),
+		Retry:   DefaultRetryPolicy,
+		Breaker: NewCircuitBreaker(DefaultBreakerPolicy),
+	}
+	// every attempt is observed on its own
+	opts = append(opts, grpc.WithChainUnaryInterceptor(c.retryRPC, observeRPC))
+
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.service = v1.NewHeadscaleServiceClient(conn)
+	return c, nil
+}
+
+// grpcTarget returns the host:port to dial and whether TLS is disabled
+func grpcTarget(address string) (string, bool, error) {
+	u, err := url.Parse(address)
+	if err == nil && u.Scheme == "unix" {
+		return address, true, nil
+	}
+	if err != nil || u.Host == "" {
+		// not a URL, e.g. headscale.example.com:50443
+		return address, false, nil
+	}
+
+	switch u.Scheme {
+	case "http":
+		return u.Host, true, nil
+	case "https":
+		return u.Host, false, nil
+	default:
+		return "", false, fmt.Errorf("unsupported scheme %q in gRPC address", u.Scheme)
+	}
+}
+
+// Close closes the connection to Headscale
+func (c *GRPCClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *GRPCClient) PreAuthKeys() PreAuthKeyAPI {
+	return &grpcPreAuthKeyClient{service: c.service}
+}
+
+func (c *GRPCClient) Nodes() NodeAPI {
+	return &grpcNodeClient{service: c.service}
+}
+
+func (c *GRPCClient) Routes() RouteAPI {
+	return &grpcRouteClient{service: c.service}
+}
+
+func (c *GRPCClient) Users() UserAPI {
+	return &grpcUserClient{service: c.service}
+}
+
+// tokenAuth authenticates every call with the API key, like the headscale CLI
+type tokenAuth struct {
+	token  string
+	secure bool
+}
+
+func (t tokenAuth) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + t.token,
+	}, nil
+}
+
+func (t tokenAuth) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+// observeRPC records calls in the same metrics as the REST client, gRPC
+// codes are mapped to the status codes the gateway would have returned.
+// Errors are returned as *APIError like the ones of the REST client
+func observeRPC(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var header metadata.MD
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header))...)
+	metrics.ObserveHeadscaleRequest(path.Base(method), runtime.HTTPStatusFromCode(status.Code(err)), time.Since(start))
+
+	var requestID string
+	if ids := header.Get("x-request-id"); len(ids) > 0 {
+		requestID = ids[0]
+	}
+	return apiErrorFromStatus(path.Base(method), err, requestID)
+}
+
+// notIdempotentRPCs are the calls which must not be made twice
+var notIdempotentRPCs = map[string]bool{
+	"CreatePreAuthKey": true,
+	"CreateUser":       true,
+	"RegisterNode":     true,
+	"RenameUser":       true,
+}
+
+// retryRPC makes the call like Client.do sends requests, retrying transient
+// failures within the deadline of the context and the retry policy
+func (c *GRPCClient) retryRPC(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	endpoint := path.Base(method)
+	canRetry := !notIdempotentRPCs[endpoint]
+
+	for attempt := 1; ; attempt++ {
+		if !c.Breaker.allow(time.Now()) {
+			return fmt.Errorf("%s: %w", endpoint, ErrCircuitOpen)
+		}
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		code := runtime.HTTPStatusFromCode(status.Code(err))
+		c.Breaker.done(ctx, err == nil || !transient(code), time.Now())
+		if err == nil || attempt >= c.Retry.MaxAttempts || !retryable(code, canRetry) {
+			return err
+		}
+
+		delay := c.Retry.delay(attempt)
+		if !withinBudget(ctx, delay) {
+			return err
+		}
+		c.Logger.WarnContext(ctx, "retrying request", "endpoint", endpoint, "attempt", attempt, "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+type grpcPreAuthKeyClient struct {
+	service v1.HeadscaleServiceClient
+}
+
+func (c *grpcPreAuthKeyClient) Create(ctx context.Context, user string, reusable bool, ephemeral bool, expiration time.Time, aclTags []string) (*CreatePreAuthKeyResponse, error) {
+	resp, err := c.service.CreatePreAuthKey(ctx, &v1.CreatePreAuthKeyRequest{
+		User:       user,
+		Reusable:   reusable,
+		Ephemeral:  ephemeral,
+		Expiration: timestamppb.New(expiration),
+		AclTags:    aclTags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &CreatePreAuthKeyResponse{PreAuthKey: preAuthKeyFromProto(resp.GetPreAuthKey())}, nil
+}
+
+func (c *grpcPreAuthKeyClient) List(ctx context.Context, user string) (*ListPreAuthKeysResponse, error) {
+	resp, err := c.service.ListPreAuthKeys(ctx, &v1.ListPreAuthKeysRequest{User: user})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &ListPreAuthKeysResponse{}
+	for _, k := range resp.GetPreAuthKeys() {
+		keys.PreAuthKeys = append(keys.PreAuthKeys, preAuthKeyFromProto(k))
+	}
+	return keys, nil
+}
+
+func (c *grpcPreAuthKeyClient) Expire(ctx context.Context, user string, key string) error {
+	_, err := c.service.ExpirePreAuthKey(ctx, &v1.ExpirePreAuthKeyRequest{User: user, Key: key})
+	return err
+}
+
+type grpcNodeClient struct {
+	service v1.HeadscaleServiceClient
+}
+
+func (c *grpcNodeClient) List(ctx context.Context, user string) (*ListNodesResponse, error) {
+	resp, err := c.service.ListNodes(ctx, &v1.ListNodesRequest{User: user})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := &ListNodesResponse{}
+	for _, n := range resp.GetNodes() {
+		nodes.Nodes = append(nodes.Nodes, nodeFromProto(n))
+	}
+	return nodes, nil
+}
+
+func (c *grpcNodeClient) Get(ctx context.Context, id string) (*NodeResponse, error) {
+	nodeID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.service.GetNode(ctx, &v1.GetNodeRequest{NodeId: nodeID})
+	if err != nil {
+		return nil, err
+	}
+	return &NodeResponse{Node: nodeFromProto(resp.GetNode())}, nil
+}
+
+func (c *grpcNodeClient) Delete(ctx context.Context, id string) error {
+	nodeID, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.service.DeleteNode(ctx, &v1.DeleteNodeRequest{NodeId: nodeID})
+	return err
+}
+
+func (c *grpcNodeClient) Expire(ctx context.Context, id string) (*NodeResponse, error) {
+	nodeID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.service.ExpireNode(ctx, &v1.ExpireNodeRequest{NodeId: nodeID})
+	if err != nil {
+		return nil, err
+	}
+	return &NodeResponse{Node: nodeFromProto(resp.GetNode())}, nil
+}
+
+func (c *grpcNodeClient) Rename(ctx context.Context, id string, name string) (*NodeResponse, error) {
+	nodeID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.service.RenameNode(ctx, &v1.RenameNodeRequest{NodeId: nodeID, NewName: name})
+	if err != nil {
+		return nil, err
+	}
+	return &NodeResponse{Node: nodeFromProto(resp.GetNode())}, nil
+}
+
+func (c *grpcNodeClient) SetTags(ctx context.Context, id string, tags []string) (*NodeResponse, error) {
+	nodeID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.service.SetTags(ctx, &v1.SetTagsRequest{NodeId: nodeID, Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	return &NodeResponse{Node: nodeFromProto(resp.GetNode())}, nil
+}
+
+func (c *grpcNodeClient) Register(ctx context.Context, user string, key string) (*NodeResponse, error) {
+	resp, err := c.service.RegisterNode(ctx, &v1.RegisterNodeRequest{User: user, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return &NodeResponse{Node: nodeFromProto(resp.GetNode())}, nil
+}
+
+type grpcUserClient struct {
+	service v1.HeadscaleServiceClient
+}
+
+func (c *grpcUserClient) Create(ctx context.Context, name string) (*UserResponse, error) {
+	resp, err := c.service.CreateUser(ctx, &v1.CreateUserRequest{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return &UserResponse{User: userFromProto(resp.GetUser())}, nil
+}
+
+func (c *grpcUserClient) List(ctx context.Context) (*UsersResponse, error) {
+	resp, err := c.service.ListUsers(ctx, &v1.ListUsersRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	users := &UsersResponse{}
+	for _, u := range resp.GetUsers() {
+		users.Users = append(users.Users, userFromProto(u))
+	}
+	return users, nil
+}
+
+func (c *grpcUserClient) Rename(ctx context.Context, oldName string, newName string) (*UserResponse, error) {
+	resp, err := c.service.RenameUser(ctx, &v1.RenameUserRequest{OldName: oldName, NewName: newName})
+	if err != nil {
+		return nil, err
+	}
+	return &UserResponse{User: userFromProto(resp.GetUser())}, nil
+}
+
+func (c *grpcUserClient) Delete(ctx context.Context, name string) error {
+	_, err := c.service.DeleteUser(ctx, &v1.DeleteUserRequest{Name: name})
+	return err
+}
+
+type grpcRouteClient struct {
+	service v1.HeadscaleServiceClient
+}
+
+func (c *grpcRouteClient) List(ctx context.Context) (*RoutesResponse, error) {
+	resp, err := c.service.GetRoutes(ctx, &v1.GetRoutesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return routesFromProto(resp.GetRoutes()), nil
+}
+
+func (c *grpcRouteClient) ListNode(ctx context.Context, nodeID string) (*RoutesResponse, error) {
+	id, err := parseID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.service.GetNodeRoutes(ctx, &v1.GetNodeRoutesRequest{NodeId: id})
+	if err != nil {
+		return nil, err
+	}
+	return routesFromProto(resp.GetRoutes()), nil
+}
+
+func (c *grpcRouteClient) Enable(ctx context.Context, id string) error {
+	routeID, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.service.EnableRoute(ctx, &v1.EnableRouteRequest{RouteId: routeID})
+	return err
+}
+
+func (c *grpcRouteClient) Disable(ctx context.Context, id string) error {
+	routeID, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.service.DisableRoute(ctx, &v1.DisableRouteRequest{RouteId: routeID})
+	return err
+}
+
+func (c *grpcRouteClient) Delete(ctx context.Context, id string) error {
+	routeID, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.service.DeleteRoute(ctx, &v1.DeleteRouteRequest{RouteId: routeID})
+	return err
+}
+
+// parseID parses the id of a node or route, ids are strings in the REST
+// gateway
+func parseID(id string) (uint64, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q: %w", id, err)
+	}
+	return n, nil
+}
+
+func timeFromProto(t *timestamppb.Timestamp) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.AsTime()
+}
+
+func userFromProto(u *v1.User) User {
+	return User{
+		ID:        u.GetId(),
+		Name:      u.GetName(),
+		CreatedAt: timeFromProto(u.GetCreatedAt()),
+	}
+}
+
+func preAuthKeyFromProto(k *v1.PreAuthKey) PreAuthKey {
+	return PreAuthKey{
+		User:       k.GetUser(),
+		ID:         k.GetId(),
+		Key:        k.GetKey(),
+		Reusable:   k.GetReusable(),
+		Ephemeral:  k.GetEphemeral(),
+		Used:       k.GetUsed(),
+		Expiration: timeFromProto(k.GetExpiration()),
+		CreatedAt:  timeFromProto(k.GetCreatedAt()),
+		AclTags:    k.GetAclTags(),
+	}
+}
+
+func routesFromProto(routes []*v1.Route) *RoutesResponse {
+	resp := &RoutesResponse{}
+	for _, r := range routes {
+		resp.Routes = append(resp.Routes, Route{
+			ID:         strconv.FormatUint(r.GetId(), 10),
+			Node:       nodeFromProto(r.GetNode()),
+			Prefix:     r.GetPrefix(),
+			Advertised: r.GetAdvertised(),
+			Enabled:    r.GetEnabled(),
+			IsPrimary:  r.GetIsPrimary(),
+			CreatedAt:  timeFromProto(r.GetCreatedAt()),
+			UpdatedAt:  timeFromProto(r.GetUpdatedAt()),
+		})
+	}
+	return resp
+}
+
+func nodeFromProto(n *v1.Node) Node {
+	node := Node{
+		ID:             strconv.FormatUint(n.GetId(), 10),
+		MachineKey:     n.GetMachineKey(),
+		NodeKey:        n.GetNodeKey(),
+		DiscoKey:       n.GetDiscoKey(),
+		IPAddresses:    n.GetIpAddresses(),
+		Name:           n.GetName(),
+		User:           userFromProto(n.GetUser()),
+		LastSeen:       timeFromProto(n.GetLastSeen()),
+		Expiry:         timeFromProto(n.GetExpiry()),
+		CreatedAt:      timeFromProto(n.GetCreatedAt()),
+		RegisterMethod: n.GetRegisterMethod().String(),
+		ForcedTags:     n.GetForcedTags(),
+		InvalidTags:    n.GetInvalidTags(),
+		ValidTags:      n.GetValidTags(),
+		GivenName:      n.GetGivenName(),
+		Online:         n.GetOnline(),
+	}
+	if n.GetPreAuthKey() != nil {
+		key := preAuthKeyFromProto(n.GetPreAuthKey())
+		node.PreAuthKey = &key
+	}
+	return node
+}
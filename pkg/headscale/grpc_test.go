@@ -0,0 +1,269 @@
+package headscale
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeService is a Headscale gRPC server knowing node 3 of user sammm
+type fakeService struct {
+	v1.UnimplementedHeadscaleServiceServer
+	authorization []string
+	deleted       []uint64
+	enabled       []uint64
+	// the next failures calls of CreatePreAuthKey and ListUsers fail with
+	// failure
+	failures int
+	failure  codes.Code
+	calls    int
+}
+
+func (s *fakeService) fail() error {
+	s.calls++
+	if s.failures == 0 {
+		return nil
+	}
+	s.failures--
+	return status.Error(s.failure, "failing")
+}
+
+func (s *fakeService) authorize(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.authorization = append(s.authorization, md.Get("authorization")...)
+}
+
+func (s *fakeService) CreatePreAuthKey(ctx context.Context, req *v1.CreatePreAuthKeyRequest) (*v1.CreatePreAuthKeyResponse, error) {
+	s.authorize(ctx)
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return &v1.CreatePreAuthKeyResponse{PreAuthKey: &v1.PreAuthKey{
+		Id:         "7",
+		Key:        "hs-key",
+		User:       req.GetUser(),
+		Ephemeral:  req.GetEphemeral(),
+		Expiration: req.GetExpiration(),
+		AclTags:    req.GetAclTags(),
+	}}, nil
+}
+
+func (s *fakeService) ListNodes(ctx context.Context, req *v1.ListNodesRequest) (*v1.ListNodesResponse, error) {
+	s.authorize(ctx)
+	return &v1.ListNodesResponse{Nodes: []*v1.Node{{
+		Id:             3,
+		Name:           "web",
+		User:           &v1.User{Id: "1", Name: req.GetUser()},
+		PreAuthKey:     &v1.PreAuthKey{Id: "7"},
+		RegisterMethod: v1.RegisterMethod_REGISTER_METHOD_AUTH_KEY,
+	}}}, nil
+}
+
+func (s *fakeService) GetNode(ctx context.Context, req *v1.GetNodeRequest) (*v1.GetNodeResponse, error) {
+	s.authorize(ctx)
+	return nil, status.Errorf(codes.NotFound, "node %d not found", req.GetNodeId())
+}
+
+func (s *fakeService) DeleteNode(ctx context.Context, req *v1.DeleteNodeRequest) (*v1.DeleteNodeResponse, error) {
+	s.authorize(ctx)
+	s.deleted = append(s.deleted, req.GetNodeId())
+	return &v1.DeleteNodeResponse{}, nil
+}
+
+func (s *fakeService) ListUsers(ctx context.Context, _ *v1.ListUsersRequest) (*v1.ListUsersResponse, error) {
+	s.authorize(ctx)
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return &v1.ListUsersResponse{Users: []*v1.User{{Id: "1", Name: "sammm"}}}, nil
+}
+
+func (s *fakeService) GetNodeRoutes(ctx context.Context, req *v1.GetNodeRoutesRequest) (*v1.GetNodeRoutesResponse, error) {
+	s.authorize(ctx)
+	return &v1.GetNodeRoutesResponse{Routes: []*v1.Route{{
+		Id:         5,
+		Node:       &v1.Node{Id: req.GetNodeId()},
+		Prefix:     "10.0.0.0/8",
+		Advertised: true,
+	}}}, nil
+}
+
+func (s *fakeService) EnableRoute(ctx context.Context, req *v1.EnableRouteRequest) (*v1.EnableRouteResponse, error) {
+	s.authorize(ctx)
+	s.enabled = append(s.enabled, req.GetRouteId())
+	return &v1.EnableRouteResponse{}, nil
+}
+
+func testGRPCClient(t *testing.T) (*GRPCClient, *fakeService) {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	svc := &fakeService{}
+	srv := grpc.NewServer()
+	v1.RegisterHeadscaleServiceServer(srv, svc)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	c, err := newGRPC("hskey", "passthrough:///bufnet", nil,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c, svc
+}
+
+func TestGRPCClient(t *testing.T) {
+	ctx := context.Background()
+	c, svc := testGRPCClient(t)
+	expiry := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	key, err := c.PreAuthKeys().Create(ctx, "sammm", false, true, expiry, []string{"tag:pod"})
+	require.NoError(t, err)
+	assert.Equal(t, PreAuthKey{
+		User:       "sammm",
+		ID:         "7",
+		Key:        "hs-key",
+		Ephemeral:  true,
+		Expiration: expiry,
+		AclTags:    []string{"tag:pod"},
+	}, key.PreAuthKey)
+
+	nodes, err := c.Nodes().List(ctx, "sammm")
+	require.NoError(t, err)
+	require.Len(t, nodes.Nodes, 1)
+	assert.Equal(t, "3", nodes.Nodes[0].ID)
+	assert.Equal(t, "sammm", nodes.Nodes[0].User.Name)
+	assert.Equal(t, "7", nodes.Nodes[0].PreAuthKey.ID)
+	assert.Equal(t, "REGISTER_METHOD_AUTH_KEY", nodes.Nodes[0].RegisterMethod)
+
+	require.NoError(t, c.Nodes().Delete(ctx, "3"))
+	assert.Equal(t, []uint64{3}, svc.deleted)
+
+	users, err := c.Users().List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []User{{ID: "1", Name: "sammm"}}, users.Users)
+
+	routes, err := c.Routes().ListNode(ctx, "3")
+	require.NoError(t, err)
+	require.Len(t, routes.Routes, 1)
+	assert.Equal(t, "5", routes.Routes[0].ID)
+	assert.Equal(t, "3", routes.Routes[0].Node.ID)
+	assert.Equal(t, "10.0.0.0/8", routes.Routes[0].Prefix)
+
+	require.NoError(t, c.Routes().Enable(ctx, "5"))
+	assert.Equal(t, []uint64{5}, svc.enabled)
+
+	_, err = c.Nodes().Get(ctx, "404")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.True(t, IsNotFound(err))
+	assert.EqualError(t, err, "headscale GetNode: node 404 not found (status 404)")
+
+	_, err = c.Nodes().Get(ctx, "web")
+	assert.ErrorContains(t, err, "invalid id")
+
+	for _, auth := range svc.authorization {
+		assert.Equal(t, "Bearer hskey", auth)
+	}
+}
+
+func TestGRPCClientRetry(t *testing.T) {
+	ctx := context.Background()
+	expiry := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fast := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	t.Run("idempotent calls retry server errors", func(t *testing.T) {
+		c, svc := testGRPCClient(t)
+		c.Retry, c.Breaker = fast, nil
+		svc.failures, svc.failure = 2, codes.Internal
+		_, err := c.Users().List(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, svc.calls)
+	})
+
+	t.Run("creating a key is not retried on server errors", func(t *testing.T) {
+		c, svc := testGRPCClient(t)
+		c.Retry, c.Breaker = fast, nil
+		svc.failures, svc.failure = 1, codes.Internal
+		_, err := c.PreAuthKeys().Create(ctx, "sammm", false, true, expiry, nil)
+		assert.Error(t, err)
+		assert.Equal(t, 1, svc.calls)
+	})
+
+	t.Run("creating a key is retried when unavailable", func(t *testing.T) {
+		c, svc := testGRPCClient(t)
+		c.Retry, c.Breaker = fast, nil
+		svc.failures, svc.failure = 1, codes.Unavailable
+		key, err := c.PreAuthKeys().Create(ctx, "sammm", false, true, expiry, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "7", key.PreAuthKey.ID)
+		assert.Equal(t, 2, svc.calls)
+	})
+
+	t.Run("the circuit opens", func(t *testing.T) {
+		c, svc := testGRPCClient(t)
+		c.Retry = RetryPolicy{MaxAttempts: 1}
+		c.Breaker = NewCircuitBreaker(BreakerPolicy{Threshold: 2, Cooldown: time.Minute})
+		svc.failures, svc.failure = 10, codes.Unavailable
+		for range 2 {
+			_, err := c.Users().List(ctx)
+			assert.Equal(t, codes.Unavailable, status.Code(err))
+		}
+		_, err := c.Users().List(ctx)
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.Equal(t, 2, svc.calls)
+	})
+
+	t.Run("callers giving up do not open the circuit", func(t *testing.T) {
+		c, svc := testGRPCClient(t)
+		c.Retry = RetryPolicy{MaxAttempts: 1}
+		c.Breaker = NewCircuitBreaker(BreakerPolicy{Threshold: 1, Cooldown: time.Minute})
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := c.Users().List(cancelled)
+		assert.Equal(t, codes.Canceled, status.Code(err))
+		_, err = c.Users().List(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, svc.calls)
+	})
+}
+
+func TestGRPCTarget(t *testing.T) {
+	cases := map[string]struct {
+		target    string
+		plaintext bool
+	}{
+		"headscale.example.com:50443":       {"headscale.example.com:50443", false},
+		"https://headscale.example.com:443": {"headscale.example.com:443", false},
+		"http://headscale.headscale:50443":  {"headscale.headscale:50443", true},
+		"unix:///var/run/headscale.sock":    {"unix:///var/run/headscale.sock", true},
+	}
+
+	for address, want := range cases {
+		target, plaintext, err := grpcTarget(address)
+		require.NoError(t, err, address)
+		assert.Equal(t, want.target, target, address)
+		assert.Equal(t, want.plaintext, plaintext, address)
+	}
+
+	_, _, err := grpcTarget("ftp://headscale.example.com:21")
+	assert.Error(t, err)
+}
+
+// timestamps missing from responses are zero times, not the epoch
+func TestTimeFromProto(t *testing.T) {
+	assert.True(t, timeFromProto(nil).IsZero())
+	assert.Equal(t, time.Unix(10, 0).UTC(), timeFromProto(timestamppb.New(time.Unix(10, 0))))
+}
@@ -0,0 +1,179 @@
+package headscale
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type NodeClient struct {
+	client restClient
+}
+
+type Node struct {
+	ID             string      `json:"id"`
+	MachineKey     string      `json:"machineKey"`
+	NodeKey        string      `json:"nodeKey"`
+	DiscoKey       string      `json:"discoKey"`
+	IPAddresses    []string    `json:"ipAddresses"`
+	Name           string      `json:"name"`
+	User           User        `json:"user"`
+	LastSeen       time.Time   `json:"lastSeen"`
+	Expiry         time.Time   `json:"expiry"`
+	PreAuthKey     *PreAuthKey `json:"preAuthKey,omitempty"`
+	CreatedAt      time.Time   `json:"createdAt"`
+	RegisterMethod string      `json:"registerMethod"`
+	ForcedTags     []string    `json:"forcedTags"`
+	InvalidTags    []string    `json:"invalidTags"`
+	ValidTags      []string    `json:"validTags"`
+	GivenName      string      `json:"givenName"`
+	Online         bool        `json:"online"`
+}
+
+type ListNodesResponse struct {
+	Nodes []Node `json:"nodes"`
+}
+
+type NodeResponse struct {
+	Node Node `json:"node"`
+}
+
+type SetTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// List returns the nodes of a user, every node when user is empty
+func (n *NodeClient) List(ctx context.Context, user string) (*ListNodesResponse, error) {
+	nodes := &ListNodesResponse{}
+
+	params := map[string]string{}
+	if user != "" {
+		params["user"] = user
+	}
+
+	uri := n.client.buildPath("node")
+	req, err := n.client.buildRequest(ctx, http.MethodGet, uri, request{
+		endpoint: "ListNodes",
+		params:   params,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.client.do(ctx, req, nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (n *NodeClient) Get(ctx context.Context, id string) (*NodeResponse, error) {
+	node := &NodeResponse{}
+
+	uri := n.client.buildPath("node", id)
+	req, err := n.client.buildRequest(ctx, http.MethodGet, uri, request{
+		endpoint: "GetNode",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.client.do(ctx, req, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (n *NodeClient) Delete(ctx context.Context, id string) error {
+	uri := n.client.buildPath("node", id)
+	req, err := n.client.buildRequest(ctx, http.MethodDelete, uri, request{
+		endpoint: "DeleteNode",
+	})
+	if err != nil {
+		return err
+	}
+	return n.client.do(ctx, req, nil)
+}
+
+// Expire logs the node out, it has to authenticate again to rejoin
+func (n *NodeClient) Expire(ctx context.Context, id string) (*NodeResponse, error) {
+	node := &NodeResponse{}
+
+	uri := n.client.buildPath("node", id, "expire")
+	req, err := n.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint:   "ExpireNode",
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.client.do(ctx, req, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Rename sets the given name of the node, used in its MagicDNS name
+func (n *NodeClient) Rename(ctx context.Context, id string, name string) (*NodeResponse, error) {
+	node := &NodeResponse{}
+
+	uri := n.client.buildPath("node", id, "rename", name)
+	req, err := n.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint:   "RenameNode",
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.client.do(ctx, req, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// SetTags replaces the forced tags of the node, tags include the "tag:"
+// prefix
+func (n *NodeClient) SetTags(ctx context.Context, id string, tags []string) (*NodeResponse, error) {
+	node := &NodeResponse{}
+
+	uri := n.client.buildPath("node", id, "tags")
+	req, err := n.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint:    "SetTags",
+		idempotent:  true,
+		contentType: "application/json",
+		body: SetTagsRequest{
+			Tags: tags,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.client.do(ctx, req, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Register registers the machine waiting on key as a node of user
+func (n *NodeClient) Register(ctx context.Context, user string, key string) (*NodeResponse, error) {
+	node := &NodeResponse{}
+
+	uri := n.client.buildPath("node", "register")
+	req, err := n.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint: "RegisterNode",
+		params: map[string]string{
+			"user": user,
+			"key":  key,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.client.do(ctx, req, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
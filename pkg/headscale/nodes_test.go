@@ -0,0 +1,122 @@
+package headscale
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient returns a client for a fake Headscale serving handler
+func testClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := New(context.Background(), "hskey", srv.URL)
+	require.NoError(t, err)
+	return c
+}
+
+// expect asserts the request made and replies with resp
+func expect(t *testing.T, method, path, query, body string, resp any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, method, r.Method)
+		assert.Equal(t, path, r.URL.Path)
+		assert.Equal(t, query, r.URL.RawQuery)
+		assert.Equal(t, "Bearer hskey", r.Header.Get("Authorization"))
+
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if body == "" {
+			assert.Empty(t, b)
+		} else {
+			assert.JSONEq(t, body, string(b))
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func TestNodeClient(t *testing.T) {
+	ctx := context.Background()
+	node := NodeResponse{Node: Node{
+		ID:          "3",
+		Name:        "web",
+		GivenName:   "web-apps",
+		User:        User{ID: "1", Name: "sammm"},
+		IPAddresses: []string{"100.64.0.3"},
+		ForcedTags:  []string{"tag:pod"},
+		PreAuthKey:  &PreAuthKey{ID: "7"},
+	}}
+
+	t.Run("list", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodGet, "/api/v1/node", "user=sammm", "", ListNodesResponse{Nodes: []Node{node.Node}}))
+		got, err := c.Nodes().List(ctx, "sammm")
+		require.NoError(t, err)
+		assert.Equal(t, []Node{node.Node}, got.Nodes)
+	})
+
+	t.Run("list all", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodGet, "/api/v1/node", "", "", ListNodesResponse{}))
+		got, err := c.Nodes().List(ctx, "")
+		require.NoError(t, err)
+		assert.Empty(t, got.Nodes)
+	})
+
+	t.Run("get", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodGet, "/api/v1/node/3", "", "", node))
+		got, err := c.Nodes().Get(ctx, "3")
+		require.NoError(t, err)
+		assert.Equal(t, &node, got)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodDelete, "/api/v1/node/3", "", "", struct{}{}))
+		assert.NoError(t, c.Nodes().Delete(ctx, "3"))
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/node/3/expire", "", "", node))
+		got, err := c.Nodes().Expire(ctx, "3")
+		require.NoError(t, err)
+		assert.Equal(t, "3", got.Node.ID)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/node/3/rename/web-apps", "", "", node))
+		got, err := c.Nodes().Rename(ctx, "3", "web-apps")
+		require.NoError(t, err)
+		assert.Equal(t, "web-apps", got.Node.GivenName)
+	})
+
+	t.Run("set tags", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/node/3/tags", "", `{"tags":["tag:pod"]}`, node))
+		got, err := c.Nodes().SetTags(ctx, "3", []string{"tag:pod"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"tag:pod"}, got.Node.ForcedTags)
+	})
+
+	t.Run("register", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/node/register", "key=mkey%3Aabc&user=sammm", "", node))
+		got, err := c.Nodes().Register(ctx, "sammm", "mkey:abc")
+		require.NoError(t, err)
+		assert.Equal(t, "sammm", got.Node.User.Name)
+	})
+}
+
+func TestNodeClientError(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":5,"message":"node not found"}`, http.StatusNotFound)
+	})
+
+	_, err := c.Nodes().Get(context.Background(), "404")
+	assert.Error(t, err)
+	assert.Error(t, c.Nodes().Delete(context.Background(), "404"))
+}
@@ -7,7 +7,7 @@ import (
 )
 
 type PreAuthKeyClient struct {
-	client HeadscaleClient
+	client restClient
 }
 
 type PreAuthKey struct {
@@ -47,6 +47,7 @@ func (c *PreAuthKeyClient) Create(ctx context.Context, user string, reusable boo
 	keys := &CreatePreAuthKeyResponse{}
 	uri := c.client.buildPath("preauthkey")
 	req, err := c.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint:    "CreatePreAuthKey",
 		contentType: "application/json",
 		body: CreatePreAuthKeyRequest{
 			User:       user,
@@ -69,6 +70,7 @@ func (c *PreAuthKeyClient) List(ctx context.Context, user string) (*ListPreAuthK
 	keys := &ListPreAuthKeysResponse{}
 	uri := c.client.buildPath("preauthkey")
 	req, err := c.client.buildRequest(ctx, http.MethodGet, uri, request{
+		endpoint:    "ListPreAuthKeys",
 		contentType: "application/json",
 		params: map[string]string{
 			"user": user,
@@ -87,6 +89,8 @@ func (c *PreAuthKeyClient) List(ctx context.Context, user string) (*ListPreAuthK
 func (c *PreAuthKeyClient) Expire(ctx context.Context, user string, key string) error {
 	uri := c.client.buildPath("preauthkey", "expire")
 	req, err := c.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint:   "ExpirePreAuthKey",
+		idempotent: true,
 		body: ExpirePreAuthKeyRequest{
 			User: user,
 			Key:  key,
@@ -0,0 +1,181 @@
+package headscale
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPolicy retries transient failures with jittered exponential backoff
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one, one
+	// or less disables retries
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// BreakerPolicy configures a CircuitBreaker, a zero threshold disables it
+type BreakerPolicy struct {
+	// Threshold is the number of consecutive failures opening the circuit
+	Threshold int
+	// Cooldown is how long calls fail fast once the circuit is open
+	Cooldown time.Duration
+}
+
+var (
+	DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+	}
+	DefaultBreakerPolicy = BreakerPolicy{
+		Threshold: 5,
+		Cooldown:  30 * time.Second,
+	}
+)
+
+// minAttemptTime is the least time left worth retrying with
+const minAttemptTime = 100 * time.Millisecond
+
+var ErrCircuitOpen error = errors.New("headscale circuit breaker open: too many consecutive failures")
+
+// delay returns the backoff before the given retry, starting at 1
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.MaxDelay
+	if shift := retry - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay {
+		d = p.BaseDelay << shift
+	}
+	if d <= 0 {
+		return 0
+	}
+	// full jitter spreads the retries of concurrent admissions
+	return rand.N(d)
+}
+
+// CircuitBreaker stops calling Headscale while it is down. Once Threshold
+// consecutive calls failed, calls fail fast with ErrCircuitOpen for
+// Cooldown, then a single call is let through to probe Headscale
+type CircuitBreaker struct {
+	policy BreakerPolicy
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(p BreakerPolicy) *CircuitBreaker {
+	return &CircuitBreaker{policy: p}
+}
+
+// allow reports whether a call may be made
+func (b *CircuitBreaker) allow(now time.Time) bool {
+	if b == nil || b.policy.Threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.policy.Threshold {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a call
+func (b *CircuitBreaker) record(ok bool, now time.Time) {
+	if b == nil || b.policy.Threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.policy.Threshold {
+		b.openUntil = now.Add(b.policy.Cooldown)
+	}
+}
+
+// done records the outcome of a call unless the caller gave up on it, e.g.
+// the admission ran out of time, which says nothing about Headscale
+func (b *CircuitBreaker) done(ctx context.Context, ok bool, now time.Time) {
+	if ctx.Err() == nil {
+		b.record(ok, now)
+		return
+	}
+	if b == nil || b.policy.Threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// transient reports whether a failure says Headscale is unhealthy rather
+// than the request being wrong, status is 0 when no response was received
+func transient(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// retryable reports whether an attempt can be made again. Requests which
+// are not idempotent are only retried when Headscale cannot have handled
+// them, so retrying never mints two keys
+func retryable(status int, idempotent bool) bool {
+	if idempotent {
+		return transient(status)
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// idempotent reports whether a request may be sent twice
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	v, _ := req.Context().Value(idempotentKey{}).(bool)
+	return v
+}
+
+// retryAfter returns the delay asked for by a Retry-After header in seconds
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	s, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
+
+// withinBudget reports whether waiting d still leaves time before the
+// deadline of the context, e.g. the one of the admission request
+func withinBudget(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+	return time.Until(deadline) > d+minAttemptTime
+}
@@ -0,0 +1,157 @@
+package headscale
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flaky fails the first n calls with status then replies with resp
+func flaky(n int32, status int, resp http.HandlerFunc) (http.HandlerFunc, *atomic.Int32) {
+	calls := &atomic.Int32{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= n {
+			http.Error(w, `{"code":14,"message":"unavailable"}`, status)
+			return
+		}
+		resp(w, r)
+	}, calls
+}
+
+func fastRetries(c *Client) *Client {
+	c.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	c.Breaker = nil
+	return c
+}
+
+func TestClientRetry(t *testing.T) {
+	ctx := context.Background()
+	ok := expect(t, http.MethodPost, "/api/v1/preauthkey", "", `{"user":"sammm","reusable":false,"ephemeral":true,"expiration":"2025-01-01T00:00:00Z","aclTags":null}`, CreatePreAuthKeyResponse{PreAuthKey: PreAuthKey{ID: "7"}})
+	expiry := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("idempotent calls retry server errors", func(t *testing.T) {
+		h, calls := flaky(2, http.StatusInternalServerError, expect(t, http.MethodGet, "/api/v1/node", "", "", ListNodesResponse{}))
+		c := fastRetries(testClient(t, h))
+		_, err := c.Nodes().List(ctx, "")
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, calls.Load())
+	})
+
+	t.Run("creating a key is not retried on server errors", func(t *testing.T) {
+		h, calls := flaky(1, http.StatusInternalServerError, ok)
+		c := fastRetries(testClient(t, h))
+		_, err := c.PreAuthKeys().Create(ctx, "sammm", false, true, expiry, nil)
+		assert.Error(t, err)
+		assert.EqualValues(t, 1, calls.Load())
+	})
+
+	t.Run("creating a key is retried when unavailable", func(t *testing.T) {
+		h, calls := flaky(1, http.StatusServiceUnavailable, ok)
+		c := fastRetries(testClient(t, h))
+		key, err := c.PreAuthKeys().Create(ctx, "sammm", false, true, expiry, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "7", key.PreAuthKey.ID)
+		assert.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("client errors are not retried", func(t *testing.T) {
+		h, calls := flaky(1, http.StatusNotFound, nil)
+		c := fastRetries(testClient(t, h))
+		_, err := c.Nodes().Get(ctx, "404")
+		assert.Error(t, err)
+		assert.EqualValues(t, 1, calls.Load())
+	})
+
+	t.Run("attempts are bounded", func(t *testing.T) {
+		h, calls := flaky(10, http.StatusBadGateway, nil)
+		c := fastRetries(testClient(t, h))
+		_, err := c.Nodes().Get(ctx, "3")
+		assert.Error(t, err)
+		assert.EqualValues(t, 3, calls.Load())
+	})
+
+	t.Run("retries stop at the deadline", func(t *testing.T) {
+		var calls atomic.Int32
+		c := fastRetries(testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			// longer than the deadline leaves
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		_, err := c.Nodes().Get(ctx, "3")
+		assert.Error(t, err)
+		assert.EqualValues(t, 1, calls.Load())
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(BreakerPolicy{Threshold: 2, Cooldown: time.Minute})
+	now := time.Now()
+
+	assert.True(t, b.allow(now))
+	b.record(false, now)
+	assert.True(t, b.allow(now), "below the threshold")
+	b.record(false, now)
+	assert.False(t, b.allow(now), "open once the threshold is reached")
+
+	later := now.Add(2 * time.Minute)
+	assert.True(t, b.allow(later), "a probe is let through after the cooldown")
+	assert.False(t, b.allow(later), "only one probe at a time")
+	b.record(false, later)
+	assert.False(t, b.allow(later.Add(time.Second)), "a failed probe opens the circuit again")
+
+	later = later.Add(2 * time.Minute)
+	assert.True(t, b.allow(later))
+	b.record(true, later)
+	assert.True(t, b.allow(later), "a successful probe closes the circuit")
+	assert.True(t, b.allow(later))
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	h, calls := flaky(10, http.StatusServiceUnavailable, nil)
+	c := testClient(t, h)
+	c.Retry = RetryPolicy{MaxAttempts: 1}
+	c.Breaker = NewCircuitBreaker(BreakerPolicy{Threshold: 2, Cooldown: time.Minute})
+
+	for range 3 {
+		_, err := c.Nodes().Get(context.Background(), "3")
+		assert.Error(t, err)
+	}
+	_, err := c.Nodes().Get(context.Background(), "3")
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.EqualValues(t, 2, calls.Load())
+}
+
+// an admission running out of time says nothing about Headscale
+func TestClientCircuitBreakerCancelled(t *testing.T) {
+	h, calls := flaky(0, http.StatusOK, expect(t, http.MethodGet, "/api/v1/node/3", "", "", NodeResponse{}))
+	c := testClient(t, h)
+	c.Retry = RetryPolicy{MaxAttempts: 1}
+	c.Breaker = NewCircuitBreaker(BreakerPolicy{Threshold: 1, Cooldown: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Nodes().Get(ctx, "3")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = c.Nodes().Get(context.Background(), "3")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, calls.Load())
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry := 1; retry < 100; retry++ {
+		d := p.delay(retry)
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		assert.Less(t, d, time.Second)
+	}
+}
@@ -0,0 +1,85 @@
+package headscale
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type RouteClient struct {
+	client restClient
+}
+
+// Route is a prefix advertised by a node, it is only routed once enabled
+type Route struct {
+	ID         string    `json:"id"`
+	Node       Node      `json:"node"`
+	Prefix     string    `json:"prefix"`
+	Advertised bool      `json:"advertised"`
+	Enabled    bool      `json:"enabled"`
+	IsPrimary  bool      `json:"isPrimary"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+type RoutesResponse struct {
+	Routes []Route `json:"routes"`
+}
+
+// List returns the routes of every node
+func (r *RouteClient) List(ctx context.Context) (*RoutesResponse, error) {
+	return r.list(ctx, "GetRoutes", r.client.buildPath("routes"))
+}
+
+// ListNode returns the routes of a node
+func (r *RouteClient) ListNode(ctx context.Context, nodeID string) (*RoutesResponse, error) {
+	return r.list(ctx, "GetNodeRoutes", r.client.buildPath("node", nodeID, "routes"))
+}
+
+func (r *RouteClient) list(ctx context.Context, endpoint string, uri *url.URL) (*RoutesResponse, error) {
+	routes := &RoutesResponse{}
+	req, err := r.client.buildRequest(ctx, http.MethodGet, uri, request{
+		endpoint: endpoint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.client.do(ctx, req, routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// Enable approves a route, traffic to its prefix is sent to its node
+func (r *RouteClient) Enable(ctx context.Context, id string) error {
+	return r.post(ctx, "EnableRoute", id, "enable")
+}
+
+func (r *RouteClient) Disable(ctx context.Context, id string) error {
+	return r.post(ctx, "DisableRoute", id, "disable")
+}
+
+func (r *RouteClient) post(ctx context.Context, endpoint, id, action string) error {
+	uri := r.client.buildPath("routes", id, action)
+	req, err := r.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint:   endpoint,
+		idempotent: true,
+	})
+	if err != nil {
+		return err
+	}
+	return r.client.do(ctx, req, nil)
+}
+
+func (r *RouteClient) Delete(ctx context.Context, id string) error {
+	uri := r.client.buildPath("routes", id)
+	req, err := r.client.buildRequest(ctx, http.MethodDelete, uri, request{
+		endpoint: "DeleteRoute",
+	})
+	if err != nil {
+		return err
+	}
+	return r.client.do(ctx, req, nil)
+}
@@ -0,0 +1,49 @@
+package headscale
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteClient(t *testing.T) {
+	ctx := context.Background()
+	route := Route{
+		ID:         "5",
+		Node:       Node{ID: "3", Name: "web"},
+		Prefix:     "10.0.0.0/8",
+		Advertised: true,
+	}
+
+	t.Run("list", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodGet, "/api/v1/routes", "", "", RoutesResponse{Routes: []Route{route}}))
+		got, err := c.Routes().List(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []Route{route}, got.Routes)
+	})
+
+	t.Run("list node", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodGet, "/api/v1/node/3/routes", "", "", RoutesResponse{Routes: []Route{route}}))
+		got, err := c.Routes().ListNode(ctx, "3")
+		require.NoError(t, err)
+		assert.Equal(t, []Route{route}, got.Routes)
+	})
+
+	t.Run("enable", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/routes/5/enable", "", "", struct{}{}))
+		assert.NoError(t, c.Routes().Enable(ctx, "5"))
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/routes/5/disable", "", "", struct{}{}))
+		assert.NoError(t, c.Routes().Disable(ctx, "5"))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodDelete, "/api/v1/routes/5", "", "", struct{}{}))
+		assert.NoError(t, c.Routes().Delete(ctx, "5"))
+	})
+}
@@ -7,7 +7,7 @@ import (
 )
 
 type UserClient struct {
-	client HeadscaleClient
+	client restClient
 }
 
 type User struct {
@@ -22,18 +22,24 @@ type User struct {
 }
 
 type UsersResponse struct {
-	Users []User `json:"user"`
+	Users []User `json:"users"`
+}
+
+type UserResponse struct {
+	User User `json:"user"`
 }
 
 type CreateUserRequest struct {
 	Name string `json:"name"`
 }
 
-func (u *UserClient) Create(ctx context.Context, name string) (*User, error) {
-	user := &User{}
+func (u *UserClient) Create(ctx context.Context, name string) (*UserResponse, error) {
+	user := &UserResponse{}
 
 	uri := u.client.buildPath("user")
 	req, err := u.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint:    "CreateUser",
+		contentType: "application/json",
 		body: CreateUserRequest{
 			Name: name,
 		},
@@ -51,7 +57,9 @@ func (u *UserClient) List(ctx context.Context) (*UsersResponse, error) {
 	users := &UsersResponse{}
 
 	uri := u.client.buildPath("user")
-	req, err := u.client.buildRequest(ctx, http.MethodPost, uri, request{})
+	req, err := u.client.buildRequest(ctx, http.MethodGet, uri, request{
+		endpoint: "ListUsers",
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -61,3 +69,32 @@ func (u *UserClient) List(ctx context.Context) (*UsersResponse, error) {
 	}
 	return users, nil
 }
+
+func (u *UserClient) Rename(ctx context.Context, oldName string, newName string) (*UserResponse, error) {
+	user := &UserResponse{}
+
+	uri := u.client.buildPath("user", oldName, "rename", newName)
+	req, err := u.client.buildRequest(ctx, http.MethodPost, uri, request{
+		endpoint: "RenameUser",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.client.do(ctx, req, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Delete removes a user, Headscale refuses to delete users owning nodes
+func (u *UserClient) Delete(ctx context.Context, name string) error {
+	uri := u.client.buildPath("user", name)
+	req, err := u.client.buildRequest(ctx, http.MethodDelete, uri, request{
+		endpoint: "DeleteUser",
+	})
+	if err != nil {
+		return err
+	}
+	return u.client.do(ctx, req, nil)
+}
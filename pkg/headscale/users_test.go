@@ -0,0 +1,41 @@
+package headscale
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserClient(t *testing.T) {
+	ctx := context.Background()
+	user := UserResponse{User: User{ID: "1", Name: "sammm"}}
+
+	t.Run("list", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodGet, "/api/v1/user", "", "", UsersResponse{Users: []User{user.User}}))
+		got, err := c.Users().List(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []User{user.User}, got.Users)
+	})
+
+	t.Run("create", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/user", "", `{"name":"sammm"}`, user))
+		got, err := c.Users().Create(ctx, "sammm")
+		require.NoError(t, err)
+		assert.Equal(t, &user, got)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodPost, "/api/v1/user/sammm/rename/sam", "", "", UserResponse{User: User{ID: "1", Name: "sam"}}))
+		got, err := c.Users().Rename(ctx, "sammm", "sam")
+		require.NoError(t, err)
+		assert.Equal(t, "sam", got.User.Name)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		c := testClient(t, expect(t, http.MethodDelete, "/api/v1/user/sammm", "", "", struct{}{}))
+		assert.NoError(t, c.Users().Delete(ctx, "sammm"))
+	})
+}
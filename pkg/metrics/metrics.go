@@ -0,0 +1,95 @@
+// Package metrics defines the prometheus metrics exported by the injector
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tailscale_sidecar_injector"
+
+// admission outcomes
+const (
+	OutcomeInjected string = "injected"
+	OutcomeSkipped  string = "skipped"
+	OutcomeErrored  string = "errored"
+	// OutcomeFailedOpen is a pod admitted without a sidecar
+	OutcomeFailedOpen string = "failed_open"
+	// OutcomeDeferred is a sidecar waiting for its pre-auth key
+	OutcomeDeferred string = "deferred"
+)
+
+var (
+	// AdmissionRequests counts admission reviews by outcome
+	AdmissionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_requests_total",
+		Help:      "Admission reviews handled, by outcome.",
+	}, []string{"outcome"})
+
+	// MutationDuration observes how long mutating a pod took
+	MutationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mutation_duration_seconds",
+		Help:      "Time taken to mutate a pod, by outcome.",
+		// the webhook times out after a few seconds
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2, 5, 10},
+	}, []string{"outcome"})
+
+	// HeadscaleRequests counts calls to the Headscale API
+	HeadscaleRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "headscale_requests_total",
+		Help:      "Requests made to the Headscale API, by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+
+	// HeadscaleRequestDuration observes the latency of the Headscale API
+	HeadscaleRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "headscale_request_duration_seconds",
+		Help:      "Latency of requests made to the Headscale API, by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	// KeyPoolRequests counts pre-auth keys asked of the key pool, by whether
+	// a pooled key was handed out
+	KeyPoolRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "key_pool_requests_total",
+		Help:      "Pre-auth keys asked of the key pool, by result (hit or miss).",
+	}, []string{"result"})
+
+	// KeyPoolReady is the number of pooled pre-auth keys ready to be handed out
+	KeyPoolReady = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "key_pool_ready_keys",
+		Help:      "Pre-minted pre-auth keys ready to be handed out.",
+	})
+)
+
+// ObserveAdmission records the outcome and duration of an admission review
+func ObserveAdmission(outcome string, d time.Duration) {
+	AdmissionRequests.WithLabelValues(outcome).Inc()
+	MutationDuration.WithLabelValues(outcome).Observe(d.Seconds())
+}
+
+// ObserveHeadscaleRequest records a call to the Headscale API, code is 0
+// when no response was received
+func ObserveHeadscaleRequest(endpoint string, code int, d time.Duration) {
+	c := "error"
+	if code != 0 {
+		c = strconv.Itoa(code)
+	}
+	HeadscaleRequests.WithLabelValues(endpoint, c).Inc()
+	HeadscaleRequestDuration.WithLabelValues(endpoint).Observe(d.Seconds())
+}
+
+// Handler serves the metrics in the prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
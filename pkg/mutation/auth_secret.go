@@ -0,0 +1,318 @@
+package mutation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// AuthKeySecretKey is the key within the auth key secret holding the pre-auth key
+	AuthKeySecretKey string = "authkey"
+	// AuthKeyExpiryAnnotation records when the pre-auth key held by a secret expires
+	AuthKeyExpiryAnnotation string = "tailscale.iced.cool/auth-key-expiry"
+	// DeferredKeyAnnotation holds the request of a key still to be minted
+	DeferredKeyAnnotation string = "tailscale.iced.cool/deferred-auth-key"
+	// DeferredLabel marks secrets whose key has not been minted yet
+	DeferredLabel         string = "tailscale.iced.cool/auth-key-deferred"
+	ManagedByLabel        string = "app.kubernetes.io/managed-by"
+	ManagedByValue        string = "tailscale-sidecar-injector"
+	authKeySecretSuffix   string = "-tailscale-authkey"
+	defaultServiceAccount string = "default"
+	// maxNameLength is the longest name accepted for a secret
+	maxNameLength int = 253
+)
+
+var (
+	ErrClientNil        error = fmt.Errorf("kubernetes client not configured: cannot store pre-auth key")
+	ErrSecretNotManaged error = fmt.Errorf("secret not managed by the injector")
+)
+
+var (
+	// managedSecretSelector matches every secret created by the injector
+	managedSecretSelector = labels.SelectorFromSet(labels.Set{ManagedByLabel: ManagedByValue}).String()
+	// deferredSecretSelector matches secrets waiting for their key
+	deferredSecretSelector = labels.SelectorFromSet(labels.Set{ManagedByLabel: ManagedByValue, DeferredLabel: "true"}).String()
+)
+
+// deferredKey is stored on deferred secrets so the key can be minted later
+type deferredKey struct {
+	Request AuthKeyRequest  `json:"request"`
+	TTL     metav1.Duration `json:"ttl"`
+}
+
+// authKeySecret builds the secret holding the pre-auth key for a pod.
+// Pods with a name get a predictable secret name, pods relying on
+// generateName (e.g. from a ReplicaSet) get a generated one as their
+// name is not known at admission time
+func authKeySecret(pod *corev1.Pod, key string, expiry time.Time) *corev1.Secret {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByValue,
+			},
+			Annotations: map[string]string{
+				AuthKeyExpiryAnnotation: expiry.UTC().Format(time.RFC3339),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		StringData: map[string]string{
+			AuthKeySecretKey: key,
+		},
+	}
+
+	if pod.Name != "" {
+		s.Name = truncate(pod.Name, maxNameLength-len(authKeySecretSuffix)) + authKeySecretSuffix
+	} else {
+		s.GenerateName = truncate(pod.GenerateName+"tailscale-authkey-", maxNameLength-5)
+	}
+
+	return s
+}
+
+// deferredAuthKeySecret builds a secret without a key, recording the request
+// so the key can be minted once the control server is reachable again
+func deferredAuthKeySecret(pod *corev1.Pod, req AuthKeyRequest, ttl time.Duration) (*corev1.Secret, error) {
+	req.Expiration = time.Time{}
+	raw, err := json.Marshal(deferredKey{Request: req, TTL: metav1.Duration{Duration: ttl}})
+	if err != nil {
+		return nil, err
+	}
+
+	s := authKeySecret(pod, "", time.Time{})
+	s.StringData = nil
+	s.Labels[DeferredLabel] = "true"
+	s.Annotations = map[string]string{
+		DeferredKeyAnnotation: string(raw),
+	}
+	return s, nil
+}
+
+// ensureAuthKeySecret creates (or updates) the secret holding the pod's
+// pre-auth key and returns its name. The secret is owned by the pod's
+// service account so it never outlives the identity it was minted for.
+// Secrets of the name the injector did not create are left alone
+func ensureAuthKeySecret(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod, secret *corev1.Secret) (string, error) {
+	if client == nil {
+		return "", ErrClientNil
+	}
+
+	owner, err := serviceAccountOwner(ctx, client, pod)
+	if err != nil {
+		return "", err
+	}
+	secret.OwnerReferences = []metav1.OwnerReference{*owner}
+
+	secrets := client.CoreV1().Secrets(pod.Namespace)
+	created, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if err == nil {
+		return created.Name, nil
+	}
+	if !apierrors.IsAlreadyExists(err) || secret.Name == "" {
+		return "", fmt.Errorf("could not create secret for pre-auth key: %w", err)
+	}
+
+	existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get secret %s/%s: %w", pod.Namespace, secret.Name, err)
+	}
+	if existing.Labels[ManagedByLabel] != ManagedByValue {
+		return "", fmt.Errorf("%w: %s/%s exists", ErrSecretNotManaged, pod.Namespace, secret.Name)
+	}
+	existing.Labels = secret.Labels
+	existing.Annotations = secret.Annotations
+	existing.OwnerReferences = secret.OwnerReferences
+	existing.StringData = secret.StringData
+	existing.Data = nil
+
+	updated, err := secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not update secret %s/%s: %w", pod.Namespace, secret.Name, err)
+	}
+	return updated.Name, nil
+}
+
+// serviceAccountOwner returns a reference to the service account of a pod,
+// owning the objects created for it
+func serviceAccountOwner(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod) (*metav1.OwnerReference, error) {
+	saName := pod.Spec.ServiceAccountName
+	if saName == "" {
+		saName = defaultServiceAccount
+	}
+
+	sa, err := client.CoreV1().ServiceAccounts(pod.Namespace).Get(ctx, saName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get service account %s/%s: %w", pod.Namespace, saName, err)
+	}
+
+	return &metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ServiceAccount",
+		Name:       sa.Name,
+		UID:        sa.UID,
+	}, nil
+}
+
+// CleanupAuthKeySecrets removes every pre-auth key created by the injector
+// which has expired. Sidecars reference regular secrets as optional so they
+// are deleted, a restarting sidecar relies on the state kept in
+// TS_KUBE_SECRET instead. Deferred secrets are required by their sidecar so
+// only the key is blanked while a pod refers to them, they are deleted once
+// none does
+func CleanupAuthKeySecrets(ctx context.Context, client kubernetes.Interface, now time.Time) (int, error) {
+	list, err := client.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: managedSecretSelector,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// deferred secrets referred to by pods, by namespace
+	referenced := map[string]map[string]bool{}
+	cleaned := 0
+	for _, s := range list.Items {
+		v, ok := s.Annotations[AuthKeyExpiryAnnotation]
+		if !ok {
+			continue
+		}
+		expiry, err := time.Parse(time.RFC3339, v)
+		if err != nil || expiry.After(now) {
+			continue
+		}
+
+		if _, deferred := s.Annotations[DeferredKeyAnnotation]; deferred {
+			if _, ok := referenced[s.Namespace]; !ok {
+				if referenced[s.Namespace], err = deferredSecretsInUse(ctx, client, s.Namespace); err != nil {
+					return cleaned, err
+				}
+			}
+			if referenced[s.Namespace][s.Name] {
+				if len(s.Data[AuthKeySecretKey]) == 0 {
+					continue
+				}
+				s.Data = map[string][]byte{AuthKeySecretKey: {}}
+				_, err = client.CoreV1().Secrets(s.Namespace).Update(ctx, &s, metav1.UpdateOptions{})
+			} else {
+				err = client.CoreV1().Secrets(s.Namespace).Delete(ctx, s.Name, metav1.DeleteOptions{})
+			}
+		} else {
+			err = client.CoreV1().Secrets(s.Namespace).Delete(ctx, s.Name, metav1.DeleteOptions{})
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return cleaned, err
+		}
+		cleaned++
+	}
+
+	return cleaned, nil
+}
+
+// deferredSecretsInUse returns the deferred secrets the pods of a namespace
+// refer to
+func deferredSecretsInUse(ctx context.Context, client kubernetes.Interface, namespace string) (map[string]bool, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list pods of namespace %s: %w", namespace, err)
+	}
+	names := map[string]bool{}
+	for _, pod := range pods.Items {
+		if name, ok := pod.Annotations[AuthKeySecretAnnotation]; ok {
+			names[name] = true
+		}
+	}
+	return names, nil
+}
+
+// FillDeferredAuthKeySecrets mints the keys of deferred secrets. Secrets
+// whose key still cannot be minted are retried on the next call
+func FillDeferredAuthKeySecrets(ctx context.Context, client kubernetes.Interface, provider AuthKeyProvider, now time.Time) (int, error) {
+	list, err := client.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: deferredSecretSelector,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	filled := 0
+	for _, s := range list.Items {
+		var d deferredKey
+		if err := json.Unmarshal([]byte(s.Annotations[DeferredKeyAnnotation]), &d); err != nil {
+			errs = append(errs, fmt.Errorf("secret %s/%s: %w", s.Namespace, s.Name, err))
+			continue
+		}
+
+		d.Request.Expiration = now.Add(d.TTL.Duration)
+		key, err := provider.AuthKey(ctx, d.Request)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("secret %s/%s: %w", s.Namespace, s.Name, err))
+			continue
+		}
+		if key.SecretRef != nil {
+			errs = append(errs, fmt.Errorf("secret %s/%s: %s provider does not mint keys", s.Namespace, s.Name, provider.Name()))
+			continue
+		}
+
+		delete(s.Labels, DeferredLabel)
+		s.Annotations[AuthKeyExpiryAnnotation] = key.Expiration.UTC().Format(time.RFC3339)
+		// the controller cleans up the node of the pod by its key
+		s.Annotations[AuthKeyIDAnnotation] = key.ID
+		s.Annotations[AuthKeyUserAnnotation] = d.Request.User
+		s.Data = map[string][]byte{AuthKeySecretKey: []byte(key.Key)}
+		if _, err := client.CoreV1().Secrets(s.Namespace).Update(ctx, &s, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("secret %s/%s: %w", s.Namespace, s.Name, err))
+			continue
+		}
+		filled++
+	}
+
+	return filled, errors.Join(errs...)
+}
+
+// RunAuthKeySecretReconciler fills deferred secrets and cleans up expired
+// keys every interval until the context is cancelled
+func RunAuthKeySecretReconciler(ctx context.Context, logger logrus.FieldLogger, client kubernetes.Interface, provider AuthKeyProvider, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := FillDeferredAuthKeySecrets(ctx, client, provider, now)
+			if err != nil {
+				logger.Errorf("could not fill deferred pre-auth key secrets: %v", err)
+			}
+			if n > 0 {
+				logger.Infof("minted %d deferred pre-auth keys", n)
+			}
+
+			n, err = CleanupAuthKeySecrets(ctx, client, now)
+			if err != nil {
+				logger.Errorf("could not clean up pre-auth key secrets: %v", err)
+				continue
+			}
+			if n > 0 {
+				logger.Infof("cleaned up %d expired pre-auth key secrets", n)
+			}
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
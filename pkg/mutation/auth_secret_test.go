@@ -0,0 +1,213 @@
+package mutation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testServiceAccount() *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "default",
+			Namespace: "apps",
+			UID:       "sa-uid",
+		},
+	}
+}
+
+func TestEnsureAuthKeySecret(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(testServiceAccount())
+	expiry := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps"}}
+
+	name, err := ensureAuthKeySecret(ctx, client, pod, authKeySecret(pod, "first", expiry))
+	require.NoError(t, err)
+	assert.Equal(t, "web-tailscale-authkey", name)
+
+	// a second admission for the same pod updates the key in place
+	name, err = ensureAuthKeySecret(ctx, client, pod, authKeySecret(pod, "second", expiry))
+	require.NoError(t, err)
+	assert.Equal(t, "web-tailscale-authkey", name)
+
+	got, err := client.CoreV1().Secrets("apps").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "second", got.StringData[AuthKeySecretKey])
+	assert.Equal(t, ManagedByValue, got.Labels[ManagedByLabel])
+	assert.Equal(t, "2025-01-01T00:00:00Z", got.Annotations[AuthKeyExpiryAnnotation])
+	require.Len(t, got.OwnerReferences, 1)
+	assert.Equal(t, "ServiceAccount", got.OwnerReferences[0].Kind)
+	assert.EqualValues(t, "sa-uid", got.OwnerReferences[0].UID)
+}
+
+func TestEnsureAuthKeySecretNotManaged(t *testing.T) {
+	ctx := context.Background()
+	theirs := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-tailscale-authkey", Namespace: "apps"},
+		Data:       map[string][]byte{"password": []byte("hunter2")},
+	}
+	client := fake.NewSimpleClientset(testServiceAccount(), theirs)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps"}}
+
+	_, err := ensureAuthKeySecret(ctx, client, pod, authKeySecret(pod, "key", time.Now()))
+	assert.ErrorIs(t, err, ErrSecretNotManaged)
+
+	got, err := client.CoreV1().Secrets("apps").Get(ctx, theirs.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, theirs, got, "secrets the injector did not create are left alone")
+}
+
+func TestMutateExpiresUnstoredKey(t *testing.T) {
+	client := fake.NewSimpleClientset(testServiceAccount())
+	client.PrependReactor("create", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("etcd unavailable")
+	})
+	provider := &mintingProvider{}
+	si := sidecarInjector{Logger: logrus.New(), Client: client, Provider: provider}
+
+	_, err := si.Mutate(context.Background(), servePod(nil))
+	require.Error(t, err)
+	assert.Equal(t, 1, provider.minted)
+	assert.Equal(t, []string{"1"}, provider.expired, "keys which could not be stored are expired")
+}
+
+func TestEnsureAuthKeySecretGenerateName(t *testing.T) {
+	client := fake.NewSimpleClientset(testServiceAccount())
+	// the fake clientset does not implement generateName
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		s := action.(k8stesting.CreateAction).GetObject().(*corev1.Secret)
+		if s.Name == "" {
+			s.Name = s.GenerateName + "abcde"
+		}
+		return false, nil, nil
+	})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "web-5d8f9-", Namespace: "apps"}}
+
+	name, err := ensureAuthKeySecret(context.Background(), client, pod, authKeySecret(pod, "key", time.Now()))
+	require.NoError(t, err)
+	assert.Equal(t, "web-5d8f9-tailscale-authkey-abcde", name)
+}
+
+func TestEnsureAuthKeySecretNoClient(t *testing.T) {
+	_, err := ensureAuthKeySecret(context.Background(), nil, &corev1.Pod{}, &corev1.Secret{})
+	assert.ErrorIs(t, err, ErrClientNil)
+}
+
+func TestCleanupAuthKeySecrets(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	secret := func(name string, expiry time.Time) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "apps",
+			Labels:      map[string]string{ManagedByLabel: ManagedByValue},
+			Annotations: map[string]string{AuthKeyExpiryAnnotation: expiry.Format(time.RFC3339)},
+		}}
+	}
+	unmanaged := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "unmanaged", Namespace: "apps"}}
+
+	client := fake.NewSimpleClientset(
+		secret("expired", now.Add(-time.Minute)),
+		secret("valid", now.Add(time.Minute)),
+		unmanaged,
+	)
+
+	n, err := CleanupAuthKeySecrets(context.Background(), client, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	list, err := client.CoreV1().Secrets("apps").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	var names []string
+	for _, s := range list.Items {
+		names = append(names, s.Name)
+	}
+	assert.ElementsMatch(t, []string{"valid", "unmanaged"}, names)
+}
+
+// fakeProvider hands out key, or fails with err
+type fakeProvider struct {
+	key *AuthKey
+	err error
+	req AuthKeyRequest
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) AuthKey(_ context.Context, req AuthKeyRequest) (*AuthKey, error) {
+	p.req = req
+	return p.key, p.err
+}
+
+func TestDeferredAuthKeySecrets(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := fake.NewSimpleClientset(testServiceAccount())
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps"}}
+
+	secret, err := deferredAuthKeySecret(pod, AuthKeyRequest{User: "sammm", Tags: []string{"tag:pod"}, Ephemeral: true}, time.Minute)
+	require.NoError(t, err)
+	name, err := ensureAuthKeySecret(ctx, client, pod, secret)
+	require.NoError(t, err)
+	pod.Annotations = map[string]string{AuthKeySecretAnnotation: name}
+	_, err = client.CoreV1().Pods("apps").Create(ctx, pod, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// the control server is still unreachable
+	provider := &fakeProvider{err: errors.New("unreachable")}
+	n, err := FillDeferredAuthKeySecrets(ctx, client, provider, now)
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	provider = &fakeProvider{key: &AuthKey{ID: "7", Key: "minted", Expiration: now.Add(time.Minute)}}
+	n, err = FillDeferredAuthKeySecrets(ctx, client, provider, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, AuthKeyRequest{User: "sammm", Tags: []string{"tag:pod"}, Ephemeral: true, Expiration: now.Add(time.Minute)}, provider.req)
+
+	got, err := client.CoreV1().Secrets("apps").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "minted", string(got.Data[AuthKeySecretKey]))
+	assert.NotContains(t, got.Labels, DeferredLabel)
+	assert.Equal(t, "7", got.Annotations[AuthKeyIDAnnotation], "the controller finds the node by its key")
+	assert.Equal(t, "sammm", got.Annotations[AuthKeyUserAnnotation])
+
+	// filled secrets are left alone
+	n, err = FillDeferredAuthKeySecrets(ctx, client, provider, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// the sidecar of the pod requires the secret so only the key is removed
+	n, err = CleanupAuthKeySecrets(ctx, client, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	got, err = client.CoreV1().Secrets("apps").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, got.Data[AuthKeySecretKey])
+
+	n, err = CleanupAuthKeySecrets(ctx, client, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "spent secrets are kept while the pod is around")
+
+	// and deleted once it is gone
+	require.NoError(t, client.CoreV1().Pods("apps").Delete(ctx, "web", metav1.DeleteOptions{}))
+	n, err = CleanupAuthKeySecrets(ctx, client, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = client.CoreV1().Secrets("apps").Get(ctx, name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
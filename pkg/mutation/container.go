@@ -0,0 +1,106 @@
+package mutation
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// CPURequestAnnotation, CPULimitAnnotation, MemoryRequestAnnotation and
+	// MemoryLimitAnnotation override the resources of the sidecar
+	CPURequestAnnotation    string = "tailscale.iced.cool/cpu-request"
+	CPULimitAnnotation      string = "tailscale.iced.cool/cpu-limit"
+	MemoryRequestAnnotation string = "tailscale.iced.cool/memory-request"
+	MemoryLimitAnnotation   string = "tailscale.iced.cool/memory-limit"
+
+	LocalAddrPortKey     string = "TS_LOCAL_ADDR_PORT"
+	EnableHealthCheckKey string = "TS_ENABLE_HEALTH_CHECK"
+
+	// tailscaleSocket is where containerboot runs the tailscaled socket
+	tailscaleSocket    string = "/tmp/tailscaled.sock"
+	startupProbePeriod int32  = 2
+)
+
+var ErrInvalidResources error = fmt.Errorf("invalid resources")
+
+// applyResourceAnnotations overrides the resources of the sidecar with the
+// annotations of the pod
+func (c *config) applyResourceAnnotations(pod corev1.Pod) error {
+	for _, a := range []struct {
+		annotation string
+		list       *corev1.ResourceList
+		name       corev1.ResourceName
+	}{
+		{CPURequestAnnotation, &c.resources.Requests, corev1.ResourceCPU},
+		{CPULimitAnnotation, &c.resources.Limits, corev1.ResourceCPU},
+		{MemoryRequestAnnotation, &c.resources.Requests, corev1.ResourceMemory},
+		{MemoryLimitAnnotation, &c.resources.Limits, corev1.ResourceMemory},
+	} {
+		v, ok := pod.Annotations[a.annotation]
+		if !ok {
+			continue
+		}
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidResources, a.annotation, err)
+		}
+		if *a.list == nil {
+			*a.list = corev1.ResourceList{}
+		}
+		(*a.list)[a.name] = q
+	}
+
+	for name, limit := range c.resources.Limits {
+		if request, ok := c.resources.Requests[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("%w: %s request %s exceeds its limit %s", ErrInvalidResources, name, request.String(), limit.String())
+		}
+	}
+	return nil
+}
+
+// healthEnv serves /healthz on the local endpoint of tailscaled
+func (c *config) healthEnv() []corev1.EnvVar {
+	if c.healthPort == 0 {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{Name: LocalAddrPortKey, Value: fmt.Sprintf("[::]:%d", c.healthPort)},
+		{Name: EnableHealthCheckKey, Value: "true"},
+	}
+}
+
+// startupProbe passes once the node has joined the tailnet. The sidecar
+// starts before the app containers, which wait for it
+func (c *config) startupProbe() *corev1.Probe {
+	if c.healthPort == 0 {
+		return nil
+	}
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/healthz",
+				Port: intstr.FromInt32(c.healthPort),
+			},
+		},
+		PeriodSeconds:    startupProbePeriod,
+		FailureThreshold: max(1, int32(c.startupTimeout.Seconds())/startupProbePeriod),
+	}
+}
+
+// lifecycle logs ephemeral nodes out when the pod stops so they leave the
+// tailnet right away, other nodes keep their identity
+func (c *config) lifecycle() *corev1.Lifecycle {
+	if _, ephemeral := keySemantics(c.nodeMode); !ephemeral {
+		return nil
+	}
+	return &corev1.Lifecycle{
+		PreStop: &corev1.LifecycleHandler{
+			Exec: &corev1.ExecAction{
+				Command: []string{"tailscale", "--socket=" + tailscaleSocket, "logout"},
+			},
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package mutation
+
+import (
+	"context"
+	"testing"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBuildConfigResources(t *testing.T) {
+	si := sidecarInjector{}
+
+	c, err := si.buildConfig(*proxyPod(nil))
+	require.NoError(t, err)
+	assert.Equal(t, injectorconfig.Default().Resources, c.resources)
+
+	c, err = si.buildConfig(*proxyPod(map[string]string{
+		CPULimitAnnotation:    "100m",
+		MemoryLimitAnnotation: "256Mi",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, resource.MustParse("10m"), c.resources.Requests[corev1.ResourceCPU], "annotations override single values")
+	assert.Equal(t, resource.MustParse("100m"), c.resources.Limits[corev1.ResourceCPU])
+	assert.Equal(t, resource.MustParse("256Mi"), c.resources.Limits[corev1.ResourceMemory])
+
+	for _, annotations := range []map[string]string{
+		{CPURequestAnnotation: "lots"},
+		{MemoryRequestAnnotation: "1Gi"},
+		{CPURequestAnnotation: "1", CPULimitAnnotation: "500m"},
+	} {
+		_, err := si.buildConfig(*proxyPod(annotations))
+		assert.ErrorIs(t, err, ErrInvalidResources, annotations)
+	}
+}
+
+func TestMutateProbesAndLifecycle(t *testing.T) {
+	ctx := context.Background()
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   fake.NewSimpleClientset(testServiceAccount()),
+		Provider: &fakeProvider{key: &AuthKey{Key: "key"}},
+	}
+
+	got, err := si.Mutate(ctx, proxyPod(nil))
+	require.NoError(t, err)
+
+	sidecar := got.Spec.InitContainers[0]
+	assert.Equal(t, "[::]:9002", env(sidecar)[LocalAddrPortKey])
+	assert.Equal(t, "true", env(sidecar)[EnableHealthCheckKey])
+	require.NotNil(t, sidecar.StartupProbe)
+	assert.Equal(t, "/healthz", sidecar.StartupProbe.HTTPGet.Path)
+	assert.Equal(t, intstr.FromInt32(9002), sidecar.StartupProbe.HTTPGet.Port)
+	assert.Equal(t, int32(60), sidecar.StartupProbe.FailureThreshold)
+	require.NotNil(t, sidecar.Lifecycle)
+	assert.Equal(t, []string{"tailscale", "--socket=/tmp/tailscaled.sock", "logout"}, sidecar.Lifecycle.PreStop.Exec.Command)
+
+	// persistent nodes keep their identity
+	pod := statefulSetPod("db-0", map[string]string{InjectLabel: "true"})
+	pod.Annotations = map[string]string{NodeModeAnnotation: "persistent"}
+	got, err = si.Mutate(ctx, pod)
+	require.NoError(t, err)
+	assert.Nil(t, got.Spec.InitContainers[0].Lifecycle)
+
+	settings := injectorconfig.Default()
+	settings.HealthCheck.Enabled = false
+	si.Settings = settings
+	got, err = si.Mutate(ctx, proxyPod(nil))
+	require.NoError(t, err)
+	assert.Nil(t, got.Spec.InitContainers[0].StartupProbe)
+	assert.NotContains(t, env(got.Spec.InitContainers[0]), LocalAddrPortKey)
+}
@@ -0,0 +1,145 @@
+package mutation
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+const (
+	// HostnameAnnotation is a template of the Tailscale hostname of the
+	// pod, e.g. {{.Namespace}}-{{.OwnerName}}-{{.Ordinal}}
+	HostnameAnnotation string = "tailscale.iced.cool/hostname"
+	// maxHostnameLength is the longest DNS label
+	maxHostnameLength int = 63
+	suffixLength      int = 5
+)
+
+var ErrInvalidHostname error = fmt.Errorf("invalid hostname template")
+
+// hostnameData is what hostname templates are rendered with
+type hostnameData struct {
+	Namespace string
+	// Name of the pod, empty for pods named by generateName
+	Name string
+	// OwnerKind and OwnerName are the workload of the pod, the Deployment
+	// rather than the ReplicaSet of its pods. Pods without an owner are
+	// their own owner
+	OwnerKind string
+	OwnerName string
+	// Ordinal is the StatefulSet ordinal of the pod, empty otherwise
+	Ordinal string
+	// Suffix tells apart pods of the same workload, the ordinal of
+	// StatefulSet pods or else a random string
+	Suffix string
+}
+
+// newHostnameData describes a pod for hostname templates
+func newHostnameData(pod *corev1.Pod) hostnameData {
+	d := hostnameData{
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		OwnerKind: "Pod",
+		OwnerName: pod.Name,
+		Suffix:    utilrand.String(suffixLength),
+	}
+	if d.OwnerName == "" {
+		d.OwnerName = strings.TrimRight(pod.GenerateName, "-")
+	}
+
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return d
+	}
+	d.OwnerKind, d.OwnerName = owner.Kind, owner.Name
+
+	switch owner.Kind {
+	case "ReplicaSet":
+		// ReplicaSets of a Deployment are named after it and the template
+		// hash their pods are labelled with
+		if hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; hash != "" {
+			if name, ok := strings.CutSuffix(owner.Name, "-"+hash); ok {
+				d.OwnerKind, d.OwnerName = "Deployment", name
+			}
+		}
+	case "StatefulSet":
+		if m, err := statefulSetMemberOf(pod); err == nil {
+			d.Ordinal = strconv.Itoa(m.ordinal)
+			d.Suffix = d.Ordinal
+		}
+	}
+	return d
+}
+
+// renderHostname renders the hostname template of a pod as a DNS label.
+// Templates which would give every pod of a workload the same hostname,
+// once truncated, get the suffix of the pod appended
+func renderHostname(tmpl string, d hostnameData) (string, error) {
+	t, err := template.New("hostname").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidHostname, err)
+	}
+
+	render := func(d hostnameData) (string, error) {
+		var b bytes.Buffer
+		if err := t.Execute(&b, d); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidHostname, err)
+		}
+		return strings.TrimRight(truncate(sanitizeHostname(b.String()), maxHostnameLength), "-"), nil
+	}
+
+	hostname, err := render(d)
+	if err != nil {
+		return "", err
+	}
+	if hostname == "" {
+		return "", fmt.Errorf("%w: %q renders to an empty hostname", ErrInvalidHostname, tmpl)
+	}
+
+	// render the template for a sibling of the pod to see if it tells them
+	// apart, pods named by generateName all have an empty name
+	sibling := d
+	if sibling.Name != "" {
+		sibling.Name += "-sibling"
+	}
+	if sibling.Ordinal != "" {
+		sibling.Ordinal += "1"
+	}
+	sibling.Suffix += "x"
+	other, err := render(sibling)
+	if err != nil {
+		return "", err
+	}
+	if other == hostname {
+		suffix := sanitizeHostname(d.Suffix)
+		hostname = strings.TrimRight(truncate(hostname, maxHostnameLength-len(suffix)-1), "-") + "-" + suffix
+	}
+
+	return hostname, nil
+}
+
+// sanitizeHostname lowercases s and replaces every character not allowed
+// in a DNS label with a dash
+func sanitizeHostname(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
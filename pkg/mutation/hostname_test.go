@@ -0,0 +1,85 @@
+package mutation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestNewHostnameData(t *testing.T) {
+	deployment := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		GenerateName: "web-7d4b9c-",
+		Namespace:    "apps",
+		Labels:       map[string]string{"pod-template-hash": "7d4b9c"},
+		OwnerReferences: []metav1.OwnerReference{{
+			Kind: "ReplicaSet", Name: "web-7d4b9c", Controller: ptr.To(true),
+		}},
+	}}
+	d := newHostnameData(deployment)
+	assert.Equal(t, "Deployment", d.OwnerKind)
+	assert.Equal(t, "web", d.OwnerName)
+	assert.Empty(t, d.Ordinal)
+	assert.Len(t, d.Suffix, suffixLength)
+
+	d = newHostnameData(statefulSetPod("db-2", nil))
+	assert.Equal(t, "StatefulSet", d.OwnerKind)
+	assert.Equal(t, "db", d.OwnerName)
+	assert.Equal(t, "2", d.Ordinal)
+	assert.Equal(t, "2", d.Suffix)
+
+	d = newHostnameData(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "debug"}})
+	assert.Equal(t, "Pod", d.OwnerKind)
+	assert.Equal(t, "debug", d.OwnerName)
+}
+
+func TestRenderHostname(t *testing.T) {
+	sts := hostnameData{Namespace: "apps", Name: "db-2", OwnerKind: "StatefulSet", OwnerName: "db", Ordinal: "2", Suffix: "2"}
+	deploy := hostnameData{Namespace: "apps", OwnerKind: "Deployment", OwnerName: "web", Suffix: "x7k2p"}
+
+	tests := map[string]struct {
+		tmpl string
+		data hostnameData
+		want string
+	}{
+		"statefulset":            {"{{.Namespace}}-{{.OwnerName}}-{{.Ordinal}}", sts, "apps-db-2"},
+		"deployment gets suffix": {"{{.Namespace}}-{{.OwnerName}}", deploy, "apps-web-x7k2p"},
+		"empty ordinal":          {"{{.Namespace}}-{{.OwnerName}}-{{.Ordinal}}", deploy, "apps-web-x7k2p"},
+		"explicit suffix":        {"{{.OwnerName}}.{{.Suffix}}", deploy, "web-x7k2p"},
+		"sanitised":              {"Team_A/{{.OwnerName}}--{{.Ordinal}}", sts, "team-a-db-2"},
+		"truncated":              {strings.Repeat("a", 70) + "-{{.Ordinal}}", sts, strings.Repeat("a", 61) + "-2"},
+		"long names keep suffix": {strings.Repeat("b", 70), deploy, strings.Repeat("b", 57) + "-x7k2p"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := renderHostname(tt.tmpl, tt.data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	for _, tmpl := range []string{"{{.Namespace", "{{.Missing}}", "{{.Ordinal}}--"} {
+		_, err := renderHostname(tmpl, deploy)
+		assert.ErrorIs(t, err, ErrInvalidHostname, tmpl)
+	}
+}
+
+func TestBuildConfigHostname(t *testing.T) {
+	si := sidecarInjector{Logger: logrus.New()}
+	pod := statefulSetPod("db-1", nil)
+	pod.Annotations = map[string]string{HostnameAnnotation: "{{.Namespace}}-{{.OwnerName}}-{{.Ordinal}}"}
+
+	c, err := si.buildConfig(*pod)
+	require.NoError(t, err)
+	assert.Equal(t, "apps-db-1", c.hostname)
+
+	sc, err := buildSidecarContainer(c)
+	require.NoError(t, err)
+	assert.Contains(t, sc.Env, corev1.EnvVar{Name: HostnameKey, Value: "apps-db-1"})
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/utils/ptr"
 )
 
@@ -18,41 +23,107 @@ const (
 	UserspaceKey  string = "TS_USERSPACE"
 	PreAuthKeyKey string = "TS_AUTHKEY"
 	TSExtraArgs   string = "TS_EXTRA_ARGS"
+	HostnameKey   string = "TS_HOSTNAME"
 	// custom
 	LoginServer string = "LOGIN_SERVER"
 	APIKey      string = "API_KEY"
 )
 
 const (
+	// InjectLabel opts pods in or out of injection with "true" or "false",
+	// and every pod of a namespace with "enabled" or "disabled"
 	InjectLabel               string = "tailscale-inject"
 	LoginServerAnnotation     string = "tailscale.iced.cool/login-server"
 	SecretNameAnnotation      string = "tailscale.iced.cool/sercret-name"
 	EnableUserspaceAnnotation string = "tailscale.iced.cool/userspace-enabled"
 	// UserNameAnnotation defines which user to assume when creating pre-auth keys
 	UserNameAnnotation string = "tailscale.iced.cool/user"
-)
-
-const (
-	ImageName         = "ghcr.io/tailscale/tailscale"
-	ImageTag          = "latest"
-	Image             = ImageName + ":" + ImageTag
-	defaultSecretName = "tailscale-auth"
+	// TagsAnnotation asks for ACL tags on top of the default ones, comma
+	// separated. Each must be allowed for the namespace by the config
+	TagsAnnotation string = "tailscale.iced.cool/tags"
+	// FailurePolicyAnnotation defines what happens when no pre-auth key can
+	// be minted, one of fail-closed, fail-open or defer
+	FailurePolicyAnnotation string = "tailscale.iced.cool/failure-policy"
+	// InjectionErrorAnnotation records why a pod was admitted without a sidecar
+	InjectionErrorAnnotation string = "tailscale.iced.cool/injection-error"
+	// AuthKeyIDAnnotation and AuthKeyUserAnnotation record the Headscale
+	// pre-auth key minted for the pod
+	AuthKeyIDAnnotation   string = "tailscale.iced.cool/auth-key-id"
+	AuthKeyUserAnnotation string = "tailscale.iced.cool/auth-key-user"
+	// AuthKeySecretAnnotation names the secret the deferred pre-auth key of
+	// the pod is minted into, the key ID is recorded on the secret
+	AuthKeySecretAnnotation string = "tailscale.iced.cool/auth-key-secret"
+	// NodeIDAnnotation records the Headscale node of the pod once it joined
+	NodeIDAnnotation string = "tailscale.iced.cool/node-id"
+	// CleanupFinalizer holds deleted pods until the controller removed their
+	// node and key from Headscale
+	CleanupFinalizer string = "tailscale.iced.cool/headscale-cleanup"
 )
 
 // sidecarInjector implements the pod mutator interface
 type sidecarInjector struct {
-	Logger logrus.FieldLogger
-	Config config
+	Logger   logrus.FieldLogger
+	Config   config
+	Client   kubernetes.Interface
+	Provider AuthKeyProvider
+	Policies PolicyLister
+	// Namespaces are looked up in the API server when nil
+	Namespaces corelisters.NamespaceLister
+	// WebhookNamespace is never injected
+	WebhookNamespace string
+	// Settings are the cluster-wide defaults, nil means config.Default()
+	Settings *injectorconfig.Config
+	// Report collects warnings for the admission response, it may be nil
+	Report *Result
+	// DryRun skips every write and key mint, the sidecar points at the
+	// objects it would be given
+	DryRun bool
+
+	podSecurity string // level enforced in the namespace of the pod
+	template    bool   // the pod is the template of a workload
 }
 
 type config struct {
-	userspace   bool   // TS_USERSPACE
-	preAuthKey  string // TS_AUTH_KEY
-	secretName  string // TS_KUBE_SECRET
-	loginServer string // TS_LOGIN_SERVER
-	image       string
-	user        string
-	client      headscale.HeadscaleClient
+	userspace         bool   // TS_USERSPACE
+	preAuthKey        string // TS_AUTH_KEY
+	keyTTL            time.Duration
+	keyExpiry         time.Time
+	keyID             string
+	minted            *AuthKey // expired when it cannot be stored
+	keyRequest        AuthKeyRequest
+	createUser        bool
+	keyRef            *corev1.SecretKeySelector // secret holding TS_AUTH_KEY
+	deferredSecret    string                    // secret the key is minted into later
+	secretName        string                    // TS_KUBE_SECRET
+	loginServer       string                    // TS_LOGIN_SERVER
+	serverURL         string                    // control server API
+	image             string
+	user              string
+	tags              []string
+	extraArgs         []string
+	resources         corev1.ResourceRequirements
+	policy            string // TailscaleSidecarPolicy the config is based on
+	provider          AuthKeyProvider
+	failurePolicy     v1alpha1.FailurePolicy
+	nodeMode          v1alpha1.NodeMode
+	hostname          string // TS_HOSTNAME
+	hostnameTemplate  string
+	member            *statefulSetMember // set for persistent nodes
+	serve             []v1alpha1.ServePort
+	serveConfigMap    string // holds TS_SERVE_CONFIG
+	advertiseRoutes   []string
+	advertiseExit     bool
+	acceptRoutes      bool
+	exitNode          string
+	approveRoutes     bool // enable the routes in Headscale
+	proxyPort         int32
+	noProxy           []string
+	proxyContainers   []string // given the proxy env in userspace
+	podSecurity       string
+	forcedUserspace   bool // tun is not allowed by podSecurity
+	tunDeviceResource string
+	healthPort        int32 // TS_LOCAL_ADDR_PORT, 0 disables the probe
+	startupTimeout    time.Duration
 }
 
 func (c *config) LoginServer() string {
@@ -62,6 +133,9 @@ func (c *config) LoginServer() string {
 var (
 	ErrSecretNameNotProvided error = fmt.Errorf("%s missing: a secret containing the tailscale pre-auth-key must be provided", SecretNameKey)
 	ErrSidecarNil            error = fmt.Errorf("provided sidecar was empty")
+	ErrInvalidFailurePolicy  error = fmt.Errorf("invalid failure policy")
+	ErrTagNotAllowed         error = fmt.Errorf("tag not allowed")
+	ErrLoginServerNotAllowed error = fmt.Errorf("login server not allowed")
 )
 
 func getAnnotation(pod corev1.Pod, key string, defaultValue string) string {
@@ -71,20 +145,166 @@ func getAnnotation(pod corev1.Pod, key string, defaultValue string) string {
 	return defaultValue
 }
 
+// getBoolAnnotation parses a boolean annotation, any other non-empty
+// value counts as true
+func getBoolAnnotation(pod corev1.Pod, key string, defaultValue bool) bool {
+	v, ok := pod.Annotations[key]
+	if !ok {
+		return defaultValue
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return v != ""
+}
+
+// requestedTags returns the tags asked for by the pod on top of the ones it
+// is granted, each must be allowed in its namespace. Tags of policies are
+// granted as only those allowed to create policies in the namespace can
+// set them
+func requestedTags(pod corev1.Pod, settings *injectorconfig.Config, granted []string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(pod.Annotations[TagsAnnotation], ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "tag:")
+		if tag == "" || slices.Contains(granted, tag) || slices.Contains(tags, tag) {
+			continue
+		}
+		if !injectorconfig.ValidTag(tag) {
+			return nil, fmt.Errorf("%s: invalid tag %q", TagsAnnotation, tag)
+		}
+		if !settings.TagAllowed(pod.Namespace, tag) {
+			return nil, fmt.Errorf("%w: pods in namespace %q may not ask for tag:%s", ErrTagNotAllowed, pod.Namespace, tag)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
 func (si sidecarInjector) buildConfig(pod corev1.Pod) (*config, error) {
 	c := &config{}
 
-	c.image = Image
-	c.secretName = getAnnotation(pod, SecretNameAnnotation, defaultSecretName)
-	c.userspace = getAnnotation(pod, EnableUserspaceAnnotation, "") != ""
-	c.loginServer = getAnnotation(pod, LoginServerAnnotation, "")
-	c.user = getAnnotation(pod, UserNameAnnotation, "")
+	settings := si.Settings
+	if settings == nil {
+		settings = injectorconfig.Default()
+	}
+	c.image = settings.ImageRef()
+	c.secretName = settings.SecretName
+	c.tags = settings.Tags(pod.Namespace)
+	c.keyTTL = settings.KeyTTL.Duration
+	c.loginServer = settings.LoginServer
+	c.failurePolicy = settings.FailurePolicy
+	c.createUser = settings.Headscale.CreateUsers
+	c.nodeMode = v1alpha1.Ephemeral
+	c.hostnameTemplate = settings.Hostname
+	c.approveRoutes = settings.Routes.AutoApprove
+	c.proxyPort = settings.Proxy.Port
+	c.podSecurity = si.podSecurity
+	if c.podSecurity == "" {
+		c.podSecurity = settings.PodSecurity.DefaultLevel
+	}
+	c.tunDeviceResource = settings.PodSecurity.TunDeviceResource
+	c.resources = *settings.Resources.DeepCopy()
+	if settings.HealthCheck.Enabled {
+		c.healthPort = settings.HealthCheck.Port
+		c.startupTimeout = settings.HealthCheck.StartupTimeout.Duration
+	}
+	c.noProxy = settings.Proxy.NoProxy
+
+	if si.Policies != nil {
+		policies, err := si.Policies.List(pod.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("could not list policies: %w", err)
+		}
+		p, err := matchPolicy(policies, &pod)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			if err := c.applyPolicy(p, settings, pod.Namespace); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-	hs, err := headscale.New(context.TODO(), os.Getenv("HEADSCALE_CLI_API_KEY"), c.loginServer)
+	// annotations override the policy
+	c.secretName = getAnnotation(pod, SecretNameAnnotation, c.secretName)
+	c.userspace = getBoolAnnotation(pod, EnableUserspaceAnnotation, c.userspace)
+	c.loginServer = getAnnotation(pod, LoginServerAnnotation, c.loginServer)
+	if err := c.setServerURL(settings); err != nil {
+		return nil, err
+	}
+	c.user = getAnnotation(pod, UserNameAnnotation, c.user)
+	tags, err := requestedTags(pod, settings, c.tags)
+	if err != nil {
+		return nil, err
+	}
+	// the tags may be those of a cached policy
+	c.tags = append(slices.Clone(c.tags), tags...)
+	c.failurePolicy = v1alpha1.FailurePolicy(getAnnotation(pod, FailurePolicyAnnotation, string(c.failurePolicy)))
+	if !c.failurePolicy.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidFailurePolicy, c.failurePolicy)
+	}
+	c.hostnameTemplate = getAnnotation(pod, HostnameAnnotation, c.hostnameTemplate)
+	if err := c.applyResourceAnnotations(pod); err != nil {
+		return nil, err
+	}
+	serve, err := parseServeAnnotations(pod)
 	if err != nil {
 		return nil, err
 	}
-	c.client = hs
+	if serve != nil {
+		c.serve = serve
+	}
+	if err := c.applyRouteAnnotations(pod, settings); err != nil {
+		return nil, err
+	}
+	if !c.userspace && !tunAllowed(c.podSecurity) {
+		c.userspace = true
+		c.forcedUserspace = true
+	}
+	// userspace sidecars have no tun device, the apps reach the tailnet
+	// through their proxies
+	if c.userspace {
+		if c.proxyContainers, err = proxyContainers(pod, c.proxyContainers); err != nil {
+			return nil, err
+		}
+	} else {
+		c.proxyContainers = nil
+	}
+	c.nodeMode = v1alpha1.NodeMode(getAnnotation(pod, NodeModeAnnotation, string(c.nodeMode)))
+	if !c.nodeMode.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidNodeMode, c.nodeMode)
+	}
+
+	// the identity of a node is that of its pod, templates have none
+	if si.template {
+		c.hostnameTemplate = ""
+	}
+	// persistent nodes keep their state in a secret of their own, unless
+	// the pod names one
+	if c.nodeMode == v1alpha1.Persistent && !si.template {
+		m, err := statefulSetMemberOf(&pod)
+		if err != nil {
+			return nil, err
+		}
+		c.member = m
+		c.hostname = m.hostname()
+		if _, ok := pod.Annotations[SecretNameAnnotation]; !ok {
+			c.secretName = m.stateSecretName()
+		}
+	}
+	if c.hostnameTemplate != "" {
+		hostname, err := renderHostname(c.hostnameTemplate, newHostnameData(&pod))
+		if err != nil {
+			return nil, err
+		}
+		c.hostname = hostname
+	}
+
+	c.provider = si.Provider
+	if c.provider == nil {
+		c.provider = &HeadscaleProvider{APIKey: os.Getenv("HEADSCALE_CLI_API_KEY")}
+	}
 
 	return c, nil
 }
@@ -95,8 +315,9 @@ func (c *config) TSExtraArgs() []string {
 	if c.loginServer != "" {
 		args = append(args, fmt.Sprintf("--login-server=%s", c.loginServer))
 	}
+	args = append(args, c.routeArgs()...)
 
-	return args
+	return append(args, c.extraArgs...)
 }
 
 func (c *config) TSKubeSecret() string {
@@ -110,33 +331,72 @@ func (c *config) TSUserspace() string {
 	return "false"
 }
 
+// injectSidecar adds the sidecar as the first init container, injected pods
+// and pods created from an injected template have theirs replaced
 func injectSidecar(pod *corev1.Pod, sidecar *corev1.Container) error {
 	if sidecar == nil {
 		return ErrSidecarNil
 	}
+	_, template := pod.Annotations[TemplateAnnotation]
+	if template || pod.Annotations[StatusAnnotation] == StatusInjected {
+		if i := slices.IndexFunc(pod.Spec.InitContainers, named(sidecar.Name)); i >= 0 {
+			pod.Spec.InitContainers[i] = *sidecar
+			return nil
+		}
+	}
 	pod.Spec.InitContainers = append([]corev1.Container{*sidecar}, pod.Spec.InitContainers...)
 	return nil
 }
 
+// setVolume adds a volume to the pod, replacing the one of the same name
+func setVolume(pod *corev1.Pod, volume corev1.Volume) {
+	if i := slices.IndexFunc(pod.Spec.Volumes, func(v corev1.Volume) bool { return v.Name == volume.Name }); i >= 0 {
+		pod.Spec.Volumes[i] = volume
+		return
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+}
+
 func buildSidecarContainer(config *config) (*corev1.Container, error) {
+	env := []corev1.EnvVar{
+		{Name: SecretNameKey, Value: config.TSKubeSecret()},
+		{Name: UserspaceKey, Value: config.TSUserspace()},
+		{Name: TSExtraArgs, Value: strings.Join(config.TSExtraArgs(), " ")},
+	}
+	// templates get no key, their pods do
+	if config.keyRef != nil {
+		env = append(env, corev1.EnvVar{Name: PreAuthKeyKey, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: config.keyRef}})
+	}
+	if config.hostname != "" {
+		env = append(env, corev1.EnvVar{Name: HostnameKey, Value: config.hostname})
+	}
+	env = append(env, config.healthEnv()...)
+	if config.userspace {
+		env = append(env,
+			corev1.EnvVar{Name: Socks5ServerKey, Value: config.proxyAddress()},
+			corev1.EnvVar{Name: HTTPProxyListenKey, Value: config.proxyAddress()},
+		)
+	}
+	var mounts []corev1.VolumeMount
+	if config.mountsTun() {
+		mounts = append(mounts, corev1.VolumeMount{Name: tunVolumeName, MountPath: tunDevicePath})
+	}
+	if config.serveConfigMap != "" {
+		env = append(env, corev1.EnvVar{Name: ServeConfigKey, Value: serveMountPath + "/" + serveConfigFile})
+		mounts = append(mounts, corev1.VolumeMount{Name: serveVolumeName, MountPath: serveMountPath, ReadOnly: true})
+	}
+
 	return &corev1.Container{
-		Name:            "tailscale",
+		Name:            SidecarName,
 		Image:           config.image,
 		ImagePullPolicy: corev1.PullAlways,
 		RestartPolicy:   ptr.To(corev1.ContainerRestartPolicyAlways),
-		SecurityContext: &corev1.SecurityContext{
-			Privileged: ptr.To(true),
-			Capabilities: &corev1.Capabilities{
-				Add: []corev1.Capability{"NET_ADMIN"},
-			},
-		},
-		Env: []corev1.EnvVar{
-			{Name: SecretNameKey, Value: config.TSKubeSecret()},
-			{Name: UserspaceKey, Value: config.TSUserspace()},
-			{Name: TSExtraArgs, Value: strings.Join(config.TSExtraArgs(), " ")},
-			// Todo: store in a secret
-			{Name: PreAuthKeyKey, Value: config.preAuthKey},
-		},
+		Resources:       config.sidecarResources(),
+		SecurityContext: config.securityContext(),
+		StartupProbe:    config.startupProbe(),
+		Lifecycle:       config.lifecycle(),
+		Env:             env,
+		VolumeMounts:    mounts,
 	}, nil
 
 }
@@ -147,54 +407,274 @@ func (si sidecarInjector) Name() string {
 	return "sidecar_injector"
 }
 
-func (c *config) TSAuthKey(tags []string) (string, error) {
-	if c.preAuthKey != "" {
-		return c.preAuthKey, nil
+// setServerURL picks the API the key of the pod is minted with. Only the
+// configured servers are dialed, the API key is never sent to a login server
+// named by a pod or policy unless it is allowed
+func (c *config) setServerURL(settings *injectorconfig.Config) error {
+	switch {
+	case c.loginServer == settings.LoginServer:
+		c.serverURL = settings.Headscale.Address
+		if c.serverURL == "" {
+			c.serverURL = settings.LoginServer
+		}
+	case slices.Contains(settings.AllowedLoginServers, c.loginServer):
+		c.serverURL = c.loginServer
+	default:
+		return fmt.Errorf("%w: %q", ErrLoginServerNotAllowed, c.loginServer)
 	}
+	return nil
+}
 
+// authKeyRequest builds the request for the pre-auth key of the pod
+func (c *config) authKeyRequest(tags []string) AuthKeyRequest {
 	var aclTags []string
 	for _, tag := range tags {
 		aclTags = append(aclTags, fmt.Sprintf("tag:%s", tag))
 	}
-	expiry := time.Now().Add(2 * time.Minute)
-	resp, err := c.client.PreAuthKeys().Create(context.TODO(), c.user, false, true, expiry, aclTags)
+	reusable, ephemeral := keySemantics(c.nodeMode)
+	return AuthKeyRequest{
+		User:        c.user,
+		Tags:        aclTags,
+		LoginServer: c.loginServer,
+		ServerURL:   c.serverURL,
+		Reusable:    reusable,
+		Ephemeral:   ephemeral,
+		Expiration:  time.Now().Add(c.keyTTL),
+		CreateUser:  c.createUser && c.user != "",
+	}
+}
+
+func (c *config) TSAuthKey(ctx context.Context, tags []string) (string, error) {
+	if c.preAuthKey != "" || c.keyRef != nil {
+		return c.preAuthKey, nil
+	}
+
+	req := c.authKeyRequest(tags)
+	key, err := c.provider.AuthKey(ctx, req)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%s provider: %w", c.provider.Name(), err)
 	}
-	c.preAuthKey = resp.PreAuthKey.Key
+	c.minted = key
+	c.keyRequest = req
+	c.preAuthKey = key.Key
+	c.keyID = key.ID
+	c.keyExpiry = key.Expiration
+	c.keyRef = key.SecretRef
 	return c.preAuthKey, nil
 
 }
 
-func (si sidecarInjector) Mutate(pod *corev1.Pod) (*corev1.Pod, error) {
+func (si sidecarInjector) Mutate(ctx context.Context, pod *corev1.Pod) (*corev1.Pod, error) {
 	// build the logger
 	si.Logger = si.Logger.WithField("mutation", si.Name())
 
-	if _, ok := pod.Labels[InjectLabel]; !ok {
-		si.Logger.Infof("ignoring %s", pod.Name)
+	ns := si.namespace(ctx, pod.Namespace)
+	if ok, reason := si.injectionEnabled(pod, ns); !ok {
+		si.Logger.Infof("ignoring %s: %s", pod.Name, reason)
 		return pod, nil
 	}
+	si.podSecurity = podSecurityLevel(ns)
+	if injected(pod) {
+		return si.reconcile(ctx, pod)
+	}
+	if err := checkSidecarName(pod); err != nil {
+		return nil, err
+	}
 
 	c, err := si.buildConfig(*pod)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := c.TSAuthKey([]string{
-		pod.Namespace,
-		"pod",
-	}); err != nil {
+	// dry runs mint no key and create no secret
+	if si.DryRun {
+		c.keyRef = dryRunKeyRef(pod)
+	} else {
+		if _, err := c.TSAuthKey(ctx, c.tags); err != nil {
+			switch c.failurePolicy {
+			case v1alpha1.FailOpen:
+				si.Logger.Warnf("admitting %s without sidecar: %v", pod.Name, err)
+				return si.failOpen(pod, err), nil
+			case v1alpha1.Defer:
+				si.Logger.Warnf("deferring pre-auth key of %s: %v", pod.Name, err)
+				if err := si.deferAuthKey(ctx, pod, c); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, err
+			}
+		}
+
+		if c.keyRef == nil {
+			name, err := ensureAuthKeySecret(ctx, si.Client, pod, authKeySecret(pod, c.preAuthKey, c.keyExpiry))
+			if err != nil {
+				si.expireMinted(ctx, c)
+				return nil, err
+			}
+			c.keyRef = &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Key:                  AuthKeySecretKey,
+				// the key is single use, once the node has joined its state
+				// lives in TS_KUBE_SECRET and the secret may be gone
+				Optional: ptr.To(true),
+			}
+		}
+
+		if c.member != nil {
+			if err := ensureStateSecret(ctx, si.Client, pod, c.member); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	mpod, err := si.inject(ctx, pod, c)
+	if err != nil {
 		return nil, err
 	}
 
+	if mpod.Annotations == nil {
+		mpod.Annotations = map[string]string{}
+	}
+	// the deferred secret is deleted once no pod refers to it, its key ID
+	// is recorded on it when minted
+	if c.deferredSecret != "" {
+		mpod.Annotations[AuthKeySecretAnnotation] = c.deferredSecret
+	}
+
+	// let the controller clean up Headscale once the pod is gone and enable
+	// its routes once it joined, persistent nodes outlive their pod
+	approve := c.approveRoutes && len(c.routes()) > 0
+	minted := c.keyID != "" || c.deferredSecret != ""
+	if minted && c.provider.Name() == HeadscaleProviderName && (c.nodeMode != v1alpha1.Persistent || approve) {
+		if c.keyID != "" {
+			mpod.Annotations[AuthKeyIDAnnotation] = c.keyID
+		}
+		mpod.Annotations[AuthKeyUserAnnotation] = c.user
+		if c.nodeMode != v1alpha1.Persistent {
+			mpod.Finalizers = append(mpod.Finalizers, CleanupFinalizer)
+		}
+		if approve {
+			mpod.Annotations[ApproveRoutesAnnotation] = strings.Join(c.routes(), ",")
+		}
+	}
+	markInjected(mpod)
+
+	return mpod, nil
+}
+
+// inject returns a copy of the pod with the sidecar of c and what it needs
+func (si sidecarInjector) inject(ctx context.Context, pod *corev1.Pod, c *config) (*corev1.Pod, error) {
+	if c.forcedUserspace {
+		si.Logger.Infof("running the sidecar of %s in userspace, pod security level %q does not allow tun devices", pod.Name, c.podSecurity)
+		if si.Report != nil {
+			si.Report.Warnings = append(si.Report.Warnings, fmt.Sprintf("tailscale sidecar runs in userspace as pod security level %q does not allow tun devices", c.podSecurity))
+		}
+	}
+
+	if len(c.serve) > 0 {
+		sc, err := buildServeConfig(pod, c.serve)
+		if err != nil {
+			return nil, err
+		}
+		if si.DryRun {
+			c.serveConfigMap, err = serveConfigMapName(sc)
+		} else {
+			c.serveConfigMap, err = ensureServeConfigMap(ctx, si.Client, pod, sc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	sc, err := buildSidecarContainer(c)
 	if err != nil {
 		return nil, err
 	}
 
-	// inject the sidecar
 	mpod := pod.DeepCopy()
+	injectProxyEnv(mpod, c)
 	injectSidecar(mpod, sc)
+	if c.mountsTun() {
+		setVolume(mpod, tunVolume())
+	}
+	if c.serveConfigMap != "" {
+		setVolume(mpod, serveVolume(c.serveConfigMap))
+	}
 
+	if c.policy != "" {
+		si.Logger.Debugf("configured by policy %s", c.policy)
+		if mpod.Annotations == nil {
+			mpod.Annotations = map[string]string{}
+		}
+		mpod.Annotations[PolicyAnnotation] = c.policy
+	}
 	return mpod, nil
 }
+
+// expireMinted revokes the key minted for a pod whose secret could not be
+// written, when the provider can
+func (si sidecarInjector) expireMinted(ctx context.Context, c *config) {
+	expirer, ok := c.provider.(AuthKeyExpirer)
+	if !ok || c.minted == nil {
+		return
+	}
+	if err := expirer.ExpireAuthKey(ctx, c.keyRequest, c.minted); err != nil {
+		si.Logger.Warnf("could not expire pre-auth key %s: %v", c.minted.ID, err)
+	}
+}
+
+// dryRunKeyRef points the sidecar at the secret its key would be stored in,
+// or at the prefix of its name when the pod has none yet
+func dryRunKeyRef(pod *corev1.Pod) *corev1.SecretKeySelector {
+	secret := authKeySecret(pod, "", time.Time{})
+	name := secret.Name
+	if name == "" {
+		name = secret.GenerateName
+	}
+	return &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: name},
+		Key:                  AuthKeySecretKey,
+		Optional:             ptr.To(true),
+	}
+}
+
+// failOpen returns the pod without a sidecar, annotated with the reason
+func (si sidecarInjector) failOpen(pod *corev1.Pod, cause error) *corev1.Pod {
+	mpod := pod.DeepCopy()
+	if mpod.Annotations == nil {
+		mpod.Annotations = map[string]string{}
+	}
+	mpod.Annotations[InjectionErrorAnnotation] = cause.Error()
+
+	if si.Report != nil {
+		si.Report.FailedOpen = true
+		si.Report.Warnings = append(si.Report.Warnings, fmt.Sprintf("tailscale sidecar not injected: %v", cause))
+	}
+	return mpod
+}
+
+// deferAuthKey points the sidecar at a secret without a key, the sidecar
+// cannot start until RunAuthKeySecretReconciler has minted it
+func (si sidecarInjector) deferAuthKey(ctx context.Context, pod *corev1.Pod, c *config) error {
+	secret, err := deferredAuthKeySecret(pod, c.authKeyRequest(c.tags), c.keyTTL)
+	if err != nil {
+		return err
+	}
+	name, err := ensureAuthKeySecret(ctx, si.Client, pod, secret)
+	if err != nil {
+		return err
+	}
+	c.keyRef = &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: name},
+		Key:                  AuthKeySecretKey,
+		// hold the sidecar back until the key is minted
+		Optional: ptr.To(false),
+	}
+	c.deferredSecret = name
+
+	if si.Report != nil {
+		si.Report.Deferred = true
+		si.Report.Warnings = append(si.Report.Warnings, fmt.Sprintf("tailscale pre-auth key deferred, sidecar waits for secret %s", name))
+	}
+	return nil
+}
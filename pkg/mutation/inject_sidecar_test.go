@@ -1,12 +1,17 @@
 package mutation
 
 import (
+	"context"
+	"errors"
 	"testing"
 
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestIgnoreUnannotatedPod(t *testing.T) {
@@ -33,7 +38,7 @@ func TestIgnoreUnannotatedPod(t *testing.T) {
 	}
 
 	logger := logrus.New().WithField("test", t.Name())
-	got, err := sidecarInjector{Logger: logger}.Mutate(pod)
+	got, err := sidecarInjector{Logger: logger}.Mutate(context.Background(), pod)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,9 +63,168 @@ func TestInjectSidecarMutate(t *testing.T) {
 			logger := logrus.New()
 			logger.WithField("test", t.Name())
 			want := test.want.DeepCopy()
-			got, err := sidecarInjector{Logger: logger}.Mutate(test.got.DeepCopy())
+			got, err := sidecarInjector{Logger: logger}.Mutate(context.Background(), test.got.DeepCopy())
 			assert.NoError(t, err)
 			assert.Equal(t, want, got)
 		})
 	}
 }
+
+func TestBuildSidecarContainerAuthKeyFromSecret(t *testing.T) {
+	c := &config{
+		image:      injectorconfig.Default().ImageRef(),
+		preAuthKey: "tskey-secret",
+		keyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "web-tailscale-authkey"},
+			Key:                  AuthKeySecretKey,
+		},
+	}
+
+	sc, err := buildSidecarContainer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, env := range sc.Env {
+		assert.NotEqual(t, c.preAuthKey, env.Value, "pre-auth key leaked into %s", env.Name)
+		if env.Name != PreAuthKeyKey {
+			continue
+		}
+		if assert.NotNil(t, env.ValueFrom) && assert.NotNil(t, env.ValueFrom.SecretKeyRef) {
+			assert.Equal(t, "web-tailscale-authkey", env.ValueFrom.SecretKeyRef.Name)
+			assert.Equal(t, AuthKeySecretKey, env.ValueFrom.SecretKeyRef.Key)
+		}
+	}
+}
+
+func TestMutateFailurePolicy(t *testing.T) {
+	unreachable := &fakeProvider{err: errors.New("connection refused")}
+	pod := func(policy string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "web",
+				Namespace:   "apps",
+				Labels:      map[string]string{InjectLabel: "true"},
+				Annotations: map[string]string{FailurePolicyAnnotation: policy},
+			},
+		}
+	}
+
+	t.Run("fail-closed", func(t *testing.T) {
+		si := sidecarInjector{Logger: logrus.New(), Provider: unreachable, Report: &Result{}}
+		_, err := si.Mutate(context.Background(), pod("fail-closed"))
+		assert.ErrorContains(t, err, "connection refused")
+	})
+
+	t.Run("fail-open", func(t *testing.T) {
+		report := &Result{}
+		si := sidecarInjector{Logger: logrus.New(), Provider: unreachable, Report: report}
+		got, err := si.Mutate(context.Background(), pod("fail-open"))
+		require.NoError(t, err)
+		assert.Empty(t, got.Spec.InitContainers)
+		assert.Equal(t, "fake provider: connection refused", got.Annotations[InjectionErrorAnnotation])
+		assert.True(t, report.FailedOpen)
+		assert.Len(t, report.Warnings, 1)
+	})
+
+	t.Run("defer", func(t *testing.T) {
+		report := &Result{}
+		client := fake.NewSimpleClientset(testServiceAccount())
+		si := sidecarInjector{Logger: logrus.New(), Client: client, Provider: unreachable, Report: report}
+		got, err := si.Mutate(context.Background(), pod("defer"))
+		require.NoError(t, err)
+		require.Len(t, got.Spec.InitContainers, 1)
+		assert.True(t, report.Deferred)
+		assert.Len(t, report.Warnings, 1)
+
+		var ref *corev1.SecretKeySelector
+		for _, env := range got.Spec.InitContainers[0].Env {
+			if env.Name == PreAuthKeyKey {
+				ref = env.ValueFrom.SecretKeyRef
+			}
+		}
+		require.NotNil(t, ref)
+		assert.Equal(t, "web-tailscale-authkey", ref.Name)
+		assert.False(t, *ref.Optional)
+		assert.Equal(t, ref.Name, got.Annotations[AuthKeySecretAnnotation])
+
+		secret, err := client.CoreV1().Secrets("apps").Get(context.Background(), ref.Name, v1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "true", secret.Labels[DeferredLabel])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		si := sidecarInjector{Logger: logrus.New(), Provider: unreachable}
+		_, err := si.Mutate(context.Background(), pod("sometimes"))
+		assert.ErrorIs(t, err, ErrInvalidFailurePolicy)
+	})
+}
+
+func TestBuildConfigTags(t *testing.T) {
+	settings, err := injectorconfig.Parse([]byte(`allowedTags: {apps: [web, "team-*"]}`))
+	require.NoError(t, err)
+	si := sidecarInjector{Logger: logrus.New(), Settings: settings}
+	pod := func(tags string) corev1.Pod {
+		return corev1.Pod{ObjectMeta: v1.ObjectMeta{
+			Namespace:   "apps",
+			Annotations: map[string]string{TagsAnnotation: tags},
+		}}
+	}
+
+	c, err := si.buildConfig(pod("web, tag:team-a,pod"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"apps", "pod", "web", "team-a"}, c.tags)
+
+	_, err = si.buildConfig(pod("web,admin"))
+	assert.ErrorIs(t, err, ErrTagNotAllowed)
+	assert.ErrorContains(t, err, `pods in namespace "apps" may not ask for tag:admin`)
+
+	_, err = si.buildConfig(pod("team a"))
+	assert.ErrorContains(t, err, "invalid tag")
+}
+
+func TestBuildConfigLoginServer(t *testing.T) {
+	settings, err := injectorconfig.Parse([]byte(`{loginServer: https://hs.example.com, headscale: {address: "https://hs-api.example.com"}, allowedLoginServers: [https://other.example.com]}`))
+	require.NoError(t, err)
+	si := sidecarInjector{Logger: logrus.New(), Settings: settings}
+	pod := func(server string) corev1.Pod {
+		p := corev1.Pod{ObjectMeta: v1.ObjectMeta{Namespace: "apps"}}
+		if server != "" {
+			p.Annotations = map[string]string{LoginServerAnnotation: server}
+		}
+		return p
+	}
+
+	c, err := si.buildConfig(pod(""))
+	require.NoError(t, err)
+	assert.Equal(t, "https://hs-api.example.com", c.authKeyRequest(nil).ServerURL)
+
+	c, err = si.buildConfig(pod("https://other.example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://other.example.com", c.authKeyRequest(nil).ServerURL)
+
+	_, err = si.buildConfig(pod("https://attacker.example.com"))
+	assert.ErrorIs(t, err, ErrLoginServerNotAllowed, "the API key is not sent to servers named by pods")
+}
+
+func TestMutateDryRun(t *testing.T) {
+	client := fake.NewSimpleClientset(testServiceAccount())
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   client,
+		Provider: &fakeProvider{err: errors.New("minted on a dry run")},
+		DryRun:   true,
+	}
+
+	got, err := si.Mutate(context.Background(), servePod(map[string]string{ServeAnnotation: "https:443=http"}))
+	require.NoError(t, err)
+	require.Len(t, got.Spec.InitContainers, 1)
+	assert.Contains(t, got.Spec.InitContainers[0].Env, corev1.EnvVar{Name: PreAuthKeyKey, ValueFrom: &corev1.EnvVarSource{
+		SecretKeyRef: dryRunKeyRef(servePod(nil)),
+	}})
+	assert.Empty(t, got.Finalizers, "no key was minted for the controller to clean up")
+
+	for _, action := range client.Actions() {
+		assert.Contains(t, []string{"get", "list", "watch"}, action.GetVerb(), "dry runs write nothing: %v", action)
+	}
+}
@@ -0,0 +1,73 @@
+package mutation
+
+import (
+	"context"
+	"strconv"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InjectAnnotation opts a pod in or out of injection like InjectLabel, the
+// label wins when both are set. The webhook configuration selects pods by
+// label, so the annotation mostly opts pods of an enabled namespace out
+const InjectAnnotation string = "tailscale.iced.cool/inject"
+
+// namespace returns a namespace from the lister, or from the API server
+// without one. It returns nil when the namespace cannot be told
+func (si sidecarInjector) namespace(ctx context.Context, name string) *corev1.Namespace {
+	var (
+		ns  *corev1.Namespace
+		err error
+	)
+	switch {
+	case si.Namespaces != nil:
+		ns, err = si.Namespaces.Get(name)
+	case si.Client != nil:
+		ns, err = si.Client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	default:
+		return nil
+	}
+	if err != nil {
+		si.Logger.Warnf("could not get namespace %s: %v", name, err)
+		return nil
+	}
+	return ns
+}
+
+// injectValue parses the value of InjectLabel or InjectAnnotation, "false"
+// and "disabled" opt out and any other value opts in
+func injectValue(v string) bool {
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return v != "disabled"
+}
+
+// injectionEnabled decides whether the sidecar is injected into the pod,
+// and why. Pods are never injected in excluded namespaces, otherwise they
+// are as they ask with InjectLabel or InjectAnnotation, or as their
+// namespace asks with InjectLabel
+func (si sidecarInjector) injectionEnabled(pod *corev1.Pod, ns *corev1.Namespace) (bool, string) {
+	settings := si.Settings
+	if settings == nil {
+		settings = injectorconfig.Default()
+	}
+	if (si.WebhookNamespace != "" && pod.Namespace == si.WebhookNamespace) || settings.NamespaceExcluded(pod.Namespace) {
+		return false, "namespace " + pod.Namespace + " is excluded"
+	}
+
+	if v, ok := pod.Labels[InjectLabel]; ok {
+		return injectValue(v), "pod label " + InjectLabel + "=" + v
+	}
+	if v, ok := pod.Annotations[InjectAnnotation]; ok {
+		return injectValue(v), "pod annotation " + InjectAnnotation + "=" + v
+	}
+	if ns != nil {
+		if v, ok := ns.Labels[InjectLabel]; ok {
+			return injectValue(v), "namespace label " + InjectLabel + "=" + v
+		}
+	}
+	return false, "neither the pod nor its namespace opted in"
+}
@@ -0,0 +1,104 @@
+package mutation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func namespaceLister(t *testing.T, namespaces ...*corev1.Namespace) corelisters.NamespaceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		require.NoError(t, indexer.Add(ns))
+	}
+	return corelisters.NewNamespaceLister(indexer)
+}
+
+func labelledNamespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func TestInjectionEnabled(t *testing.T) {
+	si := sidecarInjector{
+		Logger: logrus.New(),
+		Namespaces: namespaceLister(t,
+			labelledNamespace("plain", nil),
+			labelledNamespace("enabled", map[string]string{InjectLabel: "true"}),
+			labelledNamespace("enabled-word", map[string]string{InjectLabel: "enabled"}),
+			labelledNamespace("disabled", map[string]string{InjectLabel: "false"}),
+			labelledNamespace("disabled-word", map[string]string{InjectLabel: "disabled"}),
+			labelledNamespace("kube-system", map[string]string{InjectLabel: "true"}),
+			labelledNamespace("injector", map[string]string{InjectLabel: "true"}),
+		),
+		WebhookNamespace: "injector",
+	}
+
+	tests := []struct {
+		name        string
+		namespace   string
+		labels      map[string]string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "nothing set", namespace: "plain"},
+		{name: "unknown namespace", namespace: "missing"},
+		{name: "pod label", namespace: "plain", labels: map[string]string{InjectLabel: "true"}, want: true},
+		{name: "pod label without value", namespace: "plain", labels: map[string]string{InjectLabel: ""}, want: true},
+		{name: "pod label opts out", namespace: "plain", labels: map[string]string{InjectLabel: "false"}},
+		{name: "pod annotation", namespace: "plain", annotations: map[string]string{InjectAnnotation: "true"}, want: true},
+		{name: "pod annotation opts out", namespace: "enabled", annotations: map[string]string{InjectAnnotation: "false"}},
+		{name: "label wins over annotation", namespace: "plain", labels: map[string]string{InjectLabel: "true"}, annotations: map[string]string{InjectAnnotation: "false"}, want: true},
+		{name: "label opts out over annotation", namespace: "plain", labels: map[string]string{InjectLabel: "false"}, annotations: map[string]string{InjectAnnotation: "true"}},
+		{name: "namespace label", namespace: "enabled", want: true},
+		{name: "namespace label enabled", namespace: "enabled-word", want: true},
+		{name: "namespace label opts out", namespace: "disabled"},
+		{name: "namespace label disabled", namespace: "disabled-word"},
+		{name: "pod opts out of namespace", namespace: "enabled", labels: map[string]string{InjectLabel: "false"}},
+		{name: "pod opts into disabled namespace", namespace: "disabled", labels: map[string]string{InjectLabel: "true"}, want: true},
+		{name: "excluded namespace", namespace: "kube-system", labels: map[string]string{InjectLabel: "true"}},
+		{name: "webhook namespace", namespace: "injector", labels: map[string]string{InjectLabel: "true"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "web",
+				Namespace:   tt.namespace,
+				Labels:      tt.labels,
+				Annotations: tt.annotations,
+			}}
+			got, reason := si.injectionEnabled(pod, si.namespace(context.Background(), tt.namespace))
+			assert.Equal(t, tt.want, got, reason)
+		})
+	}
+}
+
+func TestMutateNamespaceOptIn(t *testing.T) {
+	ctx := context.Background()
+	si := sidecarInjector{
+		Logger:     logrus.New(),
+		Client:     fake.NewSimpleClientset(testServiceAccount()),
+		Provider:   &fakeProvider{key: &AuthKey{Key: "key"}},
+		Namespaces: namespaceLister(t, labelledNamespace("apps", map[string]string{InjectLabel: "true"})),
+	}
+
+	pod := servePod(nil)
+	pod.Labels = nil
+	got, err := si.Mutate(ctx, pod)
+	require.NoError(t, err)
+	assert.Equal(t, SidecarName, got.Spec.InitContainers[0].Name)
+	assert.Equal(t, "true", got.Labels[InjectLabel], "the controller watches injected pods by label")
+
+	pod.Annotations = map[string]string{InjectAnnotation: "false"}
+	got, err = si.Mutate(ctx, pod)
+	require.NoError(t, err)
+	assert.Empty(t, got.Spec.InitContainers)
+}
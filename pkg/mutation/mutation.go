@@ -1,16 +1,29 @@
 package mutation
 
 import (
+	"context"
 	"encoding/json"
 
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
 	"github.com/sirupsen/logrus"
 	"github.com/wI2L/jsondiff"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 )
 
 // Mutator is a container for mutation
 type Mutator struct {
-	Logger *logrus.Entry
+	Logger   *logrus.Entry
+	Client   kubernetes.Interface
+	Provider AuthKeyProvider
+	Policies PolicyLister
+	// Namespaces decide which pods are injected, they are looked up in the
+	// API server when nil
+	Namespaces corelisters.NamespaceLister
+	// WebhookNamespace is the namespace of the webhook, it is never injected
+	WebhookNamespace string
+	Config           *injectorconfig.Store
 }
 
 // NewMutator returns an initialised instance of Mutator
@@ -18,15 +31,28 @@ func NewMutator(logger *logrus.Entry) *Mutator {
 	return &Mutator{Logger: logger}
 }
 
+// Result is the outcome of mutating a pod
+type Result struct {
+	Patch []byte
+	// Warnings are returned to the client creating the pod
+	Warnings []string
+	// FailedOpen is set when the pod was admitted without a sidecar
+	FailedOpen bool
+	// Deferred is set when the sidecar waits for its pre-auth key
+	Deferred bool
+}
+
 // podMutators is an interface used to group functions mutating pods
 type podMutator interface {
-	Mutate(*corev1.Pod) (*corev1.Pod, error)
+	Mutate(context.Context, *corev1.Pod) (*corev1.Pod, error)
 	Name() string
 }
 
 // MutatePodPatch returns a json patch containing all the mutations needed for
-// a given pod
-func (m *Mutator) MutatePodPatch(pod *corev1.Pod) ([]byte, error) {
+// a given pod, along with warnings for the admission response. Calls to the
+// control server and the API server are bound by the context. Dry runs
+// write nothing and mint no key
+func (m *Mutator) MutatePodPatch(ctx context.Context, pod *corev1.Pod, dryRun bool) (*Result, error) {
 	var podName string
 	if pod.Name != "" {
 		podName = pod.Name
@@ -37,9 +63,26 @@ func (m *Mutator) MutatePodPatch(pod *corev1.Pod) ([]byte, error) {
 	}
 	log := logrus.WithField("pod_name", podName)
 
+	var settings *injectorconfig.Config
+	if m.Config != nil {
+		settings = m.Config.Get()
+	}
+
+	result := &Result{}
+
 	// list of all mutations to be applied to the pod
 	mutations := []podMutator{
-		sidecarInjector{Logger: log},
+		sidecarInjector{
+			Logger:           log,
+			Client:           m.Client,
+			Provider:         m.Provider,
+			Policies:         m.Policies,
+			Namespaces:       m.Namespaces,
+			WebhookNamespace: m.WebhookNamespace,
+			Settings:         settings,
+			Report:           result,
+			DryRun:           dryRun,
+		},
 	}
 
 	mpod := pod.DeepCopy()
@@ -47,7 +90,7 @@ func (m *Mutator) MutatePodPatch(pod *corev1.Pod) ([]byte, error) {
 	// apply all mutations
 	for _, m := range mutations {
 		var err error
-		mpod, err = m.Mutate(mpod)
+		mpod, err = m.Mutate(ctx, mpod)
 		if err != nil {
 			return nil, err
 		}
@@ -59,10 +102,10 @@ func (m *Mutator) MutatePodPatch(pod *corev1.Pod) ([]byte, error) {
 		return nil, err
 	}
 
-	patchb, err := json.Marshal(patch)
+	result.Patch, err = json.Marshal(patch)
 	if err != nil {
 		return nil, err
 	}
 
-	return patchb, nil
+	return result, nil
 }
@@ -0,0 +1,115 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// NodeModeAnnotation is one of ephemeral, reusable or persistent
+	NodeModeAnnotation string = "tailscale.iced.cool/node-mode"
+	// podIndexLabel is set on StatefulSet pods since Kubernetes 1.28
+	podIndexLabel     string = "apps.kubernetes.io/pod-index"
+	stateSecretSuffix string = "-tailscale-state"
+)
+
+var (
+	ErrInvalidNodeMode  error = fmt.Errorf("invalid node mode")
+	ErrNotInStatefulSet error = fmt.Errorf("persistent nodes need a pod of a StatefulSet")
+)
+
+// keySemantics returns whether the key of a node of mode m is reusable and
+// ephemeral
+func keySemantics(m v1alpha1.NodeMode) (reusable, ephemeral bool) {
+	switch m {
+	case v1alpha1.Reusable:
+		return true, true
+	case v1alpha1.Persistent:
+		return false, false
+	}
+	return false, true
+}
+
+// statefulSetMember is the identity of a pod within its StatefulSet
+type statefulSetMember struct {
+	owner   metav1.OwnerReference
+	ordinal int
+}
+
+// hostname is stable across restarts and rescheduling of the pod. Like
+// rendered hostnames it is a DNS label, the name of the StatefulSet is cut
+// so the ordinal always fits
+func (m statefulSetMember) hostname() string {
+	suffix := "-" + strconv.Itoa(m.ordinal)
+	return strings.TrimRight(truncate(sanitizeHostname(m.owner.Name), maxHostnameLength-len(suffix)), "-") + suffix
+}
+
+// stateSecretName is the TS_KUBE_SECRET of the pod
+func (m statefulSetMember) stateSecretName() string {
+	name := fmt.Sprintf("%s-%d", m.owner.Name, m.ordinal)
+	return truncate(name, maxNameLength-len(stateSecretSuffix)) + stateSecretSuffix
+}
+
+// statefulSetMemberOf returns the StatefulSet and ordinal of a pod, the
+// ordinal is read from the pod index label or else the pod name
+func statefulSetMemberOf(pod *corev1.Pod) (*statefulSetMember, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		return nil, ErrNotInStatefulSet
+	}
+
+	index, ok := pod.Labels[podIndexLabel]
+	if !ok {
+		var found bool
+		index, found = strings.CutPrefix(pod.Name, owner.Name+"-")
+		if !found {
+			return nil, fmt.Errorf("%w: cannot find the ordinal of pod %q", ErrNotInStatefulSet, pod.Name)
+		}
+	}
+	ordinal, err := strconv.Atoi(index)
+	if err != nil || ordinal < 0 {
+		return nil, fmt.Errorf("%w: invalid ordinal %q", ErrNotInStatefulSet, index)
+	}
+
+	return &statefulSetMember{owner: *owner, ordinal: ordinal}, nil
+}
+
+// ensureStateSecret creates the empty state secret of a persistent node
+// unless it exists. It is owned by the StatefulSet so the node identity
+// survives the pod but not the StatefulSet
+func ensureStateSecret(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod, m *statefulSetMember) error {
+	if client == nil {
+		return ErrClientNil
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m.stateSecretName(),
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: m.owner.APIVersion,
+				Kind:       m.owner.Kind,
+				Name:       m.owner.Name,
+				UID:        m.owner.UID,
+			}},
+		},
+		Type: corev1.SecretTypeOpaque,
+	}
+
+	_, err := client.CoreV1().Secrets(pod.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("could not create state secret: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package mutation
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func statefulSetPod(name string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "apps",
+			Labels:    labels,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "StatefulSet",
+				Name:       "db",
+				UID:        "sts-uid",
+				Controller: ptr.To(true),
+			}},
+		},
+	}
+}
+
+func TestStatefulSetMemberOf(t *testing.T) {
+	m, err := statefulSetMemberOf(statefulSetPod("db-2", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "db-2", m.hostname())
+	assert.Equal(t, "db-2-tailscale-state", m.stateSecretName())
+
+	m, err = statefulSetMemberOf(statefulSetPod("db-2", map[string]string{podIndexLabel: "3"}))
+	require.NoError(t, err)
+	assert.Equal(t, 3, m.ordinal, "the pod index label wins")
+
+	long := statefulSetPod("db-2", nil)
+	long.OwnerReferences[0].Name = "analytics.warehouse-" + strings.Repeat("replica", 10)
+	long.Name = long.OwnerReferences[0].Name + "-12"
+	m, err = statefulSetMemberOf(long)
+	require.NoError(t, err)
+	assert.Len(t, m.hostname(), maxHostnameLength)
+	assert.Regexp(t, `^analytics-warehouse-replica[a-z]+-12$`, m.hostname(), "the ordinal survives truncation")
+	assert.Equal(t, m.hostname(), sanitizeHostname(m.hostname()))
+
+	_, err = statefulSetMemberOf(statefulSetPod("other-2", nil))
+	assert.ErrorIs(t, err, ErrNotInStatefulSet)
+
+	_, err = statefulSetMemberOf(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web"}})
+	assert.ErrorIs(t, err, ErrNotInStatefulSet)
+}
+
+func TestMutateNodeMode(t *testing.T) {
+	ctx := context.Background()
+	key := &AuthKey{ID: "1", Key: "hs-key"}
+
+	t.Run("ephemeral by default", func(t *testing.T) {
+		provider := &fakeProvider{key: key}
+		si := sidecarInjector{Logger: logrus.New(), Client: fake.NewSimpleClientset(testServiceAccount()), Provider: provider}
+		_, err := si.Mutate(ctx, statefulSetPod("db-0", map[string]string{InjectLabel: "true"}))
+		require.NoError(t, err)
+		assert.True(t, provider.req.Ephemeral)
+		assert.False(t, provider.req.Reusable)
+	})
+
+	t.Run("reusable", func(t *testing.T) {
+		provider := &fakeProvider{key: key}
+		si := sidecarInjector{Logger: logrus.New(), Client: fake.NewSimpleClientset(testServiceAccount()), Provider: provider}
+		pod := statefulSetPod("db-0", map[string]string{InjectLabel: "true"})
+		pod.Annotations = map[string]string{NodeModeAnnotation: "reusable"}
+		_, err := si.Mutate(ctx, pod)
+		require.NoError(t, err)
+		assert.True(t, provider.req.Ephemeral)
+		assert.True(t, provider.req.Reusable)
+	})
+
+	t.Run("persistent", func(t *testing.T) {
+		provider := &fakeProvider{key: key}
+		client := fake.NewSimpleClientset(testServiceAccount())
+		si := sidecarInjector{Logger: logrus.New(), Client: client, Provider: provider}
+		pod := statefulSetPod("db-1", map[string]string{InjectLabel: "true"})
+		pod.Annotations = map[string]string{NodeModeAnnotation: "persistent"}
+
+		got, err := si.Mutate(ctx, pod)
+		require.NoError(t, err)
+		assert.False(t, provider.req.Ephemeral)
+		assert.False(t, provider.req.Reusable)
+
+		env := map[string]string{}
+		for _, e := range got.Spec.InitContainers[0].Env {
+			env[e.Name] = e.Value
+		}
+		assert.Equal(t, "db-1", env[HostnameKey])
+		assert.Equal(t, "db-1-tailscale-state", env[SecretNameKey])
+		assert.NotContains(t, got.Finalizers, CleanupFinalizer)
+
+		secret, err := client.CoreV1().Secrets("apps").Get(ctx, "db-1-tailscale-state", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "StatefulSet", secret.OwnerReferences[0].Kind)
+
+		// the state is kept when the pod is recreated
+		secret.Data = map[string][]byte{"_machinekey": []byte("state")}
+		_, err = client.CoreV1().Secrets("apps").Update(ctx, secret, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		_, err = si.Mutate(ctx, pod)
+		require.NoError(t, err)
+		secret, err = client.CoreV1().Secrets("apps").Get(ctx, "db-1-tailscale-state", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("state"), secret.Data["_machinekey"])
+	})
+
+	t.Run("persistent outside a statefulset", func(t *testing.T) {
+		si := sidecarInjector{Logger: logrus.New(), Provider: &fakeProvider{key: key}}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Labels:      map[string]string{InjectLabel: "true"},
+			Annotations: map[string]string{NodeModeAnnotation: "persistent"},
+		}}
+		_, err := si.Mutate(ctx, pod)
+		assert.ErrorIs(t, err, ErrNotInStatefulSet)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		si := sidecarInjector{Logger: logrus.New(), Provider: &fakeProvider{key: key}}
+		pod := statefulSetPod("db-0", map[string]string{InjectLabel: "true"})
+		pod.Annotations = map[string]string{NodeModeAnnotation: "forever"}
+		_, err := si.Mutate(ctx, pod)
+		assert.ErrorIs(t, err, ErrInvalidNodeMode)
+	})
+}
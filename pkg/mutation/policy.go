@@ -0,0 +1,142 @@
+package mutation
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// PolicyAnnotation records which TailscaleSidecarPolicy configured a pod
+const PolicyAnnotation string = "tailscale.iced.cool/policy"
+
+var ErrExtraArgNotAllowed error = fmt.Errorf("extra argument not allowed")
+
+// reservedFlags are the tailscale up flags policies may not pass in their
+// extra arguments, the fields they set are checked against the config
+var reservedFlags = []string{"advertise-routes", "advertise-tags", "advertise-exit-node"}
+
+// PolicyLister lists the TailscaleSidecarPolicies of a namespace
+type PolicyLister interface {
+	List(namespace string) ([]v1alpha1.TailscaleSidecarPolicy, error)
+}
+
+// matchPolicy returns the policy selecting the pod or nil if there is none.
+// Policies are evaluated in name order and the first match wins
+func matchPolicy(policies []v1alpha1.TailscaleSidecarPolicy, pod *corev1.Pod) (*v1alpha1.TailscaleSidecarPolicy, error) {
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	for i := range policies {
+		p := &policies[i]
+		selector, err := metav1.LabelSelectorAsSelector(&p.Spec.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s/%s has an invalid pod selector: %w", p.Namespace, p.Name, err)
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return p, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// applyPolicy sets every field defined by the policy on the config. Like
+// the tags and routes pods ask for, those of the policy must be allowed in
+// namespace
+func (c *config) applyPolicy(p *v1alpha1.TailscaleSidecarPolicy, settings *injectorconfig.Config, namespace string) error {
+	c.policy = p.Name
+	if p.Spec.User != "" {
+		c.user = p.Spec.User
+	}
+	if len(p.Spec.Tags) > 0 {
+		for _, tag := range p.Spec.Tags {
+			if !injectorconfig.ValidTag(tag) {
+				return fmt.Errorf("policy %s/%s: invalid tag %q", p.Namespace, p.Name, tag)
+			}
+			if !settings.TagAllowed(namespace, tag) {
+				return fmt.Errorf("%w: policy %s/%s may not give pods in namespace %q tag:%s", ErrTagNotAllowed, p.Namespace, p.Name, namespace, tag)
+			}
+		}
+		c.tags = p.Spec.Tags
+	}
+	if p.Spec.Image != "" {
+		c.image = p.Spec.Image
+	}
+	if p.Spec.Userspace != nil {
+		c.userspace = *p.Spec.Userspace
+	}
+	if p.Spec.LoginServer != "" {
+		c.loginServer = p.Spec.LoginServer
+	}
+	if p.Spec.Resources != nil {
+		// annotations are applied on top of the resources
+		c.resources = *p.Spec.Resources.DeepCopy()
+	}
+	if p.Spec.FailurePolicy != "" {
+		c.failurePolicy = p.Spec.FailurePolicy
+	}
+	if p.Spec.NodeMode != "" {
+		c.nodeMode = p.Spec.NodeMode
+	}
+	if p.Spec.Hostname != "" {
+		c.hostnameTemplate = p.Spec.Hostname
+	}
+	if len(p.Spec.Serve) > 0 {
+		c.serve = p.Spec.Serve
+	}
+	if len(p.Spec.AdvertiseRoutes) > 0 {
+		routes, err := parseRoutes(p.Spec.AdvertiseRoutes)
+		if err != nil {
+			return fmt.Errorf("policy %s/%s: %w", p.Namespace, p.Name, err)
+		}
+		if err := routesAllowed(settings, namespace, routes, false); err != nil {
+			return fmt.Errorf("policy %s/%s: %w", p.Namespace, p.Name, err)
+		}
+		c.advertiseRoutes = p.Spec.AdvertiseRoutes
+	}
+	if p.Spec.AdvertiseExitNode != nil {
+		if err := routesAllowed(settings, namespace, nil, *p.Spec.AdvertiseExitNode); err != nil {
+			return fmt.Errorf("policy %s/%s: %w", p.Namespace, p.Name, err)
+		}
+		c.advertiseExit = *p.Spec.AdvertiseExitNode
+	}
+	if p.Spec.AcceptRoutes != nil {
+		c.acceptRoutes = *p.Spec.AcceptRoutes
+	}
+	if p.Spec.ExitNode != "" {
+		c.exitNode = p.Spec.ExitNode
+	}
+	if len(p.Spec.ProxyContainers) > 0 {
+		c.proxyContainers = p.Spec.ProxyContainers
+	}
+	for _, arg := range p.Spec.ExtraArgs {
+		if flag, ok := reservedFlag(arg); ok {
+			return fmt.Errorf("%w: policy %s/%s may not pass --%s, use its fields instead", ErrExtraArgNotAllowed, p.Namespace, p.Name, flag)
+		}
+	}
+	c.extraArgs = append(c.extraArgs, p.Spec.ExtraArgs...)
+	return nil
+}
+
+// reservedFlag returns the reserved flag passed by arg, which may hold
+// several arguments as TS_EXTRA_ARGS is split on spaces
+func reservedFlag(arg string) (string, bool) {
+	for _, f := range strings.Fields(arg) {
+		if !strings.HasPrefix(f, "-") {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(f, "-"), "=")
+		if slices.Contains(reservedFlags, name) {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,221 @@
+package mutation
+
+import (
+	"testing"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// staticPolicies is a PolicyLister serving a fixed set of policies
+type staticPolicies []v1alpha1.TailscaleSidecarPolicy
+
+func (s staticPolicies) List(namespace string) ([]v1alpha1.TailscaleSidecarPolicy, error) {
+	var res []v1alpha1.TailscaleSidecarPolicy
+	for _, p := range s {
+		if p.Namespace == namespace {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func testPolicy(name string, selector map[string]string, spec v1alpha1.TailscaleSidecarPolicySpec) v1alpha1.TailscaleSidecarPolicy {
+	spec.PodSelector = metav1.LabelSelector{MatchLabels: selector}
+	return v1alpha1.TailscaleSidecarPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "apps"},
+		Spec:       spec,
+	}
+}
+
+func TestMatchPolicy(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}}
+
+	tests := map[string]struct {
+		policies []v1alpha1.TailscaleSidecarPolicy
+		want     string
+	}{
+		"no policies": {},
+		"selector does not match": {
+			policies: []v1alpha1.TailscaleSidecarPolicy{
+				testPolicy("db", map[string]string{"app": "db"}, v1alpha1.TailscaleSidecarPolicySpec{}),
+			},
+		},
+		"empty selector matches everything": {
+			policies: []v1alpha1.TailscaleSidecarPolicy{
+				testPolicy("db", map[string]string{"app": "db"}, v1alpha1.TailscaleSidecarPolicySpec{}),
+				testPolicy("default", nil, v1alpha1.TailscaleSidecarPolicySpec{}),
+			},
+			want: "default",
+		},
+		"first by name wins": {
+			policies: []v1alpha1.TailscaleSidecarPolicy{
+				testPolicy("web", map[string]string{"app": "web"}, v1alpha1.TailscaleSidecarPolicySpec{}),
+				testPolicy("a-web", map[string]string{"app": "web"}, v1alpha1.TailscaleSidecarPolicySpec{}),
+			},
+			want: "a-web",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := matchPolicy(test.policies, pod)
+			require.NoError(t, err)
+			if test.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, test.want, got.Name)
+		})
+	}
+}
+
+func TestBuildConfigPolicy(t *testing.T) {
+	resources := &corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m")},
+	}
+	settings, err := injectorconfig.Parse([]byte(`{allowedTags: {apps: [web]}, allowedLoginServers: [https://headscale.example.com], routes: {allowed: {apps: [10.96.0.0/12]}}}`))
+	require.NoError(t, err)
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Settings: settings,
+		Policies: staticPolicies{
+			testPolicy("web", map[string]string{"app": "web"}, v1alpha1.TailscaleSidecarPolicySpec{
+				User:            "platform",
+				Tags:            []string{"web"},
+				Image:           "ghcr.io/tailscale/tailscale:v1.80.0",
+				Userspace:       ptr.To(true),
+				LoginServer:     "https://headscale.example.com",
+				Resources:       resources,
+				ExtraArgs:       []string{"--accept-dns=false"},
+				NodeMode:        v1alpha1.Reusable,
+				AdvertiseRoutes: []string{"10.96.0.0/12"},
+				AcceptRoutes:    ptr.To(true),
+			}),
+		},
+	}
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "apps",
+		Labels:    map[string]string{"app": "web"},
+		Annotations: map[string]string{
+			UserNameAnnotation:        "sammm",
+			EnableUserspaceAnnotation: "false",
+		},
+	}}
+
+	c, err := si.buildConfig(pod)
+	require.NoError(t, err)
+
+	assert.Equal(t, "web", c.policy)
+	assert.Equal(t, "sammm", c.user, "annotation overrides the policy")
+	assert.False(t, c.userspace, "annotation overrides the policy")
+	assert.Equal(t, []string{"web"}, c.tags)
+	assert.Equal(t, "ghcr.io/tailscale/tailscale:v1.80.0", c.image)
+	assert.Equal(t, *resources, c.resources)
+	assert.Equal(t, v1alpha1.Reusable, c.nodeMode)
+	assert.Equal(t, "https://headscale.example.com", c.serverURL, "keys are minted by the allowed login server")
+	assert.Equal(t, []string{
+		"--login-server=https://headscale.example.com",
+		"--advertise-routes=10.96.0.0/12",
+		"--accept-routes",
+		"--accept-dns=false",
+	}, c.TSExtraArgs())
+}
+
+func TestBuildConfigPolicyTags(t *testing.T) {
+	settings, err := injectorconfig.Parse([]byte(`allowedTags: {apps: [web]}`))
+	require.NoError(t, err)
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "apps",
+		Labels:    map[string]string{"app": "web"},
+	}}
+
+	tests := map[string]struct {
+		tags []string
+		err  error
+	}{
+		"allowed":     {tags: []string{"web"}},
+		"not allowed": {tags: []string{"web", "admin"}, err: ErrTagNotAllowed},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			si := sidecarInjector{
+				Logger:   logrus.New(),
+				Settings: settings,
+				Policies: staticPolicies{testPolicy("web", map[string]string{"app": "web"}, v1alpha1.TailscaleSidecarPolicySpec{Tags: tt.tags})},
+			}
+			c, err := si.buildConfig(pod)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.tags, c.tags)
+		})
+	}
+
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Settings: settings,
+		Policies: staticPolicies{testPolicy("web", map[string]string{"app": "web"}, v1alpha1.TailscaleSidecarPolicySpec{Tags: []string{"tag:web"}})},
+	}
+	_, err = si.buildConfig(pod)
+	assert.ErrorContains(t, err, "invalid tag")
+}
+
+func TestBuildConfigPolicyRoutes(t *testing.T) {
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "apps",
+		Labels:    map[string]string{"app": "web"},
+	}}
+
+	tests := map[string]struct {
+		spec v1alpha1.TailscaleSidecarPolicySpec
+		err  error
+	}{
+		"allowed route":         {spec: v1alpha1.TailscaleSidecarPolicySpec{AdvertiseRoutes: []string{"10.96.0.0/16"}}},
+		"wider than allowed":    {spec: v1alpha1.TailscaleSidecarPolicySpec{AdvertiseRoutes: []string{"10.0.0.0/8"}}, err: ErrRouteNotAllowed},
+		"default route":         {spec: v1alpha1.TailscaleSidecarPolicySpec{AdvertiseRoutes: []string{"0.0.0.0/0"}}, err: ErrInvalidRoutes},
+		"exit node not allowed": {spec: v1alpha1.TailscaleSidecarPolicySpec{AdvertiseExitNode: ptr.To(true)}, err: ErrRouteNotAllowed},
+		"not an exit node":      {spec: v1alpha1.TailscaleSidecarPolicySpec{AdvertiseExitNode: ptr.To(false)}},
+		"harmless extra args":   {spec: v1alpha1.TailscaleSidecarPolicySpec{ExtraArgs: []string{"--accept-dns=false", "--shields-up"}}},
+		"advertised routes arg": {spec: v1alpha1.TailscaleSidecarPolicySpec{ExtraArgs: []string{"--advertise-routes=10.0.0.0/8"}}, err: ErrExtraArgNotAllowed},
+		"advertised tags arg":   {spec: v1alpha1.TailscaleSidecarPolicySpec{ExtraArgs: []string{"--accept-dns=false -advertise-tags tag:admin"}}, err: ErrExtraArgNotAllowed},
+		"exit node arg":         {spec: v1alpha1.TailscaleSidecarPolicySpec{ExtraArgs: []string{"--advertise-exit-node"}}, err: ErrExtraArgNotAllowed},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			si := sidecarInjector{
+				Logger:   logrus.New(),
+				Settings: routesSettings(t),
+				Policies: staticPolicies{testPolicy("web", map[string]string{"app": "web"}, tt.spec)},
+			}
+			_, err := si.buildConfig(pod)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestBuildConfigNoPolicy(t *testing.T) {
+	si := sidecarInjector{Logger: logrus.New(), Policies: staticPolicies{}}
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "apps"}}
+
+	c, err := si.buildConfig(pod)
+	require.NoError(t, err)
+	assert.Empty(t, c.policy)
+	assert.Equal(t, injectorconfig.Default().ImageRef(), c.image)
+	assert.Equal(t, []string{"apps", "pod"}, c.tags)
+}
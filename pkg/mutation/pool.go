@@ -0,0 +1,279 @@
+package mutation
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// keyPoolInterval is how often pools are topped up and swept when no
+	// key is taken
+	keyPoolInterval = 30 * time.Second
+	// keyPoolDrainTimeout bounds expiring the unused keys on shutdown
+	keyPoolDrainTimeout = 10 * time.Second
+	// keyPoolIdleTimeout is how long a pool nobody asks a key of is kept
+	keyPoolIdleTimeout = 10 * time.Minute
+)
+
+// AuthKeyExpirer is implemented by providers able to revoke a key they
+// handed out, the pool uses it to expire the keys it never handed out
+type AuthKeyExpirer interface {
+	ExpireAuthKey(ctx context.Context, req AuthKeyRequest, key *AuthKey) error
+}
+
+// KeyPool keeps pre-minted keys ready for every user and set of tags pods
+// asked keys for, so admissions do not wait on the control server. Pools
+// are refilled in the background by Run, a pod finding its pool empty gets
+// a key minted synchronously by the provider. Pooled keys are minted for
+// as long as pods ask keys for, so a handed out key never outlives the
+// keyTTL of pods
+type KeyPool struct {
+	Provider AuthKeyProvider
+	Logger   logrus.FieldLogger
+	// Size is the number of ready keys kept per user and set of tags
+	Size int
+	// MaxAge is how long a pooled key waits to be handed out before it is
+	// replaced, pods are given keys valid for at least their TTL less
+	// MaxAge. It must be shorter than the TTL of the keys pods ask for
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*keyBucket
+	refill  chan struct{}
+}
+
+// keyBucket holds the ready keys of one kind of request
+type keyBucket struct {
+	req  AuthKeyRequest
+	keys []*AuthKey
+	// validity is how long the keys asked for must stay valid
+	validity time.Duration
+	lastUsed time.Time
+}
+
+var _ AuthKeyProvider = (*KeyPool)(nil)
+
+func NewKeyPool(logger logrus.FieldLogger, provider AuthKeyProvider, size int, maxAge time.Duration) *KeyPool {
+	return &KeyPool{
+		Provider: provider,
+		Logger:   logger,
+		Size:     size,
+		MaxAge:   maxAge,
+		buckets:  map[string]*keyBucket{},
+		refill:   make(chan struct{}, 1),
+	}
+}
+
+// Name is the name of the pooled provider
+func (p *KeyPool) Name() string {
+	return p.Provider.Name()
+}
+
+// AuthKey hands out a pooled key valid until the requested expiration,
+// falling back to the provider when there is none
+func (p *KeyPool) AuthKey(ctx context.Context, req AuthKeyRequest) (*AuthKey, error) {
+	if !pooled(req) {
+		return p.Provider.AuthKey(ctx, req)
+	}
+
+	now := time.Now()
+	id := bucketID(req)
+
+	p.mu.Lock()
+	b, ok := p.buckets[id]
+	if !ok {
+		b = &keyBucket{req: req}
+		b.req.Expiration = time.Time{}
+		p.buckets[id] = b
+	}
+	b.lastUsed = now
+	b.validity = req.Expiration.Sub(now)
+	key := b.take(req.Expiration, p.MaxAge)
+	p.mu.Unlock()
+
+	// whether we took a key or not the pool needs filling
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+
+	if key != nil {
+		metrics.KeyPoolRequests.WithLabelValues("hit").Inc()
+		metrics.KeyPoolReady.Dec()
+		return key, nil
+	}
+	metrics.KeyPoolRequests.WithLabelValues("miss").Inc()
+	return p.Provider.AuthKey(ctx, req)
+}
+
+// take removes and returns the first key expiring by expiration and no
+// more than maxAge before it
+func (b *keyBucket) take(expiration time.Time, maxAge time.Duration) *AuthKey {
+	for i, key := range b.keys {
+		if !key.Expiration.After(expiration) && key.Expiration.After(expiration.Add(-maxAge)) {
+			b.keys = append(b.keys[:i], b.keys[i+1:]...)
+			return key
+		}
+	}
+	return nil
+}
+
+// Run fills the pools whenever a key is taken and periodically, it blocks
+// until the context is cancelled then expires the keys left in the pools
+func (p *KeyPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(keyPoolInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), keyPoolDrainTimeout)
+			defer cancel()
+			if err := p.drain(drainCtx); err != nil {
+				p.Logger.Errorf("could not expire pooled keys: %v", err)
+			}
+			return
+		case <-ticker.C:
+		case <-p.refill:
+		}
+
+		p.fill(ctx, time.Now())
+	}
+}
+
+// fill drops the keys older than MaxAge and the pools nobody asked a key
+// of for keyPoolIdleTimeout, then mints keys until every pool holds Size
+// keys
+func (p *KeyPool) fill(ctx context.Context, now time.Time) {
+	var (
+		wg      sync.WaitGroup
+		expired []pooledKey
+	)
+
+	p.mu.Lock()
+	for id, b := range p.buckets {
+		if now.Sub(b.lastUsed) > keyPoolIdleTimeout {
+			for _, key := range b.keys {
+				expired = append(expired, pooledKey{b.req, key})
+			}
+			delete(p.buckets, id)
+			continue
+		}
+
+		var keep []*AuthKey
+		for _, key := range b.keys {
+			if key.Expiration.After(now.Add(b.validity - p.MaxAge)) {
+				keep = append(keep, key)
+			} else {
+				expired = append(expired, pooledKey{b.req, key})
+			}
+		}
+		b.keys = keep
+
+		if missing := p.Size - len(b.keys); missing > 0 {
+			wg.Add(1)
+			go func(req AuthKeyRequest, validity time.Duration) {
+				defer wg.Done()
+				p.mint(ctx, id, req, validity, missing)
+			}(b.req, b.validity)
+		}
+	}
+	p.mu.Unlock()
+	metrics.KeyPoolReady.Sub(float64(len(expired)))
+
+	if err := p.expire(ctx, expired); err != nil {
+		p.Logger.Warnf("could not expire stale pooled keys: %v", err)
+	}
+	wg.Wait()
+}
+
+// mint adds n keys valid for validity to the pool id
+func (p *KeyPool) mint(ctx context.Context, id string, req AuthKeyRequest, validity time.Duration, n int) {
+	for range n {
+		req.Expiration = time.Now().Add(validity)
+		key, err := p.Provider.AuthKey(ctx, req)
+		if err != nil {
+			p.Logger.Warnf("could not fill key pool of user %q: %v", req.User, err)
+			return
+		}
+
+		p.mu.Lock()
+		b, ok := p.buckets[id]
+		if ok {
+			b.keys = append(b.keys, key)
+			metrics.KeyPoolReady.Inc()
+		}
+		p.mu.Unlock()
+
+		if !ok {
+			// the pool was swept meanwhile
+			if err := p.expire(ctx, []pooledKey{{req, key}}); err != nil {
+				p.Logger.Warnf("could not expire pooled key: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// drain empties every pool, expiring the keys left
+func (p *KeyPool) drain(ctx context.Context) error {
+	var keys []pooledKey
+
+	p.mu.Lock()
+	for id, b := range p.buckets {
+		for _, key := range b.keys {
+			keys = append(keys, pooledKey{b.req, key})
+		}
+		delete(p.buckets, id)
+	}
+	p.mu.Unlock()
+	metrics.KeyPoolReady.Sub(float64(len(keys)))
+
+	return p.expire(ctx, keys)
+}
+
+type pooledKey struct {
+	req AuthKeyRequest
+	key *AuthKey
+}
+
+// expire revokes keys which were never handed out, when the provider
+// cannot they are left to expire
+func (p *KeyPool) expire(ctx context.Context, keys []pooledKey) error {
+	expirer, ok := p.Provider.(AuthKeyExpirer)
+	if !ok {
+		return nil
+	}
+
+	var errs []error
+	for _, k := range keys {
+		if err := expirer.ExpireAuthKey(ctx, k.req, k.key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pooled reports whether keys of req may be minted ahead of time, only
+// single use ephemeral keys are since they are what pods are given
+func pooled(req AuthKeyRequest) bool {
+	return req.Ephemeral && !req.Reusable
+}
+
+// bucketID identifies the requests a pooled key can be handed out for
+func bucketID(req AuthKeyRequest) string {
+	return strings.Join([]string{
+		req.ServerURL,
+		req.LoginServer,
+		req.User,
+		strings.Join(req.Tags, ","),
+		strconv.FormatBool(req.CreateUser),
+	}, "\x00")
+}
@@ -0,0 +1,124 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mintingProvider mints numbered keys and records the ones expired
+type mintingProvider struct {
+	mu      sync.Mutex
+	minted  int
+	expired []string
+}
+
+func (p *mintingProvider) Name() string {
+	return "minting"
+}
+
+func (p *mintingProvider) AuthKey(_ context.Context, req AuthKeyRequest) (*AuthKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.minted++
+	return &AuthKey{ID: fmt.Sprint(p.minted), Key: fmt.Sprintf("key-%d", p.minted), Expiration: req.Expiration}, nil
+}
+
+func (p *mintingProvider) ExpireAuthKey(_ context.Context, _ AuthKeyRequest, key *AuthKey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expired = append(p.expired, key.ID)
+	return nil
+}
+
+func TestKeyPool(t *testing.T) {
+	ctx := context.Background()
+	provider := &mintingProvider{}
+	pool := NewKeyPool(logrus.New(), provider, 2, time.Minute)
+	req := func(user string) AuthKeyRequest {
+		return AuthKeyRequest{User: user, Tags: []string{"tag:pod"}, Ephemeral: true, Expiration: time.Now().Add(2 * time.Minute)}
+	}
+
+	// the first pod of a user waits for its key
+	key, err := pool.AuthKey(ctx, req("sammm"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", key.ID)
+
+	pool.fill(ctx, time.Now())
+	assert.Equal(t, 3, provider.minted, "the pool is filled in the background")
+
+	want := req("sammm")
+	key, err = pool.AuthKey(ctx, want)
+	require.NoError(t, err)
+	assert.Equal(t, "2", key.ID, "pooled keys are handed out")
+	assert.False(t, key.Expiration.After(want.Expiration), "pooled keys do not outlive the keys pods ask for")
+	assert.True(t, key.Expiration.After(want.Expiration.Add(-time.Minute)))
+
+	key, err = pool.AuthKey(ctx, req("other"))
+	require.NoError(t, err)
+	assert.Equal(t, "4", key.ID, "keys are pooled per user")
+
+	reusable := req("sammm")
+	reusable.Reusable = true
+	key, err = pool.AuthKey(ctx, reusable)
+	require.NoError(t, err)
+	assert.Equal(t, "5", key.ID, "reusable keys are never pooled")
+
+	require.NoError(t, pool.drain(ctx))
+	assert.Equal(t, []string{"3"}, provider.expired, "unused keys are expired on shutdown")
+	assert.Empty(t, pool.buckets)
+}
+
+func TestKeyPoolSweep(t *testing.T) {
+	ctx := context.Background()
+	provider := &mintingProvider{}
+	pool := NewKeyPool(logrus.New(), provider, 1, time.Minute)
+	req := AuthKeyRequest{User: "sammm", Ephemeral: true, Expiration: time.Now().Add(2 * time.Minute)}
+
+	_, err := pool.AuthKey(ctx, req)
+	require.NoError(t, err)
+	pool.fill(ctx, time.Now())
+	require.Len(t, pool.buckets[bucketID(req)].keys, 1)
+
+	// keys older than MaxAge are replaced
+	pool.fill(ctx, time.Now().Add(30*time.Second))
+	assert.Empty(t, provider.expired)
+	pool.fill(ctx, time.Now().Add(61*time.Second))
+	assert.Equal(t, []string{"2"}, provider.expired)
+	require.Len(t, pool.buckets[bucketID(req)].keys, 1)
+	assert.Equal(t, "3", pool.buckets[bucketID(req)].keys[0].ID)
+
+	// pools nobody asked a key of are dropped
+	pool.fill(ctx, time.Now().Add(keyPoolIdleTimeout+time.Minute))
+	assert.Equal(t, []string{"2", "3"}, provider.expired)
+	assert.Empty(t, pool.buckets)
+}
+
+func TestKeyPoolRun(t *testing.T) {
+	provider := &mintingProvider{}
+	pool := NewKeyPool(logrus.New(), provider, 1, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+
+	_, err := pool.AuthKey(ctx, AuthKeyRequest{User: "sammm", Ephemeral: true, Expiration: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+		return provider.minted == 2
+	}, time.Second, 10*time.Millisecond, "taking a key refills the pool")
+
+	cancel()
+	<-done
+	assert.Equal(t, []string{"2"}, provider.expired)
+}
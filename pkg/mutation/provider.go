@@ -0,0 +1,279 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/tailscale"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AuthKeyRequest describes the pre-auth key wanted for a pod
+type AuthKeyRequest struct {
+	User        string   `json:"user,omitempty"`
+	Tags        []string `json:"tags,omitempty"` // ACL tags, including the "tag:" prefix
+	LoginServer string   `json:"loginServer,omitempty"`
+	// ServerURL is the API address of the control server, it is never
+	// taken from the pod
+	ServerURL  string    `json:"serverURL,omitempty"`
+	Reusable   bool      `json:"reusable,omitempty"`
+	Ephemeral  bool      `json:"ephemeral,omitempty"`
+	Expiration time.Time `json:"expiration"`
+	// CreateUser asks the provider to create User if it does not exist
+	CreateUser bool `json:"createUser,omitempty"`
+}
+
+// AuthKey is a pre-auth key handed out by an AuthKeyProvider
+type AuthKey struct {
+	ID         string
+	Key        string
+	Expiration time.Time
+	// SecretRef points at an existing secret holding the key, when set no
+	// secret is created for the pod and Key is empty
+	SecretRef *corev1.SecretKeySelector
+}
+
+// AuthKeyProvider is an interface implemented by every control-plane able
+// to hand out pre-auth keys to sidecars
+type AuthKeyProvider interface {
+	AuthKey(ctx context.Context, req AuthKeyRequest) (*AuthKey, error)
+	Name() string
+}
+
+const (
+	HeadscaleProviderName    string = "headscale"
+	TailscaleProviderName    string = "tailscale"
+	StaticSecretProviderName string = "static"
+)
+
+var ErrUnknownProvider error = fmt.Errorf("unknown auth key provider")
+
+// HeadscaleProvider mints pre-auth keys with the Headscale API. Without a
+// server in the request HEADSCALE_CLI_ADDRESS is used
+type HeadscaleProvider struct {
+	APIKey string
+	// Transport is headscale.TransportREST (the default) or TransportGRPC
+	Transport string
+	Insecure  bool
+	// Retry and Breaker configure the clients, zero values keep the
+	// defaults of the headscale package
+	Retry   headscale.RetryPolicy
+	Breaker headscale.BreakerPolicy
+
+	// clients caches up to maxClients clients by address so gRPC
+	// connections are reused
+	mu      sync.Mutex
+	clients map[string]*cachedClient
+	// users caches the users known to exist, by address and name
+	users sync.Map
+}
+
+var (
+	_ AuthKeyProvider = (*HeadscaleProvider)(nil)
+	_ AuthKeyExpirer  = (*HeadscaleProvider)(nil)
+)
+
+func (p *HeadscaleProvider) Name() string {
+	return HeadscaleProviderName
+}
+
+func (p *HeadscaleProvider) AuthKey(ctx context.Context, req AuthKeyRequest) (*AuthKey, error) {
+	address := req.ServerURL
+	client, err := p.client(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.CreateUser {
+		if err := p.ensureUser(ctx, client, address, req.User); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := client.PreAuthKeys().Create(ctx, req.User, req.Reusable, req.Ephemeral, req.Expiration, req.Tags)
+	switch {
+	case headscale.IsNotFound(err):
+		return nil, fmt.Errorf("user '%s' does not exist in headscale: %w", req.User, err)
+	case headscale.IsUnauthorized(err):
+		return nil, fmt.Errorf("headscale rejected the API key: %w", err)
+	case err != nil:
+		return nil, err
+	}
+
+	return &AuthKey{
+		ID:         resp.PreAuthKey.ID,
+		Key:        resp.PreAuthKey.Key,
+		Expiration: req.Expiration,
+	}, nil
+}
+
+func (p *HeadscaleProvider) ExpireAuthKey(ctx context.Context, req AuthKeyRequest, key *AuthKey) error {
+	client, err := p.client(ctx, req.ServerURL)
+	if err != nil {
+		return err
+	}
+	return client.PreAuthKeys().Expire(ctx, req.User, key.Key)
+}
+
+// maxClients bounds the clients cached by a HeadscaleProvider
+const maxClients = 16
+
+type cachedClient struct {
+	client   headscale.HeadscaleClient
+	lastUsed time.Time
+}
+
+// client returns the client for address, dialing it on first use. The least
+// recently used client is closed when too many are cached
+func (p *HeadscaleProvider) client(ctx context.Context, address string) (headscale.HeadscaleClient, error) {
+	p.mu.Lock()
+	if c, ok := p.clients[address]; ok {
+		c.lastUsed = time.Now()
+		p.mu.Unlock()
+		return c.client, nil
+	}
+	p.mu.Unlock()
+
+	c, err := headscale.Dial(ctx, headscale.Options{
+		Transport: p.Transport,
+		APIKey:    p.APIKey,
+		Address:   address,
+		Insecure:  p.Insecure,
+		Retry:     p.Retry,
+		Breaker:   p.Breaker,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// another admission may have raced us, only keep one client
+	if actual, ok := p.clients[address]; ok {
+		closeClient(c)
+		actual.lastUsed = time.Now()
+		return actual.client, nil
+	}
+	if p.clients == nil {
+		p.clients = map[string]*cachedClient{}
+	}
+	if len(p.clients) >= maxClients {
+		var oldest string
+		for a, cached := range p.clients {
+			if oldest == "" || cached.lastUsed.Before(p.clients[oldest].lastUsed) {
+				oldest = a
+			}
+		}
+		closeClient(p.clients[oldest].client)
+		delete(p.clients, oldest)
+	}
+	p.clients[address] = &cachedClient{client: c, lastUsed: time.Now()}
+	return c, nil
+}
+
+func closeClient(c headscale.HeadscaleClient) {
+	if closer, ok := c.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// ensureUser creates the user unless it already exists
+func (p *HeadscaleProvider) ensureUser(ctx context.Context, client headscale.HeadscaleClient, address, name string) error {
+	cacheKey := address + "/" + name
+	if _, ok := p.users.Load(cacheKey); ok {
+		return nil
+	}
+
+	users, err := client.Users().List(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list users: %w", err)
+	}
+	if !slices.ContainsFunc(users.Users, func(u headscale.User) bool { return u.Name == name }) {
+		// another replica may have created it since
+		if _, err := client.Users().Create(ctx, name); err != nil && !headscale.IsConflict(err) {
+			return fmt.Errorf("could not create user %q: %w", name, err)
+		}
+	}
+
+	p.users.Store(cacheKey, struct{}{})
+	return nil
+}
+
+// TailscaleProvider mints auth keys with the Tailscale SaaS API. Keys minted
+// by an OAuth client must be tagged and are always pre-authorized
+type TailscaleProvider struct {
+	Client *tailscale.Client
+}
+
+var (
+	_ AuthKeyProvider = (*TailscaleProvider)(nil)
+	_ AuthKeyExpirer  = (*TailscaleProvider)(nil)
+)
+
+func (p *TailscaleProvider) Name() string {
+	return TailscaleProviderName
+}
+
+func (p *TailscaleProvider) AuthKey(ctx context.Context, req AuthKeyRequest) (*AuthKey, error) {
+	create := tailscale.CreateKeyRequest{
+		ExpirySeconds: int64(time.Until(req.Expiration).Seconds()),
+		Description:   "tailscale-sidecar-injector",
+	}
+	create.Capabilities.Devices.Create = tailscale.KeyDeviceCreateCapabilities{
+		Reusable:      req.Reusable,
+		Ephemeral:     req.Ephemeral,
+		Preauthorized: true,
+		Tags:          req.Tags,
+	}
+
+	key, err := p.Client.Keys().Create(ctx, create)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthKey{
+		ID:         key.ID,
+		Key:        key.Key,
+		Expiration: key.Expires,
+	}, nil
+}
+
+func (p *TailscaleProvider) ExpireAuthKey(ctx context.Context, _ AuthKeyRequest, key *AuthKey) error {
+	return p.Client.Keys().Delete(ctx, key.ID)
+}
+
+// StaticSecretProvider hands out a key stored in an existing secret, the
+// secret must exist in the namespace of every injected pod
+type StaticSecretProvider struct {
+	SecretName string
+	Key        string
+}
+
+var _ AuthKeyProvider = (*StaticSecretProvider)(nil)
+
+func (p *StaticSecretProvider) Name() string {
+	return StaticSecretProviderName
+}
+
+func (p *StaticSecretProvider) AuthKey(_ context.Context, _ AuthKeyRequest) (*AuthKey, error) {
+	if p.SecretName == "" {
+		return nil, fmt.Errorf("%s provider: secret name must be provided", p.Name())
+	}
+
+	key := p.Key
+	if key == "" {
+		key = AuthKeySecretKey
+	}
+
+	return &AuthKey{
+		SecretRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: p.SecretName},
+			Key:                  key,
+		},
+	}, nil
+}
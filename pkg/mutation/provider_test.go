@@ -0,0 +1,229 @@
+package mutation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/tailscale"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHeadscaleProvider(t *testing.T) {
+	expiry := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/preauthkey", r.URL.Path)
+		assert.Equal(t, "Bearer hskey", r.Header.Get("Authorization"))
+
+		var req headscale.CreatePreAuthKeyRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "sammm", req.User)
+		assert.True(t, req.Ephemeral)
+		assert.Equal(t, []string{"tag:pod"}, req.AclTags)
+
+		json.NewEncoder(w).Encode(headscale.CreatePreAuthKeyResponse{
+			PreAuthKey: headscale.PreAuthKey{ID: "1", Key: "hs-key"},
+		})
+	}))
+	defer srv.Close()
+
+	p := &HeadscaleProvider{APIKey: "hskey"}
+	key, err := p.AuthKey(context.Background(), AuthKeyRequest{
+		User:        "sammm",
+		Tags:        []string{"tag:pod"},
+		LoginServer: "https://headscale.example.com",
+		ServerURL:   srv.URL,
+		Ephemeral:   true,
+		Expiration:  expiry,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &AuthKey{ID: "1", Key: "hs-key", Expiration: expiry}, key)
+}
+
+func TestHeadscaleProviderClientCache(t *testing.T) {
+	ctx := context.Background()
+	p := &HeadscaleProvider{APIKey: "hskey"}
+
+	first, err := p.client(ctx, "https://hs0.example.com")
+	require.NoError(t, err)
+	for i := 1; i <= maxClients; i++ {
+		_, err := p.client(ctx, fmt.Sprintf("https://hs%d.example.com", i))
+		require.NoError(t, err)
+	}
+	assert.Len(t, p.clients, maxClients, "the cache is bounded")
+	assert.NotContains(t, p.clients, "https://hs0.example.com", "the least recently used client is evicted")
+
+	again, err := p.client(ctx, "https://hs0.example.com")
+	require.NoError(t, err)
+	assert.NotSame(t, first, again)
+}
+
+func TestTailscaleProvider(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/api/v2/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		var req tailscale.CreateKeyRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(t, req.Capabilities.Devices.Create.Ephemeral)
+		assert.True(t, req.Capabilities.Devices.Create.Preauthorized)
+		assert.Equal(t, []string{"tag:pod"}, req.Capabilities.Devices.Create.Tags)
+
+		json.NewEncoder(w).Encode(tailscale.Key{ID: "k1", Key: "ts-key"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client, err := tailscale.New(context.Background(), "id", "secret", srv.URL)
+	require.NoError(t, err)
+
+	p := &TailscaleProvider{Client: client}
+	key, err := p.AuthKey(context.Background(), AuthKeyRequest{
+		Tags:       []string{"tag:pod"},
+		Ephemeral:  true,
+		Expiration: time.Now().Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "k1", key.ID)
+	assert.Equal(t, "ts-key", key.Key)
+}
+
+func TestStaticSecretProvider(t *testing.T) {
+	_, err := (&StaticSecretProvider{}).AuthKey(context.Background(), AuthKeyRequest{})
+	assert.Error(t, err)
+
+	key, err := (&StaticSecretProvider{SecretName: "shared"}).AuthKey(context.Background(), AuthKeyRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, key.Key)
+	assert.Equal(t, &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "shared"},
+		Key:                  AuthKeySecretKey,
+	}, key.SecretRef)
+}
+
+func TestMutateStaticSecretProvider(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "apps",
+			Labels:    map[string]string{InjectLabel: "true"},
+		},
+	}
+
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   client,
+		Provider: &StaticSecretProvider{SecretName: "shared", Key: "key"},
+	}
+	got, err := si.Mutate(context.Background(), pod)
+	require.NoError(t, err)
+	require.Len(t, got.Spec.InitContainers, 1)
+
+	var ref *corev1.SecretKeySelector
+	for _, env := range got.Spec.InitContainers[0].Env {
+		if env.Name == PreAuthKeyKey {
+			ref = env.ValueFrom.SecretKeyRef
+		}
+	}
+	require.NotNil(t, ref)
+	assert.Equal(t, "shared", ref.Name)
+	assert.Equal(t, "key", ref.Key)
+
+	// no per-pod secret is needed when referencing an existing one
+	secrets, err := client.CoreV1().Secrets("apps").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, secrets.Items)
+}
+
+func TestMutateHeadscaleProviderRecordsKey(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(headscale.CreatePreAuthKeyResponse{
+			PreAuthKey: headscale.PreAuthKey{ID: "7", Key: "hs-key"},
+		})
+	}))
+	defer srv.Close()
+
+	settings := injectorconfig.Default()
+	settings.Headscale.Address = srv.URL
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "apps",
+			Labels:      map[string]string{InjectLabel: "true"},
+			Annotations: map[string]string{UserNameAnnotation: "sammm"},
+		},
+	}
+
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   fake.NewSimpleClientset(testServiceAccount()),
+		Provider: &HeadscaleProvider{APIKey: "hskey"},
+		Settings: settings,
+	}
+	got, err := si.Mutate(context.Background(), pod)
+	require.NoError(t, err)
+	assert.Equal(t, "7", got.Annotations[AuthKeyIDAnnotation])
+	assert.Equal(t, "sammm", got.Annotations[AuthKeyUserAnnotation])
+	assert.Equal(t, []string{CleanupFinalizer}, got.Finalizers)
+}
+
+func TestHeadscaleProviderCreateUser(t *testing.T) {
+	var created []string
+	lists := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		lists++
+		json.NewEncoder(w).Encode(headscale.UsersResponse{Users: []headscale.User{{Name: "existing"}}})
+	})
+	mux.HandleFunc("POST /api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		var req headscale.CreateUserRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		created = append(created, req.Name)
+		json.NewEncoder(w).Encode(headscale.UserResponse{User: headscale.User{Name: req.Name}})
+	})
+	mux.HandleFunc("POST /api/v1/preauthkey", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(headscale.CreatePreAuthKeyResponse{PreAuthKey: headscale.PreAuthKey{ID: "1"}})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := &HeadscaleProvider{APIKey: "hskey"}
+	for _, user := range []string{"existing", "new", "new"} {
+		_, err := p.AuthKey(context.Background(), AuthKeyRequest{User: user, ServerURL: srv.URL, CreateUser: true})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"new"}, created)
+	// known users are cached
+	assert.Equal(t, 2, lists)
+}
+
+func TestHeadscaleProviderMissingUser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Headscale answers missing users with an unknown error
+		http.Error(w, `{"code":2,"message":"user not found","details":[]}`, http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p := &HeadscaleProvider{APIKey: "hskey"}
+	_, err := p.AuthKey(context.Background(), AuthKeyRequest{User: "foo", ServerURL: srv.URL})
+	assert.ErrorContains(t, err, "user 'foo' does not exist in headscale")
+	assert.True(t, headscale.IsNotFound(err))
+}
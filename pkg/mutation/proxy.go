@@ -0,0 +1,131 @@
+package mutation
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ProxyContainersAnnotation lists the containers of a userspace pod
+	// which reach the tailnet through the proxies of the sidecar, comma
+	// separated. Every container does by default and none when it is empty
+	ProxyContainersAnnotation string = "tailscale.iced.cool/proxy-containers"
+	// ProxiedContainersAnnotation records the containers given the proxy
+	// env when the pod was injected, containers added since by other
+	// webhooks are left alone when the sidecar is reconciled
+	ProxiedContainersAnnotation string = "tailscale.iced.cool/proxied-containers"
+	Socks5ServerKey             string = "TS_SOCKS5_SERVER"
+	HTTPProxyListenKey          string = "TS_OUTBOUND_HTTP_PROXY_LISTEN"
+)
+
+var ErrUnknownContainer error = fmt.Errorf("unknown container")
+
+// proxyContainers returns the containers of the pod given the proxy env,
+// named ones may also be init containers
+func proxyContainers(pod corev1.Pod, names []string) ([]string, error) {
+	if v, ok := pod.Annotations[ProxyContainersAnnotation]; ok {
+		names = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return []string{}, nil
+		}
+	}
+
+	if len(names) == 0 {
+		for _, c := range pod.Spec.Containers {
+			names = append(names, c.Name)
+		}
+		return names, nil
+	}
+
+	for _, name := range names {
+		if !slices.ContainsFunc(pod.Spec.Containers, named(name)) && !slices.ContainsFunc(pod.Spec.InitContainers, named(name)) {
+			return nil, fmt.Errorf("%w: %s: pod has no container %q", ErrUnknownContainer, ProxyContainersAnnotation, name)
+		}
+	}
+	return names, nil
+}
+
+// proxiedContainers returns the containers given the proxy env when the
+// pod was injected, and whether they were recorded
+func proxiedContainers(pod corev1.Pod) ([]string, bool) {
+	v, ok := pod.Annotations[ProxiedContainersAnnotation]
+	if !ok {
+		return nil, false
+	}
+	names := []string{}
+	for _, name := range strings.Split(v, ",") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
+
+func named(name string) func(corev1.Container) bool {
+	return func(c corev1.Container) bool {
+		return c.Name == name
+	}
+}
+
+// proxyAddress is where the proxies of the sidecar listen
+func (c *config) proxyAddress() string {
+	return "localhost:" + strconv.Itoa(int(c.proxyPort))
+}
+
+// proxyEnv points the usual proxy variables, in both cases as tools read
+// either, at the sidecar
+func (c *config) proxyEnv() []corev1.EnvVar {
+	socks := "socks5://" + c.proxyAddress()
+	httpProxy := "http://" + c.proxyAddress()
+	noProxy := strings.Join(c.noProxy, ",")
+
+	var env []corev1.EnvVar
+	for _, v := range []struct{ name, value string }{
+		{"ALL_PROXY", socks},
+		{"HTTP_PROXY", httpProxy},
+		{"HTTPS_PROXY", httpProxy},
+		{"NO_PROXY", noProxy},
+	} {
+		env = append(env,
+			corev1.EnvVar{Name: v.name, Value: v.value},
+			corev1.EnvVar{Name: strings.ToLower(v.name), Value: v.value},
+		)
+	}
+	return env
+}
+
+// injectProxyEnv adds the proxy env to the proxied containers and records
+// them, variables a container sets itself are left alone
+func injectProxyEnv(pod *corev1.Pod, c *config) {
+	if c.proxyContainers == nil {
+		delete(pod.Annotations, ProxiedContainersAnnotation)
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[ProxiedContainersAnnotation] = strings.Join(c.proxyContainers, ",")
+
+	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for i := range containers {
+			container := &containers[i]
+			if !slices.Contains(c.proxyContainers, container.Name) {
+				continue
+			}
+			for _, e := range c.proxyEnv() {
+				if !slices.ContainsFunc(container.Env, func(v corev1.EnvVar) bool { return v.Name == e.Name }) {
+					container.Env = append(container.Env, e)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package mutation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func proxyPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "apps",
+			Labels:      map[string]string{InjectLabel: "true"},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "migrate"}},
+			Containers: []corev1.Container{
+				{Name: "web", Env: []corev1.EnvVar{{Name: "NO_PROXY", Value: "example.com"}}},
+				{Name: "metrics"},
+			},
+		},
+	}
+}
+
+func env(c corev1.Container) map[string]string {
+	m := map[string]string{}
+	for _, e := range c.Env {
+		m[e.Name] = e.Value
+	}
+	return m
+}
+
+func TestProxyContainers(t *testing.T) {
+	got, err := proxyContainers(*proxyPod(nil), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web", "metrics"}, got, "every container by default")
+
+	got, err = proxyContainers(*proxyPod(nil), []string{"migrate"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"migrate"}, got)
+
+	got, err = proxyContainers(*proxyPod(map[string]string{ProxyContainersAnnotation: "web, migrate"}), []string{"metrics"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web", "migrate"}, got, "annotation overrides the policy")
+
+	got, err = proxyContainers(*proxyPod(map[string]string{ProxyContainersAnnotation: ""}), nil)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	_, err = proxyContainers(*proxyPod(map[string]string{ProxyContainersAnnotation: "db"}), nil)
+	assert.ErrorIs(t, err, ErrUnknownContainer)
+}
+
+func TestMutateUserspaceProxy(t *testing.T) {
+	ctx := context.Background()
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   fake.NewSimpleClientset(testServiceAccount()),
+		Provider: &fakeProvider{key: &AuthKey{Key: "key"}},
+	}
+
+	got, err := si.Mutate(ctx, proxyPod(map[string]string{
+		EnableUserspaceAnnotation: "true",
+		ProxyContainersAnnotation: "web,migrate",
+	}))
+	require.NoError(t, err)
+
+	sidecar := env(got.Spec.InitContainers[0])
+	assert.Equal(t, "true", sidecar[UserspaceKey])
+	assert.Equal(t, "localhost:1055", sidecar[Socks5ServerKey])
+	assert.Equal(t, "localhost:1055", sidecar[HTTPProxyListenKey])
+
+	web := env(got.Spec.Containers[0])
+	assert.Equal(t, "socks5://localhost:1055", web["ALL_PROXY"])
+	assert.Equal(t, "http://localhost:1055", web["HTTP_PROXY"])
+	assert.Equal(t, "http://localhost:1055", web["https_proxy"])
+	assert.Equal(t, "example.com", web["NO_PROXY"], "variables set by the container are kept")
+	assert.Equal(t, "localhost,127.0.0.1,::1,.svc,.cluster.local", web["no_proxy"])
+	assert.Contains(t, env(got.Spec.InitContainers[1]), "ALL_PROXY")
+	assert.Empty(t, got.Spec.Containers[1].Env)
+
+	// pods with a tun device need no proxy
+	got, err = si.Mutate(ctx, proxyPod(nil))
+	require.NoError(t, err)
+	assert.NotContains(t, env(got.Spec.InitContainers[0]), Socks5ServerKey)
+	assert.Empty(t, got.Spec.Containers[1].Env)
+}
+
+func TestMutateReinvokedProxy(t *testing.T) {
+	ctx := context.Background()
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   fake.NewSimpleClientset(testServiceAccount()),
+		Provider: &fakeProvider{key: &AuthKey{Key: "key"}},
+	}
+
+	first, err := si.Mutate(ctx, proxyPod(map[string]string{EnableUserspaceAnnotation: "true"}))
+	require.NoError(t, err)
+	assert.Equal(t, "web,metrics", first.Annotations[ProxiedContainersAnnotation])
+
+	// another webhook adds its own container before we are reinvoked
+	first.Spec.Containers = append(first.Spec.Containers, corev1.Container{Name: "istio-proxy"})
+	again, err := si.Mutate(ctx, first)
+	require.NoError(t, err)
+	assert.Contains(t, env(again.Spec.Containers[1]), "ALL_PROXY")
+	assert.Empty(t, again.Spec.Containers[2].Env, "containers added since injection are not proxied")
+	assert.Equal(t, "web,metrics", again.Annotations[ProxiedContainersAnnotation])
+}
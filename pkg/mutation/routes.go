@@ -0,0 +1,165 @@
+package mutation
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// AdvertiseRoutesAnnotation lists the prefixes the pod routes the
+	// tailnet to, comma separated. It replaces the routes of the policy and
+	// each must be allowed for the namespace by the config
+	AdvertiseRoutesAnnotation string = "tailscale.iced.cool/advertise-routes"
+	// AdvertiseExitNodeAnnotation offers the pod as an exit node, the config
+	// must allow 0.0.0.0/0 and ::/0 for the namespace
+	AdvertiseExitNodeAnnotation string = "tailscale.iced.cool/advertise-exit-node"
+	// AcceptRoutesAnnotation routes the traffic of the pod to the subnets
+	// advertised by other nodes
+	AcceptRoutesAnnotation string = "tailscale.iced.cool/accept-routes"
+	// ExitNodeAnnotation is the IP or name of the exit node of the pod
+	ExitNodeAnnotation string = "tailscale.iced.cool/exit-node"
+	// ApproveRoutesAnnotation lists the routes of the pod the controller
+	// enables in Headscale once its node joined
+	ApproveRoutesAnnotation string = "tailscale.iced.cool/approve-routes"
+	// RoutesApprovedAnnotation records the routes the controller enabled
+	RoutesApprovedAnnotation string = "tailscale.iced.cool/routes-approved"
+)
+
+var (
+	ErrInvalidRoutes   error = fmt.Errorf("invalid routes")
+	ErrRouteNotAllowed error = fmt.Errorf("route not allowed")
+)
+
+// exitRoutes are the routes of exit nodes
+var exitRoutes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/0"),
+	netip.MustParsePrefix("::/0"),
+}
+
+// applyRouteAnnotations overrides the routing of the config with the
+// annotations of the pod, the routes it advertises must be allowed in its
+// namespace like those of policies
+func (c *config) applyRouteAnnotations(pod corev1.Pod, settings *injectorconfig.Config) error {
+	if v, ok := pod.Annotations[AdvertiseRoutesAnnotation]; ok {
+		routes, err := parseRoutes(strings.Split(v, ","))
+		if err != nil {
+			return fmt.Errorf("%s: %w", AdvertiseRoutesAnnotation, err)
+		}
+		if err := routesAllowed(settings, pod.Namespace, routes, false); err != nil {
+			return err
+		}
+		c.advertiseRoutes = prefixStrings(routes)
+	}
+
+	if _, ok := pod.Annotations[AdvertiseExitNodeAnnotation]; ok {
+		c.advertiseExit = getBoolAnnotation(pod, AdvertiseExitNodeAnnotation, false)
+		if err := routesAllowed(settings, pod.Namespace, nil, c.advertiseExit); err != nil {
+			return err
+		}
+	}
+
+	c.acceptRoutes = getBoolAnnotation(pod, AcceptRoutesAnnotation, c.acceptRoutes)
+	c.exitNode = strings.TrimSpace(getAnnotation(pod, ExitNodeAnnotation, c.exitNode))
+	return c.validateRoutes()
+}
+
+// routesAllowed checks pods in namespace may advertise routes, and be exit
+// nodes when exit is set
+func routesAllowed(settings *injectorconfig.Config, namespace string, routes []netip.Prefix, exit bool) error {
+	for _, route := range routes {
+		if !settings.RouteAllowed(namespace, route) {
+			return fmt.Errorf("%w: pods in namespace %q may not advertise %s", ErrRouteNotAllowed, namespace, route)
+		}
+	}
+	for _, route := range exitRoutes {
+		if exit && !settings.RouteAllowed(namespace, route) {
+			return fmt.Errorf("%w: pods in namespace %q may not be exit nodes", ErrRouteNotAllowed, namespace)
+		}
+	}
+	return nil
+}
+
+// validateRoutes checks the routing of the config, whether it comes from
+// a policy or annotations, and normalises the advertised routes
+func (c *config) validateRoutes() error {
+	routes, err := parseRoutes(c.advertiseRoutes)
+	if err != nil {
+		return err
+	}
+	c.advertiseRoutes = prefixStrings(routes)
+
+	if c.exitNode == "" {
+		return nil
+	}
+	if c.advertiseExit {
+		return fmt.Errorf("%w: an exit node cannot use another exit node", ErrInvalidRoutes)
+	}
+	if _, err := netip.ParseAddr(c.exitNode); err != nil {
+		if msgs := validation.IsDNS1123Subdomain(strings.ToLower(c.exitNode)); len(msgs) > 0 {
+			return fmt.Errorf("%w: exit node %q is neither an IP nor a name", ErrInvalidRoutes, c.exitNode)
+		}
+	}
+	return nil
+}
+
+// parseRoutes parses prefixes, masking their host bits. Default routes are
+// rejected as only exit nodes may advertise them
+func parseRoutes(routes []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, route := range routes {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(route)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRoutes, err)
+		}
+		if p.Bits() == 0 {
+			return nil, fmt.Errorf("%w: %s is a default route, advertise an exit node instead", ErrInvalidRoutes, p)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	var s []string
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+	return s
+}
+
+// routes returns every route the node advertises
+func (c *config) routes() []string {
+	routes := slices.Clone(c.advertiseRoutes)
+	if c.advertiseExit {
+		routes = append(routes, prefixStrings(exitRoutes)...)
+	}
+	return routes
+}
+
+// routeArgs are the tailscale up flags of the routing of the node
+func (c *config) routeArgs() []string {
+	var args []string
+	if len(c.advertiseRoutes) > 0 {
+		args = append(args, fmt.Sprintf("--advertise-routes=%s", strings.Join(c.advertiseRoutes, ",")))
+	}
+	if c.advertiseExit {
+		args = append(args, "--advertise-exit-node")
+	}
+	if c.acceptRoutes {
+		args = append(args, "--accept-routes")
+	}
+	if c.exitNode != "" {
+		args = append(args, fmt.Sprintf("--exit-node=%s", c.exitNode))
+	}
+	return args
+}
@@ -0,0 +1,118 @@
+package mutation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/headscale"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func routesSettings(t *testing.T) *injectorconfig.Config {
+	t.Helper()
+	settings, err := injectorconfig.Parse([]byte(`
+routes:
+  allowed:
+    apps: [10.96.0.0/12]
+    egress: [0.0.0.0/0, "::/0"]
+`))
+	require.NoError(t, err)
+	return settings
+}
+
+func routesPod(namespace string, annotations map[string]string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   namespace,
+			Labels:      map[string]string{InjectLabel: "true"},
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestBuildConfigRoutes(t *testing.T) {
+	si := sidecarInjector{Settings: routesSettings(t)}
+
+	c, err := si.buildConfig(routesPod("egress", map[string]string{
+		AdvertiseRoutesAnnotation:   "10.96.0.1/12, 10.100.0.0/16",
+		AdvertiseExitNodeAnnotation: "true",
+		AcceptRoutesAnnotation:      "true",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"--advertise-routes=10.96.0.0/12,10.100.0.0/16",
+		"--advertise-exit-node",
+		"--accept-routes",
+	}, c.TSExtraArgs())
+	assert.Equal(t, []string{"10.96.0.0/12", "10.100.0.0/16", "0.0.0.0/0", "::/0"}, c.routes())
+
+	c, err = si.buildConfig(routesPod("db", map[string]string{ExitNodeAnnotation: "100.64.0.1"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--exit-node=100.64.0.1"}, c.TSExtraArgs(), "using an exit node needs no allowed route")
+
+	invalid := map[string]struct {
+		namespace   string
+		annotations map[string]string
+		err         error
+	}{
+		"not a prefix":          {"apps", map[string]string{AdvertiseRoutesAnnotation: "10.96.0.1"}, ErrInvalidRoutes},
+		"default route":         {"egress", map[string]string{AdvertiseRoutesAnnotation: "0.0.0.0/0"}, ErrInvalidRoutes},
+		"wider than allowed":    {"apps", map[string]string{AdvertiseRoutesAnnotation: "10.0.0.0/8"}, ErrRouteNotAllowed},
+		"other namespace":       {"db", map[string]string{AdvertiseRoutesAnnotation: "10.96.0.0/12"}, ErrRouteNotAllowed},
+		"exit node not allowed": {"apps", map[string]string{AdvertiseExitNodeAnnotation: "true"}, ErrRouteNotAllowed},
+		"exit node of exit node": {"egress", map[string]string{
+			AdvertiseExitNodeAnnotation: "true",
+			ExitNodeAnnotation:          "exit",
+		}, ErrInvalidRoutes},
+		"bad exit node": {"apps", map[string]string{ExitNodeAnnotation: "exit node"}, ErrInvalidRoutes},
+	}
+	for name, tt := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := si.buildConfig(routesPod(tt.namespace, tt.annotations))
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestMutateApprovesRoutes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(headscale.CreatePreAuthKeyResponse{
+			PreAuthKey: headscale.PreAuthKey{ID: "7", Key: "hs-key"},
+		})
+	}))
+	defer srv.Close()
+
+	settings := routesSettings(t)
+	settings.Headscale.Address = srv.URL
+	settings.Routes.AutoApprove = true
+	pod := routesPod("apps", map[string]string{
+		UserNameAnnotation:        "sammm",
+		AdvertiseRoutesAnnotation: "10.96.0.0/12",
+	})
+
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   fake.NewSimpleClientset(testServiceAccount()),
+		Provider: &HeadscaleProvider{APIKey: "hskey"},
+		Settings: settings,
+	}
+	got, err := si.Mutate(context.Background(), &pod)
+	require.NoError(t, err)
+	assert.Equal(t, "10.96.0.0/12", got.Annotations[ApproveRoutesAnnotation])
+	assert.Equal(t, "7", got.Annotations[AuthKeyIDAnnotation])
+
+	settings.Routes.AutoApprove = false
+	got, err = si.Mutate(context.Background(), &pod)
+	require.NoError(t, err)
+	assert.NotContains(t, got.Annotations, ApproveRoutesAnnotation)
+}
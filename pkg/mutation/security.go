@@ -0,0 +1,98 @@
+package mutation
+
+import (
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// PodSecurityEnforceLabel is the Pod Security level enforced in a
+	// namespace
+	PodSecurityEnforceLabel string = "pod-security.kubernetes.io/enforce"
+
+	tunVolumeName string = "tailscale-tun"
+	tunDevicePath string = "/dev/net/tun"
+	// nonRootUser runs userspace sidecars, which need no capability
+	nonRootUser int64 = 1000
+)
+
+// podSecurityLevel returns the Pod Security level enforced in a namespace,
+// or an empty string when it cannot be told and the configured default
+// applies
+func podSecurityLevel(ns *corev1.Namespace) string {
+	if ns == nil {
+		return ""
+	}
+	return ns.Labels[PodSecurityEnforceLabel]
+}
+
+// tunAllowed reports whether sidecars may use a tun device at a Pod
+// Security level, it takes capabilities and a host device only privileged
+// pods are granted
+func tunAllowed(level string) bool {
+	return level == injectorconfig.PodSecurityPrivileged
+}
+
+// securityContext grants the sidecar the least it needs: NET_ADMIN and
+// NET_RAW to drive the tun device and the firewall, nothing at all in
+// userspace where it complies with the restricted level
+func (c *config) securityContext() *corev1.SecurityContext {
+	if c.userspace {
+		return &corev1.SecurityContext{
+			RunAsNonRoot:             ptr.To(true),
+			RunAsUser:                ptr.To(nonRootUser),
+			RunAsGroup:               ptr.To(nonRootUser),
+			AllowPrivilegeEscalation: ptr.To(false),
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+			},
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			},
+		}
+	}
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: ptr.To(false),
+		Capabilities: &corev1.Capabilities{
+			Add: []corev1.Capability{"NET_ADMIN", "NET_RAW"},
+		},
+	}
+}
+
+// sidecarResources adds the tun device of the device plugin to the
+// resources of the sidecar
+func (c *config) sidecarResources() corev1.ResourceRequirements {
+	resources := *c.resources.DeepCopy()
+	if c.userspace || c.tunDeviceResource == "" {
+		return resources
+	}
+
+	name := corev1.ResourceName(c.tunDeviceResource)
+	for _, list := range []*corev1.ResourceList{&resources.Requests, &resources.Limits} {
+		if *list == nil {
+			*list = corev1.ResourceList{}
+		}
+		(*list)[name] = resource.MustParse("1")
+	}
+	return resources
+}
+
+// mountsTun reports whether the tun device is mounted from the host
+func (c *config) mountsTun() bool {
+	return !c.userspace && c.tunDeviceResource == ""
+}
+
+// tunVolume is the tun device of the host
+func tunVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: tunVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: tunDevicePath,
+				Type: ptr.To(corev1.HostPathCharDev),
+			},
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package mutation
+
+import (
+	"context"
+	"testing"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testNamespace(level string) *corev1.Namespace {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}}
+	if level != "" {
+		ns.Labels = map[string]string{PodSecurityEnforceLabel: level}
+	}
+	return ns
+}
+
+func TestMutateTun(t *testing.T) {
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   fake.NewSimpleClientset(testServiceAccount(), testNamespace("")),
+		Provider: &fakeProvider{key: &AuthKey{Key: "key"}},
+	}
+
+	got, err := si.Mutate(context.Background(), proxyPod(nil))
+	require.NoError(t, err)
+
+	sidecar := got.Spec.InitContainers[0]
+	assert.Nil(t, sidecar.SecurityContext.Privileged)
+	assert.Equal(t, []corev1.Capability{"NET_ADMIN", "NET_RAW"}, sidecar.SecurityContext.Capabilities.Add)
+	assert.Equal(t, "false", env(sidecar)[UserspaceKey])
+	assert.Contains(t, sidecar.VolumeMounts, corev1.VolumeMount{Name: tunVolumeName, MountPath: tunDevicePath})
+	assert.Contains(t, got.Spec.Volumes, tunVolume())
+}
+
+func TestMutateTunDevicePlugin(t *testing.T) {
+	settings := injectorconfig.Default()
+	settings.PodSecurity.TunDeviceResource = "squat.ai/tun"
+	si := sidecarInjector{
+		Logger:   logrus.New(),
+		Client:   fake.NewSimpleClientset(testServiceAccount(), testNamespace("")),
+		Provider: &fakeProvider{key: &AuthKey{Key: "key"}},
+		Settings: settings,
+	}
+
+	got, err := si.Mutate(context.Background(), proxyPod(nil))
+	require.NoError(t, err)
+
+	sidecar := got.Spec.InitContainers[0]
+	assert.Equal(t, resource.MustParse("1"), sidecar.Resources.Limits["squat.ai/tun"])
+	assert.Empty(t, sidecar.VolumeMounts)
+	assert.Empty(t, got.Spec.Volumes)
+}
+
+func TestMutateUserspaceFallback(t *testing.T) {
+	restricted := injectorconfig.Default()
+	restricted.PodSecurity.DefaultLevel = injectorconfig.PodSecurityRestricted
+
+	tests := map[string]struct {
+		namespace *corev1.Namespace
+		settings  *injectorconfig.Config
+	}{
+		"baseline namespace":   {testNamespace("baseline"), nil},
+		"restricted namespace": {testNamespace("restricted"), nil},
+		"restricted default":   {testNamespace(""), restricted},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			report := &Result{}
+			si := sidecarInjector{
+				Logger:   logrus.New(),
+				Client:   fake.NewSimpleClientset(testServiceAccount(), tt.namespace),
+				Provider: &fakeProvider{key: &AuthKey{Key: "key"}},
+				Settings: tt.settings,
+				Report:   report,
+			}
+
+			got, err := si.Mutate(context.Background(), proxyPod(nil))
+			require.NoError(t, err)
+
+			sidecar := got.Spec.InitContainers[0]
+			assert.Equal(t, "true", env(sidecar)[UserspaceKey])
+			assert.True(t, *sidecar.SecurityContext.RunAsNonRoot)
+			assert.False(t, *sidecar.SecurityContext.AllowPrivilegeEscalation)
+			assert.Equal(t, []corev1.Capability{"ALL"}, sidecar.SecurityContext.Capabilities.Drop)
+			assert.Empty(t, sidecar.SecurityContext.Capabilities.Add)
+			assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, sidecar.SecurityContext.SeccompProfile.Type)
+			assert.Empty(t, got.Spec.Volumes)
+			assert.Contains(t, env(got.Spec.Containers[1]), "ALL_PROXY", "apps reach the tailnet through the proxy")
+			assert.Len(t, report.Warnings, 1)
+		})
+	}
+}
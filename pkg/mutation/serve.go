@@ -0,0 +1,251 @@
+package mutation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// ServeAnnotation lists the ports published with tailscale serve as
+	// <protocol>:<port>[=<container port>], comma separated, e.g.
+	// "https:443=http,tcp:5432". It replaces the ports of the policy
+	ServeAnnotation string = "tailscale.iced.cool/serve"
+	// FunnelAnnotation lists the served ports also published on the
+	// internet, comma separated
+	FunnelAnnotation string = "tailscale.iced.cool/funnel"
+	ServeConfigKey   string = "TS_SERVE_CONFIG"
+
+	serveVolumeName   string = "tailscale-serve"
+	serveMountPath    string = "/etc/tailscale/serve"
+	serveConfigFile   string = "serve.json"
+	serveConfigPrefix string = "tailscale-serve-"
+	// certDomain is replaced by containerboot with the MagicDNS name of
+	// the node
+	certDomain string = "${TS_CERT_DOMAIN}"
+)
+
+var ErrInvalidServe error = fmt.Errorf("invalid serve config")
+
+// funnelPorts are the only ports Tailscale funnels
+var funnelPorts = []int32{443, 8443, 10000}
+
+// serveConfig is the subset of the ipn.ServeConfig of tailscale which
+// TS_SERVE_CONFIG is read into
+type serveConfig struct {
+	TCP         map[string]*tcpPortHandler  `json:"TCP,omitempty"`
+	Web         map[string]*webServerConfig `json:"Web,omitempty"`
+	AllowFunnel map[string]bool             `json:"AllowFunnel,omitempty"`
+}
+
+type tcpPortHandler struct {
+	HTTPS      bool   `json:"HTTPS,omitempty"`
+	HTTP       bool   `json:"HTTP,omitempty"`
+	TCPForward string `json:"TCPForward,omitempty"`
+}
+
+type webServerConfig struct {
+	Handlers map[string]*httpHandler `json:"Handlers"`
+}
+
+type httpHandler struct {
+	Proxy string `json:"Proxy"`
+}
+
+// parseServeAnnotations returns the ports the pod asks to publish, or nil
+// when it does not set the serve annotation
+func parseServeAnnotations(pod corev1.Pod) ([]v1alpha1.ServePort, error) {
+	v, ok := pod.Annotations[ServeAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	funnel := map[string]bool{}
+	for _, p := range strings.Split(pod.Annotations[FunnelAnnotation], ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			funnel[p] = true
+		}
+	}
+
+	ports := []v1alpha1.ServePort{}
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		protocol, rest, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s: %q is not <protocol>:<port>[=<container port>]", ErrInvalidServe, ServeAnnotation, entry)
+		}
+		port, target, _ := strings.Cut(rest, "=")
+		n, err := strconv.ParseInt(port, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: invalid port %q", ErrInvalidServe, ServeAnnotation, port)
+		}
+
+		sp := v1alpha1.ServePort{
+			Protocol: v1alpha1.ServeProtocol(protocol),
+			Port:     int32(n),
+			Funnel:   funnel[port],
+		}
+		if target != "" {
+			sp.TargetPort = intstr.Parse(target)
+		}
+		ports = append(ports, sp)
+		delete(funnel, port)
+	}
+
+	if len(funnel) > 0 {
+		return nil, fmt.Errorf("%w: %s: ports %v are not served", ErrInvalidServe, FunnelAnnotation, slices.Sorted(maps.Keys(funnel)))
+	}
+	return ports, nil
+}
+
+// buildServeConfig renders the serve config of the pod, container ports
+// are looked up by name in the containers of the pod
+func buildServeConfig(pod *corev1.Pod, ports []v1alpha1.ServePort) (*serveConfig, error) {
+	sc := &serveConfig{TCP: map[string]*tcpPortHandler{}}
+
+	for _, p := range ports {
+		if p.Port < 1 || p.Port > 65535 {
+			return nil, fmt.Errorf("%w: invalid port %d", ErrInvalidServe, p.Port)
+		}
+		port := strconv.Itoa(int(p.Port))
+		if _, ok := sc.TCP[port]; ok {
+			return nil, fmt.Errorf("%w: port %d is served twice", ErrInvalidServe, p.Port)
+		}
+		target, err := containerPort(pod, p)
+		if err != nil {
+			return nil, err
+		}
+		if p.Funnel && (p.Protocol != v1alpha1.ServeHTTPS || !slices.Contains(funnelPorts, p.Port)) {
+			return nil, fmt.Errorf("%w: only https ports %v can be funneled", ErrInvalidServe, funnelPorts)
+		}
+
+		hostPort := certDomain + ":" + port
+		backend := "127.0.0.1:" + strconv.Itoa(int(target))
+		switch p.Protocol {
+		case v1alpha1.ServeHTTP, v1alpha1.ServeHTTPS:
+			sc.TCP[port] = &tcpPortHandler{HTTP: p.Protocol == v1alpha1.ServeHTTP, HTTPS: p.Protocol == v1alpha1.ServeHTTPS}
+			if sc.Web == nil {
+				sc.Web = map[string]*webServerConfig{}
+			}
+			sc.Web[hostPort] = &webServerConfig{Handlers: map[string]*httpHandler{
+				"/": {Proxy: "http://" + backend},
+			}}
+		case v1alpha1.ServeTCP:
+			sc.TCP[port] = &tcpPortHandler{TCPForward: backend}
+		default:
+			return nil, fmt.Errorf("%w: unknown protocol %q", ErrInvalidServe, p.Protocol)
+		}
+
+		if p.Funnel {
+			if sc.AllowFunnel == nil {
+				sc.AllowFunnel = map[string]bool{}
+			}
+			sc.AllowFunnel[hostPort] = true
+		}
+	}
+	return sc, nil
+}
+
+// containerPort resolves the target port of p
+func containerPort(pod *corev1.Pod, p v1alpha1.ServePort) (int32, error) {
+	switch {
+	case p.TargetPort.Type == intstr.String && p.TargetPort.StrVal != "":
+		for _, c := range pod.Spec.Containers {
+			for _, cp := range c.Ports {
+				if cp.Name == p.TargetPort.StrVal {
+					return cp.ContainerPort, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("%w: no container port named %q", ErrInvalidServe, p.TargetPort.StrVal)
+	case p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal != 0:
+		if p.TargetPort.IntVal < 1 || p.TargetPort.IntVal > 65535 {
+			return 0, fmt.Errorf("%w: invalid target port %d", ErrInvalidServe, p.TargetPort.IntVal)
+		}
+		return p.TargetPort.IntVal, nil
+	}
+	return p.Port, nil
+}
+
+// ensureServeConfigMap creates the configmap holding a serve config and
+// returns its name. It is named after its content so pods with the same
+// config share it, and owned by the service account of the pod
+func ensureServeConfigMap(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod, sc *serveConfig) (string, error) {
+	if client == nil {
+		return "", ErrClientNil
+	}
+
+	name, err := serveConfigMapName(sc)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return "", err
+	}
+
+	owner, err := serviceAccountOwner(ctx, client, pod)
+	if err != nil {
+		return "", err
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByValue,
+			},
+			OwnerReferences: []metav1.OwnerReference{*owner},
+		},
+		Immutable: ptr.To(true),
+		Data: map[string]string{
+			serveConfigFile: string(data),
+		},
+	}
+
+	_, err = client.CoreV1().ConfigMaps(pod.Namespace).Create(ctx, cm, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("could not create serve configmap: %w", err)
+	}
+	return cm.Name, nil
+}
+
+// serveConfigMapName names the configmap of a serve config after its content
+func serveConfigMapName(sc *serveConfig) (string, error) {
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return serveConfigPrefix + hex.EncodeToString(sum[:])[:10], nil
+}
+
+// serveVolume mounts the serve config into the sidecar
+func serveVolume(configMap string) corev1.Volume {
+	return corev1.Volume{
+		Name: serveVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMap},
+			},
+		},
+	}
+}
@@ -0,0 +1,114 @@
+package mutation
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func servePod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "apps",
+			Labels:      map[string]string{InjectLabel: "true"},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "web",
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+		}}},
+	}
+}
+
+func TestParseServeAnnotations(t *testing.T) {
+	ports, err := parseServeAnnotations(*servePod(map[string]string{
+		ServeAnnotation:  "https:443=http, tcp:5432, http:80=9090",
+		FunnelAnnotation: "443",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []v1alpha1.ServePort{
+		{Protocol: v1alpha1.ServeHTTPS, Port: 443, TargetPort: intstr.FromString("http"), Funnel: true},
+		{Protocol: v1alpha1.ServeTCP, Port: 5432},
+		{Protocol: v1alpha1.ServeHTTP, Port: 80, TargetPort: intstr.FromInt32(9090)},
+	}, ports)
+
+	ports, err = parseServeAnnotations(*servePod(nil))
+	require.NoError(t, err)
+	assert.Nil(t, ports, "the policy applies without the annotation")
+
+	for _, annotations := range []map[string]string{
+		{ServeAnnotation: "443"},
+		{ServeAnnotation: "https:web"},
+		{ServeAnnotation: "https:443", FunnelAnnotation: "8443"},
+	} {
+		_, err := parseServeAnnotations(*servePod(annotations))
+		assert.ErrorIs(t, err, ErrInvalidServe, annotations)
+	}
+}
+
+func TestBuildServeConfig(t *testing.T) {
+	pod := servePod(nil)
+	sc, err := buildServeConfig(pod, []v1alpha1.ServePort{
+		{Protocol: v1alpha1.ServeHTTPS, Port: 443, TargetPort: intstr.FromString("http"), Funnel: true},
+		{Protocol: v1alpha1.ServeTCP, Port: 5432},
+	})
+	require.NoError(t, err)
+
+	got, err := json.Marshal(sc)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"TCP": {"443": {"HTTPS": true}, "5432": {"TCPForward": "127.0.0.1:5432"}},
+		"Web": {"${TS_CERT_DOMAIN}:443": {"Handlers": {"/": {"Proxy": "http://127.0.0.1:8080"}}}},
+		"AllowFunnel": {"${TS_CERT_DOMAIN}:443": true}
+	}`, string(got))
+
+	invalid := map[string][]v1alpha1.ServePort{
+		"unknown port name":  {{Protocol: v1alpha1.ServeHTTP, Port: 80, TargetPort: intstr.FromString("metrics")}},
+		"served twice":       {{Protocol: v1alpha1.ServeHTTP, Port: 80}, {Protocol: v1alpha1.ServeTCP, Port: 80}},
+		"funnel over http":   {{Protocol: v1alpha1.ServeHTTP, Port: 443, Funnel: true}},
+		"funnel on any port": {{Protocol: v1alpha1.ServeHTTPS, Port: 8080, Funnel: true}},
+		"unknown protocol":   {{Protocol: "udp", Port: 53}},
+		"port out of range":  {{Protocol: v1alpha1.ServeTCP, Port: 70000}},
+	}
+	for name, ports := range invalid {
+		_, err := buildServeConfig(pod, ports)
+		assert.ErrorIs(t, err, ErrInvalidServe, name)
+	}
+}
+
+func TestMutateServe(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(testServiceAccount())
+	si := sidecarInjector{Logger: logrus.New(), Client: client, Provider: &fakeProvider{key: &AuthKey{Key: "key"}}}
+
+	got, err := si.Mutate(ctx, servePod(map[string]string{ServeAnnotation: "https:443=http"}))
+	require.NoError(t, err)
+
+	i := slices.IndexFunc(got.Spec.Volumes, func(v corev1.Volume) bool { return v.Name == serveVolumeName })
+	require.GreaterOrEqual(t, i, 0)
+	name := got.Spec.Volumes[i].ConfigMap.Name
+	sidecar := got.Spec.InitContainers[0]
+	assert.Contains(t, sidecar.Env, corev1.EnvVar{Name: ServeConfigKey, Value: "/etc/tailscale/serve/serve.json"})
+	assert.Contains(t, sidecar.VolumeMounts, corev1.VolumeMount{Name: serveVolumeName, MountPath: serveMountPath, ReadOnly: true})
+
+	cm, err := client.CoreV1().ConfigMaps("apps").Get(ctx, name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, cm.Data[serveConfigFile], "http://127.0.0.1:8080")
+	assert.Equal(t, "ServiceAccount", cm.OwnerReferences[0].Kind)
+
+	// pods publishing the same ports share the configmap
+	again, err := si.Mutate(ctx, servePod(map[string]string{ServeAnnotation: "https:443=http"}))
+	require.NoError(t, err)
+	assert.Contains(t, again.Spec.Volumes, serveVolume(name))
+}
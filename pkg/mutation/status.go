@@ -0,0 +1,104 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SidecarName is the name of the injected init container
+	SidecarName string = "tailscale"
+	// StatusAnnotation marks the pods the sidecar was injected into, later
+	// admissions of the pod reconcile the sidecar instead of adding another
+	StatusAnnotation string = "tailscale.iced.cool/status"
+	StatusInjected   string = "injected"
+	// VersionAnnotation records the version of the injector which injected
+	// the sidecar
+	VersionAnnotation string = "tailscale.iced.cool/injector-version"
+)
+
+// Version of the injector, set at build time with
+// -ldflags "-X github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation.Version=..."
+var Version = "dev"
+
+var ErrSidecarNameTaken error = fmt.Errorf("container name taken")
+
+// injected reports whether the sidecar was already injected into the pod,
+// e.g. when the webhook is reinvoked after another webhook
+func injected(pod *corev1.Pod) bool {
+	return pod.Annotations[StatusAnnotation] == StatusInjected &&
+		slices.ContainsFunc(pod.Spec.InitContainers, named(SidecarName))
+}
+
+// checkSidecarName makes sure no container of the pod is named like the
+// sidecar, except for the sidecar of an injected template
+func checkSidecarName(pod *corev1.Pod) error {
+	if slices.ContainsFunc(pod.Spec.Containers, named(SidecarName)) {
+		return fmt.Errorf("%w: pod has a container named %q", ErrSidecarNameTaken, SidecarName)
+	}
+	if _, ok := pod.Annotations[TemplateAnnotation]; ok {
+		return nil
+	}
+	if slices.ContainsFunc(pod.Spec.InitContainers, named(SidecarName)) {
+		return fmt.Errorf("%w: pod has an init container named %q", ErrSidecarNameTaken, SidecarName)
+	}
+	return nil
+}
+
+// markInjected records that the sidecar was injected into the pod. Pods
+// injected as their namespace or annotation asked are labelled like those
+// which opted in with InjectLabel, the controller only watches the label
+func markInjected(pod *corev1.Pod) {
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[StatusAnnotation] = StatusInjected
+	pod.Annotations[VersionAnnotation] = Version
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels[InjectLabel] = "true"
+}
+
+// reconcile brings the sidecar of an injected pod up to date. The pod keeps
+// what it was given when first injected: its pre-auth key, hostname and
+// state secret. The pod security level of its namespace is already known
+func (si sidecarInjector) reconcile(ctx context.Context, pod *corev1.Pod) (*corev1.Pod, error) {
+	si.Logger.Infof("reconciling the sidecar of %s", pod.Name)
+
+	// like for templates the identity of the pod is not rebuilt
+	si.template = true
+	c, err := si.buildConfig(*pod)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecar := pod.Spec.InitContainers[slices.IndexFunc(pod.Spec.InitContainers, named(SidecarName))]
+	for _, e := range sidecar.Env {
+		switch e.Name {
+		case PreAuthKeyKey:
+			if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil {
+				c.keyRef = e.ValueFrom.SecretKeyRef.DeepCopy()
+			}
+		case HostnameKey:
+			c.hostname = e.Value
+		case SecretNameKey:
+			c.secretName = e.Value
+		}
+	}
+
+	// containers added by other webhooks since are not proxied
+	if names, ok := proxiedContainers(*pod); ok && c.proxyContainers != nil {
+		c.proxyContainers = names
+	}
+
+	mpod, err := si.inject(ctx, pod, c)
+	if err != nil {
+		return nil, err
+	}
+	markInjected(mpod)
+	return mpod, nil
+}
@@ -0,0 +1,60 @@
+package mutation
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMutateReinvoked(t *testing.T) {
+	ctx := context.Background()
+	provider := &fakeProvider{key: &AuthKey{Key: "key"}}
+	si := sidecarInjector{Logger: logrus.New(), Client: fake.NewSimpleClientset(testServiceAccount()), Provider: provider}
+
+	pod := servePod(map[string]string{HostnameAnnotation: "{{.Name}}-{{.Suffix}}"})
+	first, err := si.Mutate(ctx, pod)
+	require.NoError(t, err)
+	assert.Equal(t, StatusInjected, first.Annotations[StatusAnnotation])
+	assert.Equal(t, Version, first.Annotations[VersionAnnotation])
+
+	// another webhook adds its own containers before we are reinvoked
+	first.Spec.InitContainers = append([]corev1.Container{{Name: "istio-init"}}, first.Spec.InitContainers...)
+	first.Spec.Containers = append(first.Spec.Containers, corev1.Container{Name: "istio-proxy"})
+	provider.err = errors.New("minted twice")
+
+	again, err := si.Mutate(ctx, first)
+	require.NoError(t, err, "the pod keeps its key")
+
+	var sidecars []corev1.Container
+	for _, c := range again.Spec.InitContainers {
+		if c.Name == SidecarName {
+			sidecars = append(sidecars, c)
+		}
+	}
+	require.Len(t, sidecars, 1)
+	assert.Equal(t, first.Spec.InitContainers[1].Env, sidecars[0].Env, "the sidecar keeps its key and hostname")
+	assert.Equal(t, "istio-init", again.Spec.InitContainers[0].Name)
+	assert.True(t, slices.ContainsFunc(again.Spec.Containers, named("istio-proxy")))
+}
+
+func TestMutateSidecarNameTaken(t *testing.T) {
+	si := sidecarInjector{Logger: logrus.New(), Client: fake.NewSimpleClientset(testServiceAccount()), Provider: &fakeProvider{key: &AuthKey{Key: "key"}}}
+
+	pod := servePod(nil)
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: SidecarName})
+	_, err := si.Mutate(context.Background(), pod)
+	assert.ErrorIs(t, err, ErrSidecarNameTaken)
+
+	// an init container of the name is only ours once marked
+	pod = servePod(nil)
+	pod.Spec.InitContainers = []corev1.Container{{Name: SidecarName}}
+	_, err = si.Mutate(context.Background(), pod)
+	assert.ErrorIs(t, err, ErrSidecarNameTaken)
+}
@@ -0,0 +1,87 @@
+package mutation
+
+import (
+	"context"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TemplateAnnotation marks the pod templates the sidecar was injected into,
+// the pods created from them get their own key and identity when admitted
+const TemplateAnnotation string = "tailscale.iced.cool/template"
+
+// MutateTemplate injects the sidecar into the pod template of a workload in
+// namespace, unless templates are not injected. The template is mutated in
+// place, dry runs write nothing
+func (m *Mutator) MutateTemplate(ctx context.Context, namespace string, tmpl *corev1.PodTemplateSpec, dryRun bool) (*Result, error) {
+	result := &Result{}
+
+	var settings *injectorconfig.Config
+	if m.Config != nil {
+		settings = m.Config.Get()
+	}
+	if settings == nil || !settings.InjectTemplates {
+		return result, nil
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: *tmpl.ObjectMeta.DeepCopy(),
+		Spec:       *tmpl.Spec.DeepCopy(),
+	}
+	pod.Namespace = namespace
+
+	si := sidecarInjector{
+		Logger:           logrus.WithField("namespace", namespace),
+		Client:           m.Client,
+		Provider:         m.Provider,
+		Policies:         m.Policies,
+		Namespaces:       m.Namespaces,
+		WebhookNamespace: m.WebhookNamespace,
+		Settings:         settings,
+		Report:           result,
+		DryRun:           dryRun,
+	}
+	mpod, err := si.mutateTemplate(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl.Labels = mpod.Labels
+	tmpl.Annotations = mpod.Annotations
+	tmpl.Spec = mpod.Spec
+	return result, nil
+}
+
+// mutateTemplate injects the sidecar into a pod template. What is specific
+// to a pod, its pre-auth key, hostname and state secret, is left to the
+// admission of the pods
+func (si sidecarInjector) mutateTemplate(ctx context.Context, pod *corev1.Pod) (*corev1.Pod, error) {
+	si.Logger = si.Logger.WithField("mutation", si.Name())
+
+	ns := si.namespace(ctx, pod.Namespace)
+	if ok, _ := si.injectionEnabled(pod, ns); !ok {
+		return pod, nil
+	}
+	if err := checkSidecarName(pod); err != nil {
+		return nil, err
+	}
+
+	si.template = true
+	si.podSecurity = podSecurityLevel(ns)
+	c, err := si.buildConfig(*pod)
+	if err != nil {
+		return nil, err
+	}
+
+	mpod, err := si.inject(ctx, pod, c)
+	if err != nil {
+		return nil, err
+	}
+	if mpod.Annotations == nil {
+		mpod.Annotations = map[string]string{}
+	}
+	mpod.Annotations[TemplateAnnotation] = "true"
+	return mpod, nil
+}
@@ -0,0 +1,97 @@
+package mutation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	injectorconfig "github.com/alam0rt/tailscale-sidecar-injector/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testStore(t *testing.T, config string) *injectorconfig.Store {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+	s, err := injectorconfig.NewStore(path)
+	require.NoError(t, err)
+	return s
+}
+
+func testTemplate() *corev1.PodTemplateSpec {
+	return &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{InjectLabel: "true", "app": "web"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web"}}},
+	}
+}
+
+func TestMutateTemplate(t *testing.T) {
+	ctx := context.Background()
+	provider := &fakeProvider{key: &AuthKey{ID: "1", Key: "key"}}
+	m := &Mutator{
+		Logger:   logrus.NewEntry(logrus.New()),
+		Client:   fake.NewSimpleClientset(testServiceAccount()),
+		Provider: provider,
+		Config:   testStore(t, "injectTemplates: true\nhostname: \"{{.OwnerName}}\""),
+	}
+
+	tmpl := testTemplate()
+	_, err := m.MutateTemplate(ctx, "apps", tmpl, false)
+	require.NoError(t, err)
+
+	require.Len(t, tmpl.Spec.InitContainers, 1)
+	sidecar := env(tmpl.Spec.InitContainers[0])
+	assert.Contains(t, sidecar, TSExtraArgs)
+	assert.NotContains(t, sidecar, PreAuthKeyKey, "keys are minted for pods")
+	assert.NotContains(t, sidecar, HostnameKey, "hostnames are rendered for pods")
+	assert.Equal(t, "true", tmpl.Annotations[TemplateAnnotation])
+	assert.Empty(t, tmpl.Namespace)
+	assert.Empty(t, provider.req.User)
+	assert.Contains(t, tmpl.Spec.Volumes, tunVolume())
+
+	// the pods of the template get their key and replace its sidecar
+	pod := &corev1.Pod{ObjectMeta: *tmpl.ObjectMeta.DeepCopy(), Spec: *tmpl.Spec.DeepCopy()}
+	pod.Name, pod.Namespace = "web-abcde", "apps"
+	result, err := m.MutatePodPatch(ctx, pod, false)
+	require.NoError(t, err)
+	assert.Contains(t, string(result.Patch), PreAuthKeyKey)
+	assert.NotContains(t, string(result.Patch), "/spec/volumes", "volumes are not added twice")
+	assert.NotContains(t, string(result.Patch), "/spec/initContainers/1", "the sidecar is not added twice")
+}
+
+func TestMutateTemplateDisabled(t *testing.T) {
+	m := &Mutator{
+		Logger:   logrus.NewEntry(logrus.New()),
+		Client:   fake.NewSimpleClientset(testServiceAccount()),
+		Provider: &fakeProvider{key: &AuthKey{Key: "key"}},
+	}
+
+	tmpl := testTemplate()
+	_, err := m.MutateTemplate(context.Background(), "apps", tmpl, false)
+	require.NoError(t, err)
+	assert.Equal(t, testTemplate(), tmpl)
+}
+
+func TestInjectSidecarReplacesTemplateSidecar(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{TemplateAnnotation: "true"}},
+		Spec: corev1.PodSpec{InitContainers: []corev1.Container{
+			{Name: "tailscale", Image: "template"},
+			{Name: "migrate"},
+		}},
+	}
+	require.NoError(t, injectSidecar(pod, &corev1.Container{Name: "tailscale", Image: "pod"}))
+	assert.Equal(t, []corev1.Container{{Name: "tailscale", Image: "pod"}, {Name: "migrate"}}, pod.Spec.InitContainers)
+
+	setVolume(pod, tunVolume())
+	setVolume(pod, tunVolume())
+	assert.Len(t, pod.Spec.Volumes, 1)
+}
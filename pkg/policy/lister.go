@@ -0,0 +1,62 @@
+// Package policy serves TailscaleSidecarPolicies to the webhook from an
+// informer cache so admissions never wait on the API server
+package policy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Lister lists TailscaleSidecarPolicies from an informer cache
+type Lister struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewLister returns a Lister watching policies in every namespace
+func NewLister(client dynamic.Interface, resync time.Duration) *Lister {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resync)
+	return &Lister{
+		informer: factory.ForResource(v1alpha1.TailscaleSidecarPolicyResource).Informer(),
+	}
+}
+
+// Run starts the informer and blocks until the context is cancelled
+func (l *Lister) Run(ctx context.Context) {
+	l.informer.Run(ctx.Done())
+}
+
+// WaitForSync blocks until the cache is populated or the context is cancelled
+func (l *Lister) WaitForSync(ctx context.Context) bool {
+	return cache.WaitForCacheSync(ctx.Done(), l.informer.HasSynced)
+}
+
+// List returns the policies of a namespace
+func (l *Lister) List(namespace string) ([]v1alpha1.TailscaleSidecarPolicy, error) {
+	objs, err := l.informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]v1alpha1.TailscaleSidecarPolicy, 0, len(objs))
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, fmt.Errorf("unexpected object %T in policy cache", obj)
+		}
+		var p v1alpha1.TailscaleSidecarPolicy
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &p); err != nil {
+			return nil, fmt.Errorf("could not parse policy %s/%s: %w", u.GetNamespace(), u.GetName(), err)
+		}
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,56 @@
+package policy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/apis/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestListerList(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+
+	policy := func(namespace, name, user string) *v1alpha1.TailscaleSidecarPolicy {
+		return &v1alpha1.TailscaleSidecarPolicy{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: v1alpha1.SchemeGroupVersion.String(),
+				Kind:       "TailscaleSidecarPolicy",
+			},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       v1alpha1.TailscaleSidecarPolicySpec{User: user},
+		}
+	}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme,
+		map[schema.GroupVersionResource]string{
+			v1alpha1.TailscaleSidecarPolicyResource: "TailscaleSidecarPolicyList",
+		},
+		policy("apps", "default", "apps"),
+		policy("other", "default", "other"),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l := NewLister(client, 0)
+	go l.Run(ctx)
+	require.True(t, l.WaitForSync(ctx))
+
+	got, err := l.List("apps")
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, "default", got[0].Name)
+	assert.Equal(t, "apps", got[0].Spec.User)
+
+	got, err = l.List("empty")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/admission"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// ServeHealth returns 200 when things are good and 503 once the server is
+// shutting down
+func (s *Server) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.Logger.WithField("uri", r.RequestURI).Debug("healthy")
+	fmt.Fprint(w, "OK")
+}
+
+// ServeMutatePods returns an admission review with pod mutations as a json
+// patch in the review response
+func (s *Server) ServeMutatePods(w http.ResponseWriter, r *http.Request) {
+	s.serveMutate(w, r, admission.Admitter.MutatePodReview)
+}
+
+// ServeMutateWorkloads returns an admission review with the mutations of
+// the pod template of a workload as a json patch in the review response
+func (s *Server) ServeMutateWorkloads(w http.ResponseWriter, r *http.Request) {
+	s.serveMutate(w, r, admission.Admitter.MutateWorkloadReview)
+}
+
+func (s *Server) serveMutate(w http.ResponseWriter, r *http.Request, review func(admission.Admitter, context.Context) (*admissionv1.AdmissionReview, error)) {
+	logger := s.Logger.WithField("uri", r.RequestURI)
+	logger.Debug("received mutation request")
+
+	in, err := parseRequest(*r)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	adm := admission.Admitter{
+		Logger:  logger,
+		Request: in.Request,
+		Mutator: s.Mutator,
+	}
+
+	ctx, cancel := admissionContext(r)
+	defer cancel()
+
+	out, err := review(adm, ctx)
+	if err != nil {
+		e := fmt.Sprintf("could not generate admission response: %v", err)
+		logger.Error(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jout, err := json.Marshal(out)
+	if err != nil {
+		e := fmt.Sprintf("could not parse admission response: %v", err)
+		logger.Error(e)
+		http.Error(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("sending response")
+	logger.Debugf("%s", jout)
+	fmt.Fprintf(w, "%s", jout)
+}
+
+const (
+	// DefaultAdmissionTimeout is used when the API server does not pass the
+	// webhook timeout, it is the API server default
+	DefaultAdmissionTimeout = 10 * time.Second
+	// responseMargin is kept from the timeout to send the response
+	responseMargin = 250 * time.Millisecond
+)
+
+// admissionContext bounds a review by the timeout the API server passes to
+// webhooks, so slow calls fail before the API server gives up on us
+func admissionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := DefaultAdmissionTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			timeout = d
+		}
+	}
+	if timeout > 2*responseMargin {
+		timeout -= responseMargin
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// parseRequest extracts an AdmissionReview from an http.Request if possible
+func parseRequest(r http.Request) (*admissionv1.AdmissionReview, error) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		return nil, fmt.Errorf("Content-Type: %q should be %q",
+			r.Header.Get("Content-Type"), "application/json")
+	}
+
+	bodybuf := new(bytes.Buffer)
+	bodybuf.ReadFrom(r.Body)
+	body := bodybuf.Bytes()
+
+	if len(body) == 0 {
+		return nil, fmt.Errorf("admission request body is empty")
+	}
+
+	var a admissionv1.AdmissionReview
+
+	if err := json.Unmarshal(body, &a); err != nil {
+		return nil, fmt.Errorf("could not parse admission review request: %v", err)
+	}
+
+	if a.Request == nil {
+		return nil, fmt.Errorf("admission review can't be used: Request field is nil")
+	}
+
+	return &a, nil
+}
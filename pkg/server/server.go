@@ -0,0 +1,125 @@
+// Package server owns the listener of the admission webhook, it serves
+// admission reviews with sane timeouts, reloads its TLS keypair when it is
+// rotated and drains in-flight reviews on shutdown
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/metrics"
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultReadHeaderTimeout = 5 * time.Second
+	DefaultReadTimeout       = 10 * time.Second
+	// DefaultWriteTimeout covers the longest webhook timeoutSeconds allowed
+	DefaultWriteTimeout    = 30 * time.Second
+	DefaultIdleTimeout     = 120 * time.Second
+	DefaultShutdownDelay   = 5 * time.Second
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultCertPoll        = 10 * time.Second
+)
+
+// Server serves the webhook endpoints
+type Server struct {
+	// Addr to listen on, e.g. ":443"
+	Addr string
+	// CertFile and KeyFile enable TLS when set
+	CertFile string
+	KeyFile  string
+	Logger   *logrus.Entry
+	Mutator  *mutation.Mutator
+	// ShutdownDelay is how long health checks fail before the listener is
+	// closed, giving the endpoints controller time to stop routing to us
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds how long in-flight reviews are drained for
+	ShutdownTimeout time.Duration
+
+	draining atomic.Bool
+}
+
+// Handler returns the routes served by the webhook
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate-pods", s.ServeMutatePods)
+	mux.HandleFunc("/mutate-workloads", s.ServeMutateWorkloads)
+	mux.HandleFunc("/health", s.ServeHealth)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// Run serves until the context is cancelled, it then drains in-flight
+// requests and returns
+func (s *Server) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		ReadTimeout:       DefaultReadTimeout,
+		WriteTimeout:      DefaultWriteTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+		// in-flight reviews must not be cancelled when shutdown starts
+		BaseContext: func(net.Listener) context.Context { return context.WithoutCancel(ctx) },
+	}
+
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	if s.CertFile != "" || s.KeyFile != "" {
+		kp, err := newKeypairReloader(s.CertFile, s.KeyFile)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		go kp.Watch(ctx, s.Logger, DefaultCertPoll)
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: kp.GetCertificate,
+		}
+		ln = tls.NewListener(ln, srv.TLSConfig)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		s.Logger.Infof("listening on %s", ln.Addr())
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.draining.Store(true)
+	s.Logger.Infof("shutting down, failing health checks for %s", s.ShutdownDelay)
+	time.Sleep(s.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	s.Logger.Info("shut down")
+	return nil
+}
+
+func (s *Server) shutdownTimeout() time.Duration {
+	if s.ShutdownTimeout > 0 {
+		return s.ShutdownTimeout
+	}
+	return DefaultShutdownTimeout
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alam0rt/tailscale-sidecar-injector/pkg/mutation"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func testServer() *Server {
+	return &Server{
+		Logger:  logrus.NewEntry(logrus.New()),
+		Mutator: mutation.NewMutator(logrus.NewEntry(logrus.New())),
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := map[string]struct {
+		contentType string
+		body        string
+		wantErr     string
+	}{
+		"wrong content type": {"text/plain", `{}`, "Content-Type"},
+		"empty body":         {"application/json", ``, "empty"},
+		"not json":           {"application/json", `{`, "could not parse"},
+		"no request":         {"application/json", `{}`, "Request field is nil"},
+		"valid":              {"application/json", `{"request":{"uid":"1"}}`, ""},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/mutate-pods", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+
+			got, err := parseRequest(*r)
+			if test.wantErr != "" {
+				assert.ErrorContains(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.EqualValues(t, "1", got.Request.UID)
+		})
+	}
+}
+
+func TestServeMutatePodsIgnoresUnlabelledPod(t *testing.T) {
+	body := `{"request":{"uid":"1","kind":{"kind":"Pod","version":"v1"},"object":{"metadata":{"name":"web"}}}}`
+	r := httptest.NewRequest(http.MethodPost, "/mutate-pods", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	testServer().Handler().ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"allowed":true`)
+}
+
+func TestServeMutatePodsDeniesUnmutablePod(t *testing.T) {
+	body := `{"request":{"uid":"1","kind":{"kind":"Pod","version":"v1"},"object":{"metadata":{"name":"web",` +
+		`"labels":{"tailscale-inject":"true"},"annotations":{"tailscale.iced.cool/failure-policy":"retry"}}}}}`
+	r := httptest.NewRequest(http.MethodPost, "/mutate-pods", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	testServer().Handler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code, "the pod is denied in the review")
+	var review admissionv1.AdmissionReview
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &review))
+	require.NotNil(t, review.Response)
+	assert.EqualValues(t, "1", review.Response.UID)
+	assert.False(t, review.Response.Allowed)
+	require.NotNil(t, review.Response.Result)
+	assert.Contains(t, review.Response.Result.Message, `invalid failure policy: "retry"`)
+}
+
+func TestAdmissionContext(t *testing.T) {
+	tests := map[string]time.Duration{
+		"/mutate-pods":               DefaultAdmissionTimeout - responseMargin,
+		"/mutate-pods?timeout=5s":    5*time.Second - responseMargin,
+		"/mutate-pods?timeout=300ms": 300 * time.Millisecond,
+		"/mutate-pods?timeout=bogus": DefaultAdmissionTimeout - responseMargin,
+	}
+
+	for target, want := range tests {
+		ctx, cancel := admissionContext(httptest.NewRequest(http.MethodPost, target, nil))
+		deadline, ok := ctx.Deadline()
+		cancel()
+		require.True(t, ok, target)
+		assert.WithinDuration(t, time.Now().Add(want), deadline, 100*time.Millisecond, target)
+	}
+}
+
+func TestServeHealthDraining(t *testing.T) {
+	s := testServer()
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	s.draining.Store(true)
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestRunDrainsInFlightRequests(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := testServer()
+	s.Addr = addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + addr + "/health")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a request still being sent when shutdown starts must be answered
+	pr, pw := io.Pipe()
+	respc := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/mutate-pods", pr)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		respc <- resp
+	}()
+	pw.Write([]byte(`{"request":{"uid":"1","kind":{"kind":"Pod"},`))
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	pw.Write([]byte(`"object":{"metadata":{"name":"web"}}}}`))
+	pw.Close()
+
+	resp := <-respc
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	assert.NoError(t, <-done)
+}
+
+// writeKeypair writes a self-signed keypair for commonName to dir
+func writeKeypair(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, kp *keypairReloader) string {
+	t.Helper()
+	cert, err := kp.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestKeypairReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeypair(t, dir, "first")
+
+	kp, err := newKeypairReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "first", servedCommonName(t, kp))
+
+	reloaded, err := kp.reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	writeKeypair(t, dir, "rotated")
+	reloaded, err = kp.reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "rotated", servedCommonName(t, kp))
+
+	// a half written rotation keeps serving the previous keypair
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	_, err = kp.reload()
+	assert.Error(t, err)
+	assert.Equal(t, "rotated", servedCommonName(t, kp))
+}
+
+func TestServeMetrics(t *testing.T) {
+	s := testServer()
+
+	body := `{"request":{"uid":"1","kind":{"kind":"Pod","version":"v1"},"object":{"metadata":{"name":"web"}}}}`
+	r := httptest.NewRequest(http.MethodPost, "/mutate-pods", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	s.Handler().ServeHTTP(httptest.NewRecorder(), r)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "tailscale_sidecar_injector_admission_requests_total")
+}
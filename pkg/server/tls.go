@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// keypairReloader serves the TLS keypair found on disk, reloading it when
+// cert-manager rotates the secret it is mounted from
+type keypairReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	raw      []byte
+}
+
+func newKeypairReloader(certFile, keyFile string) (*keypairReloader, error) {
+	kp := &keypairReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := kp.reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// reload loads the keypair if the files changed, it reports whether the
+// served certificate was replaced
+func (kp *keypairReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(kp.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(kp.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	raw := append(certPEM, keyPEM...)
+	if bytes.Equal(raw, kp.raw) {
+		return false, nil
+	}
+
+	// the certificate and key are not updated atomically, a mismatched
+	// pair is retried on the next poll
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	kp.raw = raw
+	kp.cert.Store(&cert)
+	return true, nil
+}
+
+// Watch polls the keypair every interval until the context is cancelled
+func (kp *keypairReloader) Watch(ctx context.Context, logger logrus.FieldLogger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := kp.reload()
+			if err != nil {
+				logger.Errorf("could not reload TLS keypair, serving the previous one: %v", err)
+				continue
+			}
+			if reloaded {
+				logger.Info("reloaded TLS keypair")
+			}
+		}
+	}
+}
+
+func (kp *keypairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.cert.Load(), nil
+}
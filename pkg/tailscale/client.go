@@ -0,0 +1,132 @@
+// Package tailscale is a minimal client for the Tailscale SaaS API
+package tailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+type Client struct {
+	URL       *url.URL
+	Tailnet   string
+	UserAgent string
+	HTTP      *http.Client
+	Logger    *slog.Logger
+}
+
+const (
+	DefaultURL       string        = "https://api.tailscale.com"
+	DefaultTailnet   string        = "-"
+	DefaultUserAgent string        = "tailscale-sidecar-injector"
+	DefaultTimeout   time.Duration = 5 * time.Second
+	basePath                       = "/api/v2"
+	tokenPath                      = "/api/v2/oauth/token"
+)
+
+// New returns a client authenticating with OAuth client credentials, empty
+// arguments fall back to TS_API_CLIENT_ID, TS_API_CLIENT_SECRET and
+// TS_API_URL
+func New(ctx context.Context, clientID, clientSecret, address string) (*Client, error) {
+	res := &Client{}
+
+	res.Logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug,
+	}))
+
+	if clientID == "" {
+		clientID = os.Getenv("TS_API_CLIENT_ID")
+	}
+	if clientSecret == "" {
+		clientSecret = os.Getenv("TS_API_CLIENT_SECRET")
+	}
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("tailscale oauth client id and secret must be provided")
+	}
+
+	if address == "" {
+		address = os.Getenv("TS_API_URL")
+	}
+	if address == "" {
+		address = DefaultURL
+	}
+
+	if u, err := url.Parse(address); err != nil {
+		return nil, err
+	} else {
+		res.URL = u
+	}
+
+	res.Tailnet = DefaultTailnet
+	res.UserAgent = DefaultUserAgent
+
+	creds := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     res.URL.JoinPath(tokenPath).String(),
+	}
+	res.HTTP = creds.Client(ctx)
+	res.HTTP.Timeout = DefaultTimeout
+
+	return res, nil
+}
+
+func (c *Client) Keys() *KeyClient {
+	return &KeyClient{
+		client: c,
+	}
+}
+
+func (c *Client) buildPath(parts ...string) *url.URL {
+	parts = append([]string{basePath}, parts...)
+	return c.URL.JoinPath(parts...)
+}
+
+func (c *Client) do(ctx context.Context, method string, uri *url.URL, body any, v any) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, uri.String(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	c.Logger.Debug("making http request", "method", req.Method, "url", req.URL.String())
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		c.Logger.ErrorContext(ctx, "failed making the request", "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		var e struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		c.Logger.ErrorContext(ctx, "unexpected status code", "status", resp.StatusCode, "message", e.Message)
+		return fmt.Errorf("tailscale api: unexpected status code %d: %s", resp.StatusCode, e.Message)
+	}
+
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient returns a client of a server exchanging the credentials id and
+// secret for a token and passing the other requests to handler. tokens
+// counts the tokens handed out
+func testClient(t *testing.T, handler http.HandlerFunc) (*Client, *atomic.Int32) {
+	t.Helper()
+
+	tokens := &atomic.Int32{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(tokenPath, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		id, secret, ok := r.BasicAuth()
+		if !ok {
+			id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+		if id != "id" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tokens.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, DefaultUserAgent, r.Header.Get("User-Agent"))
+		handler(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	c, err := New(context.Background(), "id", "secret", srv.URL)
+	require.NoError(t, err)
+	return c, tokens
+}
+
+// expect asserts the request made and replies with resp
+func expect(t *testing.T, method, path, body string, resp any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, method, r.Method)
+		assert.Equal(t, path, r.URL.Path)
+
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if body == "" {
+			assert.Empty(t, b)
+		} else {
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			assert.JSONEq(t, body, string(b))
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Setenv("TS_API_CLIENT_ID", "")
+	t.Setenv("TS_API_CLIENT_SECRET", "")
+	t.Setenv("TS_API_URL", "")
+
+	_, err := New(context.Background(), "id", "", "")
+	assert.ErrorContains(t, err, "must be provided")
+
+	t.Setenv("TS_API_CLIENT_ID", "env-id")
+	t.Setenv("TS_API_CLIENT_SECRET", "env-secret")
+	c, err := New(context.Background(), "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultURL, c.URL.String())
+	assert.Equal(t, DefaultTailnet, c.Tailnet)
+}
+
+func TestTokenExchange(t *testing.T) {
+	ctx := context.Background()
+	c, tokens := testClient(t, expect(t, http.MethodDelete, "/api/v2/tailnet/-/keys/k1", "", struct{}{}))
+
+	require.NoError(t, c.Keys().Delete(ctx, "k1"))
+	require.NoError(t, c.Keys().Delete(ctx, "k1"))
+	assert.EqualValues(t, 1, tokens.Load(), "the token is reused until it expires")
+}
+
+func TestTokenExchangeRejected(t *testing.T) {
+	c, tokens := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the API is called without a token")
+	})
+	wrong, err := New(context.Background(), "id", "wrong", c.URL.String())
+	require.NoError(t, err)
+
+	assert.Error(t, wrong.Keys().Delete(context.Background(), "k1"))
+	assert.Zero(t, tokens.Load())
+}
+
+func TestDoUnexpectedStatus(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		wantErr string
+	}{
+		"with message":    {http.StatusForbidden, `{"message":"tags not permitted"}`, "unexpected status code 403: tags not permitted"},
+		"without message": {http.StatusInternalServerError, `oops`, "unexpected status code 500: "},
+		"not modified":    {http.StatusNotModified, ``, "unexpected status code 304"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, _ := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			})
+
+			_, err := c.Keys().Create(context.Background(), CreateKeyRequest{})
+			assert.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package tailscale
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type KeyClient struct {
+	client *Client
+}
+
+type KeyDeviceCreateCapabilities struct {
+	Reusable      bool     `json:"reusable"`
+	Ephemeral     bool     `json:"ephemeral"`
+	Preauthorized bool     `json:"preauthorized"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+type KeyCapabilities struct {
+	Devices struct {
+		Create KeyDeviceCreateCapabilities `json:"create"`
+	} `json:"devices"`
+}
+
+type Key struct {
+	ID           string          `json:"id"`
+	Key          string          `json:"key"`
+	Description  string          `json:"description"`
+	Created      time.Time       `json:"created"`
+	Expires      time.Time       `json:"expires"`
+	Capabilities KeyCapabilities `json:"capabilities"`
+}
+
+type CreateKeyRequest struct {
+	Capabilities  KeyCapabilities `json:"capabilities"`
+	ExpirySeconds int64           `json:"expirySeconds"`
+	Description   string          `json:"description,omitempty"`
+}
+
+// Create mints a new auth key in the client's tailnet
+func (k *KeyClient) Create(ctx context.Context, req CreateKeyRequest) (*Key, error) {
+	key := &Key{}
+	uri := k.client.buildPath("tailnet", k.client.Tailnet, "keys")
+	if err := k.client.do(ctx, http.MethodPost, uri, req, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Delete revokes an auth key
+func (k *KeyClient) Delete(ctx context.Context, id string) error {
+	uri := k.client.buildPath("tailnet", k.client.Tailnet, "keys", id)
+	return k.client.do(ctx, http.MethodDelete, uri, nil, nil)
+}
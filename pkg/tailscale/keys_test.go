@@ -0,0 +1,51 @@
+package tailscale
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyClient(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("create", func(t *testing.T) {
+		req := CreateKeyRequest{ExpirySeconds: 120, Description: "web"}
+		req.Capabilities.Devices.Create = KeyDeviceCreateCapabilities{Ephemeral: true, Preauthorized: true, Tags: []string{"tag:pod"}}
+		want := Key{ID: "k1", Key: "tskey-auth-k1", Expires: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+		c, _ := testClient(t, expect(t, http.MethodPost, "/api/v2/tailnet/-/keys",
+			`{"capabilities":{"devices":{"create":{"reusable":false,"ephemeral":true,"preauthorized":true,"tags":["tag:pod"]}}},"expirySeconds":120,"description":"web"}`,
+			want))
+		got, err := c.Keys().Create(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, &want, got)
+	})
+
+	t.Run("create in tailnet", func(t *testing.T) {
+		c, _ := testClient(t, expect(t, http.MethodPost, "/api/v2/tailnet/example.com/keys",
+			`{"capabilities":{"devices":{"create":{"reusable":false,"ephemeral":false,"preauthorized":false}}},"expirySeconds":0}`,
+			Key{ID: "k2"}))
+		c.Tailnet = "example.com"
+		got, err := c.Keys().Create(ctx, CreateKeyRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "k2", got.ID)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		c, _ := testClient(t, expect(t, http.MethodDelete, "/api/v2/tailnet/-/keys/k1", "", struct{}{}))
+		assert.NoError(t, c.Keys().Delete(ctx, "k1"))
+	})
+
+	t.Run("delete unknown key", func(t *testing.T) {
+		c, _ := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"not found"}`))
+		})
+		assert.ErrorContains(t, c.Keys().Delete(ctx, "k9"), "unexpected status code 404: not found")
+	})
+}